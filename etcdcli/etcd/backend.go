@@ -0,0 +1,130 @@
+package etcd
+
+import (
+	"context"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// Backend is the storage a Client talks to. It speaks the v2 keys model
+// (directories, TTLs, indexes, compare-and-swap through SetOptions and
+// DeleteOptions) because that is what every caller of Client is written
+// against:
+//
+//	get / list prefix   Get, Recursive for the whole subtree
+//	put with TTL        Set with SetOptions.TTL
+//	CAS                 Set or Delete with PrevValue, PrevIndex, PrevExist
+//	delete              Delete
+//	watch               Watcher
+//
+// etcdv2.KeysAPI satisfies it as is. NewV3Backend maps it onto an etcd v3
+// cluster and NewMemoryBackend keeps everything in memory for tests, on top
+// of the same mapping; NewMemoryV2Backend is the v2 store in memory.
+type Backend interface {
+	Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error)
+	Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error)
+	Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error)
+	CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error)
+	Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher
+}
+
+var _ Backend = etcdv2.KeysAPI(nil)
+
+// memberLister is implemented by backends that know the cluster members
+// without a v2 client.
+type memberLister interface {
+	Members(ctx context.Context) ([]etcdv2.Member, error)
+}
+
+// Backend returns the backend the client runs on.
+func (c *Client) Backend() Backend {
+	return c.backend
+}
+
+func etcdError(code int, message string, cause string, index int64) error {
+	return etcdv2.Error{Code: code, Message: message, Cause: cause, Index: uint64(index)}
+}
+
+// compareByIndex turns a compare by value into a compare by index, for
+// backends that store values in another form than they return them. It
+// reads key, decodes its value and returns the index to swap by, or the
+// error the compare by value would have failed with.
+func compareByIndex(ctx context.Context, next Backend, key, prevValue string, prevIndex uint64, decode func(key, value string) (string, error)) (uint64, error) {
+	resp, err := next.Get(ctx, key, &etcdv2.GetOptions{Quorum: true})
+	if err != nil {
+		return 0, err
+	}
+	current, err := decode(key, resp.Node.Value)
+	if err != nil {
+		return 0, err
+	}
+	if current != prevValue || prevIndex != 0 && prevIndex != resp.Node.ModifiedIndex {
+		// no values in the cause, it ends up in logs
+		return 0, etcdError(etcdv2.ErrorCodeTestFailed, "Compare failed", key, int64(resp.Index))
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+// getOp, setOp and deleteOp name the operation of a call in metrics, logs
+// and spans.
+func getOp(opts *etcdv2.GetOptions) string {
+	if opts != nil && opts.Recursive {
+		return "list"
+	}
+	return "get"
+}
+
+func setOp(opts *etcdv2.SetOptions) string {
+	switch {
+	case opts == nil:
+	case opts.PrevValue != "" || opts.PrevIndex != 0:
+		return "cas"
+	case opts.PrevExist == etcdv2.PrevNoExist:
+		return "create"
+	case opts.PrevExist == etcdv2.PrevExist:
+		return "update"
+	}
+	return "set"
+}
+
+func deleteOp(opts *etcdv2.DeleteOptions) string {
+	if opts != nil && (opts.PrevValue != "" || opts.PrevIndex != 0) {
+		return "cad"
+	}
+	return "delete"
+}
+
+// opName is the op label of an intercepted call.
+func opName(call *Call) string {
+	switch opts := call.Options.(type) {
+	case *etcdv2.GetOptions:
+		return getOp(opts)
+	case *etcdv2.SetOptions:
+		return setOp(opts)
+	case *etcdv2.DeleteOptions:
+		return deleteOp(opts)
+	}
+	return call.Op
+}
+
+// unwrapper is implemented by backends that wrap another one, so the client
+// can still reach the v3 client or the member list underneath.
+type unwrapper interface {
+	Unwrap() Backend
+}
+
+// findBackend returns the first backend in the chain starting at b that
+// matches, or nil.
+func findBackend(b Backend, match func(Backend) bool) Backend {
+	for b != nil {
+		if match(b) {
+			return b
+		}
+		u, ok := b.(unwrapper)
+		if !ok {
+			return nil
+		}
+		b = u.Unwrap()
+	}
+	return nil
+}
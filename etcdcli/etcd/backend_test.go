@@ -0,0 +1,536 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// testBackends are the backends the v2 semantics are checked against, the
+// v2 one being the reference for the v3 mapping.
+var testBackends = []struct {
+	name string
+	new  func() Backend
+}{
+	{"v2", NewMemoryV2Backend},
+	{"v3", NewMemoryBackend},
+}
+
+// newTestClient returns a client on a fresh memory backend, closed with
+// the test.
+func newTestClient(t *testing.T) *Client {
+	c, err := NewClientWithConfig(Config{Backend: NewMemoryBackend()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// backendStep is one request of a backend test and what it must return.
+type backendStep struct {
+	op    string // get, set or delete
+	key   string
+	value string
+	get   *etcdv2.GetOptions
+	set   *etcdv2.SetOptions
+	del   *etcdv2.DeleteOptions
+	// prevIndex compares against the modified index of the previous step
+	prevIndex bool
+	// only runs the step on one backend, where v2 and v3 differ on purpose
+	only string
+
+	code   int      // error code, 0 for success
+	action string   // action of the response, when set
+	want   string   // value of the node, for get
+	keys   []string // keys below the node, for get when set
+	prev   string   // value of the previous node, when set
+}
+
+func runBackendSteps(t *testing.T, backend string, b Backend, steps []backendStep) {
+	ctx := context.Background()
+	var last *etcdv2.Response
+	for i, step := range steps {
+		if step.only != "" && step.only != backend {
+			continue
+		}
+		var resp *etcdv2.Response
+		var err error
+		switch step.op {
+		case "get":
+			resp, err = b.Get(ctx, step.key, step.get)
+		case "set":
+			opts := etcdv2.SetOptions{}
+			if step.set != nil {
+				opts = *step.set
+			}
+			if step.prevIndex {
+				opts.PrevIndex = last.Node.ModifiedIndex
+			}
+			resp, err = b.Set(ctx, step.key, step.value, &opts)
+		case "delete":
+			opts := etcdv2.DeleteOptions{}
+			if step.del != nil {
+				opts = *step.del
+			}
+			if step.prevIndex {
+				opts.PrevIndex = last.Node.ModifiedIndex
+			}
+			resp, err = b.Delete(ctx, step.key, &opts)
+		default:
+			t.Fatalf("step %d: unknown op %q", i, step.op)
+		}
+
+		if step.code != 0 {
+			if ErrorCode(err) != step.code {
+				t.Fatalf("step %d: %s %s: want error %d, got %v", i, step.op, step.key, step.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %d: %s %s: %v", i, step.op, step.key, err)
+		}
+		if step.action != "" && resp.Action != step.action {
+			t.Errorf("step %d: %s %s: action %q, want %q", i, step.op, step.key, resp.Action, step.action)
+		}
+		if step.op == "get" && !resp.Node.Dir && resp.Node.Value != step.want {
+			t.Errorf("step %d: get %s: value %q, want %q", i, step.key, resp.Node.Value, step.want)
+		}
+		if step.keys != nil {
+			if got := nodeKeys(resp.Node); !reflect.DeepEqual(got, step.keys) {
+				t.Errorf("step %d: get %s: keys %v, want %v", i, step.key, got, step.keys)
+			}
+		}
+		if step.prev != "" && (resp.PrevNode == nil || resp.PrevNode.Value != step.prev) {
+			t.Errorf("step %d: %s %s: previous node %+v, want value %q", i, step.op, step.key, resp.PrevNode, step.prev)
+		}
+		last = resp
+	}
+}
+
+// nodeKeys lists the keys below node, sorted.
+func nodeKeys(node *etcdv2.Node) []string {
+	keys := []string{}
+	var walk func(n *etcdv2.Node)
+	walk = func(n *etcdv2.Node) {
+		for _, child := range n.Nodes {
+			keys = append(keys, child.Key)
+			walk(child)
+		}
+	}
+	walk(node)
+	sort.Strings(keys)
+	return keys
+}
+
+func TestBackendSemantics(t *testing.T) {
+	dir := &etcdv2.SetOptions{Dir: true}
+	tests := []struct {
+		name  string
+		steps []backendStep
+	}{
+		{"set and get", []backendStep{
+			{op: "set", key: "/a", value: "1", action: "set"},
+			{op: "get", key: "/a", want: "1", action: "get"},
+			{op: "set", key: "a/", value: "2", action: "set", prev: "1"},
+			{op: "get", key: "/a", want: "2"},
+			{op: "get", key: "/missing", code: etcdv2.ErrorCodeKeyNotFound},
+		}},
+		{"create", []backendStep{
+			{op: "set", key: "/a", value: "1", set: &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist}, action: "create"},
+			{op: "set", key: "/a", value: "2", set: &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist}, code: etcdv2.ErrorCodeNodeExist},
+			{op: "get", key: "/a", want: "1"},
+		}},
+		{"update", []backendStep{
+			{op: "set", key: "/a", value: "1", set: &etcdv2.SetOptions{PrevExist: etcdv2.PrevExist}, code: etcdv2.ErrorCodeKeyNotFound},
+			{op: "set", key: "/a", value: "1"},
+			{op: "set", key: "/a", value: "2", set: &etcdv2.SetOptions{PrevExist: etcdv2.PrevExist}, action: "update", prev: "1"},
+			{op: "get", key: "/a", want: "2"},
+		}},
+		{"compare and swap", []backendStep{
+			{op: "set", key: "/missing", value: "1", set: &etcdv2.SetOptions{PrevValue: "0"}, code: etcdv2.ErrorCodeKeyNotFound},
+			{op: "set", key: "/a", value: "1"},
+			{op: "set", key: "/a", value: "2", set: &etcdv2.SetOptions{PrevValue: "0"}, code: etcdv2.ErrorCodeTestFailed},
+			{op: "set", key: "/a", value: "2", set: &etcdv2.SetOptions{PrevValue: "1"}, action: "compareAndSwap", prev: "1"},
+			{op: "set", key: "/a", value: "3", prevIndex: true, action: "compareAndSwap", prev: "2"},
+			{op: "set", key: "/a", value: "4", set: &etcdv2.SetOptions{PrevIndex: 1 << 40}, code: etcdv2.ErrorCodeTestFailed},
+			{op: "set", key: "/a", value: "4", set: &etcdv2.SetOptions{PrevValue: "3", PrevIndex: 1 << 40}, code: etcdv2.ErrorCodeTestFailed},
+			{op: "get", key: "/a", want: "3"},
+			{op: "set", key: "/d", set: dir},
+			{op: "set", key: "/d", value: "1", set: &etcdv2.SetOptions{PrevValue: "0"}, code: etcdv2.ErrorCodeNotFile},
+		}},
+		{"directories", []backendStep{
+			{op: "set", key: "/d", set: dir, action: "set"},
+			{op: "get", key: "/d", keys: []string{}},
+			{op: "set", key: "/d/a", value: "1"},
+			{op: "set", key: "/d/e", set: dir},
+			{op: "get", key: "/d", keys: []string{"/d/a", "/d/e"}},
+			{op: "set", key: "/d", value: "1", code: etcdv2.ErrorCodeNotFile},
+			{op: "set", key: "/d", set: dir, code: etcdv2.ErrorCodeNotFile},
+			{op: "set", key: "/d", set: &etcdv2.SetOptions{Dir: true, PrevExist: etcdv2.PrevExist}, action: "update"},
+			{op: "set", key: "/d/a/b", value: "1", code: etcdv2.ErrorCodeNotDir},
+			{op: "set", key: "/d/a/b", set: dir, code: etcdv2.ErrorCodeNotDir},
+			{op: "set", key: "/d/a", set: dir, action: "set", prev: "1"},
+			{op: "get", key: "/d/a", keys: []string{}},
+		}},
+		{"implicit parents", []backendStep{
+			{op: "set", key: "/p/q/r", value: "1"},
+			{op: "get", key: "/p", keys: []string{"/p/q"}},
+			{op: "get", key: "/p", get: &etcdv2.GetOptions{Recursive: true}, keys: []string{"/p/q", "/p/q/r"}},
+			{op: "get", key: "/", keys: []string{"/p"}},
+		}},
+		{"hidden", []backendStep{
+			{op: "set", key: "/h/_x", value: "1"},
+			{op: "set", key: "/h/_d/y", value: "2"},
+			{op: "set", key: "/h/z", value: "3"},
+			{op: "get", key: "/h", get: &etcdv2.GetOptions{Recursive: true}, keys: []string{"/h/z"}},
+			{op: "get", key: "/h/_x", want: "1"},
+			{op: "get", key: "/h/_d", keys: []string{"/h/_d/y"}},
+		}},
+		{"root", []backendStep{
+			{op: "set", key: "/", value: "1", code: etcdv2.ErrorCodeRootROnly},
+			{op: "delete", key: "/", del: &etcdv2.DeleteOptions{Recursive: true}, code: etcdv2.ErrorCodeRootROnly},
+		}},
+		{"delete", []backendStep{
+			{op: "delete", key: "/a", code: etcdv2.ErrorCodeKeyNotFound},
+			{op: "set", key: "/a", value: "1"},
+			{op: "delete", key: "/a", action: "delete", prev: "1"},
+			{op: "get", key: "/a", code: etcdv2.ErrorCodeKeyNotFound},
+		}},
+		{"compare and delete", []backendStep{
+			{op: "set", key: "/a", value: "1"},
+			{op: "delete", key: "/a", del: &etcdv2.DeleteOptions{PrevValue: "0"}, code: etcdv2.ErrorCodeTestFailed},
+			{op: "delete", key: "/a", del: &etcdv2.DeleteOptions{PrevIndex: 1 << 40}, code: etcdv2.ErrorCodeTestFailed},
+			{op: "get", key: "/a", want: "1"},
+			{op: "delete", key: "/a", prevIndex: true, action: "compareAndDelete", prev: "1"},
+			{op: "set", key: "/d", set: dir},
+			{op: "delete", key: "/d", del: &etcdv2.DeleteOptions{PrevValue: "0", Dir: true}, code: etcdv2.ErrorCodeNotFile},
+		}},
+		{"delete directory", []backendStep{
+			{op: "set", key: "/d/a", value: "1"},
+			{op: "delete", key: "/d", code: etcdv2.ErrorCodeNotFile},
+			{op: "delete", key: "/d", del: &etcdv2.DeleteOptions{Dir: true}, code: etcdv2.ErrorCodeDirNotEmpty},
+			{op: "delete", key: "/d", del: &etcdv2.DeleteOptions{Recursive: true}, action: "delete"},
+			{op: "get", key: "/d/a", code: etcdv2.ErrorCodeKeyNotFound},
+			{op: "set", key: "/e", set: dir},
+			{op: "delete", key: "/e", del: &etcdv2.DeleteOptions{Dir: true}, action: "delete"},
+			{op: "get", key: "/e", code: etcdv2.ErrorCodeKeyNotFound},
+		}},
+		{"delete last child", []backendStep{
+			{op: "set", key: "/p/a", value: "1"},
+			{op: "delete", key: "/p/a"},
+			// v2 keeps the directory, v3 has no key left to hold it
+			{op: "get", key: "/p", keys: []string{}, only: "v2"},
+			{op: "get", key: "/p", code: etcdv2.ErrorCodeKeyNotFound, only: "v3"},
+		}},
+		{"refresh", []backendStep{
+			{op: "set", key: "/a", set: &etcdv2.SetOptions{TTL: time.Minute, Refresh: true, PrevExist: etcdv2.PrevExist}, code: etcdv2.ErrorCodeKeyNotFound},
+			{op: "set", key: "/a", value: "1", set: &etcdv2.SetOptions{TTL: time.Minute}},
+			{op: "set", key: "/a", value: "2", set: &etcdv2.SetOptions{TTL: time.Minute, Refresh: true, PrevExist: etcdv2.PrevExist}, code: etcdv2.ErrorCodeInvalidField},
+			{op: "set", key: "/a", set: &etcdv2.SetOptions{TTL: time.Minute, Refresh: true, PrevExist: etcdv2.PrevExist}},
+			{op: "get", key: "/a", want: "1"},
+		}},
+	}
+
+	for _, backend := range testBackends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				runBackendSteps(t, backend.name, backend.new(), tt.steps)
+			})
+		}
+	}
+}
+
+func TestBackendTTL(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := backend.new()
+			set, err := b.Set(ctx, "/t/a", "1", &etcdv2.SetOptions{TTL: 1500 * time.Millisecond, PrevExist: etcdv2.PrevNoExist})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := b.Watcher("/t", &etcdv2.WatcherOptions{Recursive: true, AfterIndex: set.Index - 1})
+			resp, err := b.Get(ctx, "/t/a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// rounded up to whole seconds
+			if resp.Node.TTL != 2 || resp.Node.Expiration == nil {
+				t.Errorf("ttl %d, expiration %v", resp.Node.TTL, resp.Node.Expiration)
+			}
+
+			wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			var actions []string
+			for len(actions) < 2 {
+				resp, err := w.Next(wctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				actions = append(actions, resp.Action+" "+resp.Node.Key)
+			}
+			if want := []string{"create /t/a", "expire /t/a"}; !reflect.DeepEqual(actions, want) {
+				t.Errorf("events %v, want %v", actions, want)
+			}
+			if _, err := b.Get(ctx, "/t/a", nil); !IsEtcdNotFound(err) {
+				t.Errorf("get after expiry: %v", err)
+			}
+		})
+	}
+}
+
+func TestBackendCreateInOrder(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := backend.new()
+			var created []string
+			for _, value := range []string{"x", "y", "z"} {
+				resp, err := b.CreateInOrder(ctx, "/q", value, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Action != "create" || !strings.HasPrefix(resp.Node.Key, "/q/") {
+					t.Fatalf("created %s %s", resp.Action, resp.Node.Key)
+				}
+				created = append(created, resp.Node.Key)
+				// unrelated writes in between move the index on
+				if _, err := b.Set(ctx, "/other", value, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !sort.StringsAreSorted(created) {
+				t.Errorf("keys out of order: %v", created)
+			}
+
+			resp, err := b.Get(ctx, "/q", &etcdv2.GetOptions{Sort: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values []string
+			for _, node := range resp.Node.Nodes {
+				values = append(values, node.Value)
+			}
+			if got := strings.Join(values, ","); got != "x,y,z" {
+				t.Errorf("values %s", got)
+			}
+
+			b.Set(ctx, "/f", "1", nil)
+			if _, err := b.CreateInOrder(ctx, "/f", "x", nil); ErrorCode(err) != etcdv2.ErrorCodeNotDir {
+				t.Errorf("create in a file: %v", err)
+			}
+		})
+	}
+}
+
+func TestBackendWatcher(t *testing.T) {
+	create := &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist}
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			b := backend.new()
+
+			first, err := b.Set(ctx, "/w/a", "1", create)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recursive := b.Watcher("/w", &etcdv2.WatcherOptions{Recursive: true})
+			single := b.Watcher("/w/a", nil)
+			replay := b.Watcher("/w", &etcdv2.WatcherOptions{Recursive: true, AfterIndex: first.Index - 1})
+
+			// let the watchers start from now before writing
+			next := func(w etcdv2.Watcher) chan string {
+				ch := make(chan string, 1)
+				go func() {
+					resp, err := w.Next(ctx)
+					if err != nil {
+						ch <- err.Error()
+						return
+					}
+					ch <- fmt.Sprintf("%s %s %s", resp.Action, resp.Node.Key, resp.Node.Value)
+				}()
+				return ch
+			}
+			pending := next(recursive)
+			pendingSingle := next(single)
+			time.Sleep(50 * time.Millisecond)
+
+			b.Set(ctx, "/x", "1", create)
+			b.Set(ctx, "/w/_hidden", "1", create)
+			b.Set(ctx, "/w/b", "2", create)
+			b.Set(ctx, "/w/a", "3", nil)
+			b.Delete(ctx, "/w/b", nil)
+
+			got := []string{<-pending}
+			for i := 0; i < 2; i++ {
+				got = append(got, <-next(recursive))
+			}
+			want := []string{"create /w/b 2", "set /w/a 3", "delete /w/b "}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("recursive watch %q, want %q", got, want)
+			}
+			if got := <-pendingSingle; got != "set /w/a 3" {
+				t.Errorf("key watch %q", got)
+			}
+			if got := <-next(replay); got != "create /w/a 1" {
+				t.Errorf("watch after index %q", got)
+			}
+		})
+	}
+}
+
+func TestBackendWatcherRecursiveDelete(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			b := backend.new()
+
+			// an implicit directory and one with a marker
+			b.Set(ctx, "/w/d/a", "1", nil)
+			b.Set(ctx, "/w/d/e/f", "2", nil)
+			b.Set(ctx, "/w/m", "", &etcdv2.SetOptions{Dir: true})
+			last, _ := b.Set(ctx, "/w/m/a", "3", nil)
+			recursive := b.Watcher("/w", &etcdv2.WatcherOptions{Recursive: true, AfterIndex: last.Index})
+			single := b.Watcher("/w/d", &etcdv2.WatcherOptions{AfterIndex: last.Index})
+
+			for _, dir := range []string{"/w/d", "/w/m"} {
+				if _, err := b.Delete(ctx, dir, &etcdv2.DeleteOptions{Dir: true, Recursive: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b.Set(ctx, "/w/z", "4", &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist})
+
+			var got []string
+			for i := 0; i < 3; i++ {
+				resp, err := recursive.Next(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fmt.Sprintf("%s %s %v", resp.Action, resp.Node.Key, resp.Node.Dir))
+			}
+			want := []string{"delete /w/d true", "delete /w/m true", "create /w/z false"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("recursive watch %q, want %q", got, want)
+			}
+			if resp, err := single.Next(ctx); err != nil || resp.Action != "delete" || resp.Node.Key != "/w/d" {
+				t.Errorf("directory watch %+v: %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestBackendWatcherIndexCleared(t *testing.T) {
+	ctx := context.Background()
+	v3 := NewMemoryV3Client()
+	backends := map[string]struct {
+		b     Backend
+		clear func(b Backend)
+	}{
+		"v2": {NewMemoryV2Backend(), func(b Backend) {
+			for i := 0; i < memoryV2HistorySize; i++ {
+				b.Set(ctx, "/other", "x", nil)
+			}
+		}},
+		"v3": {NewV3Backend(v3), func(b Backend) {
+			resp, _ := b.Set(ctx, "/other", "x", nil)
+			v3.Compact(int64(resp.Index))
+		}},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			resp, err := backend.b.Set(ctx, "/w", "1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend.clear(backend.b)
+			w := backend.b.Watcher("/w", &etcdv2.WatcherOptions{AfterIndex: resp.Index - 1})
+			wctx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			if _, err := w.Next(wctx); ErrorCode(err) != etcdv2.ErrorCodeEventIndexCleared {
+				t.Errorf("watch from a cleared index: %v", err)
+			}
+		})
+	}
+}
+
+// conflictingV3Client fails the first conflicts transactions as if the keys
+// had changed meanwhile, and counts the leases granted.
+type conflictingV3Client struct {
+	*MemoryV3Client
+	conflicts int
+	grants    int
+}
+
+func (c *conflictingV3Client) Txn(ctx context.Context, cmps []V3Cmp, ops []V3Op) (bool, int64, error) {
+	if c.conflicts > 0 {
+		c.conflicts--
+		return false, 0, nil
+	}
+	return c.MemoryV3Client.Txn(ctx, cmps, ops)
+}
+
+func (c *conflictingV3Client) Grant(ctx context.Context, ttl int64) (int64, error) {
+	c.grants++
+	return c.MemoryV3Client.Grant(ctx, ttl)
+}
+
+func TestV3Leases(t *testing.T) {
+	ctx := context.Background()
+	kv := &conflictingV3Client{MemoryV3Client: NewMemoryV3Client(), conflicts: 3}
+	b := NewV3Backend(kv)
+
+	// the retries reuse the lease of the first attempt
+	set, err := b.Set(ctx, "/k", "v", &etcdv2.SetOptions{TTL: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv.grants != 1 {
+		t.Errorf("%d leases granted for one set", kv.grants)
+	}
+
+	// a refresh to the same TTL renews the lease, the key is not written
+	time.Sleep(1100 * time.Millisecond)
+	resp, err := b.Set(ctx, "/k", "", &etcdv2.SetOptions{TTL: 10 * time.Second, Refresh: true, PrevExist: etcdv2.PrevExist})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Action != "update" || resp.Node.Value != "v" || resp.Node.ModifiedIndex != set.Node.ModifiedIndex || resp.Node.TTL != 10 {
+		t.Errorf("refresh %+v", resp.Node)
+	}
+	if get, _ := b.Get(ctx, "/k", nil); get.Node.TTL != 10 || get.Node.ModifiedIndex != set.Node.ModifiedIndex {
+		t.Errorf("after the refresh %+v", get.Node)
+	}
+	if kv.grants != 1 {
+		t.Errorf("%d leases granted after the refresh", kv.grants)
+	}
+
+	// another TTL needs another lease
+	_, err = b.Set(ctx, "/k", "", &etcdv2.SetOptions{TTL: 20 * time.Second, Refresh: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get, _ := b.Get(ctx, "/k", nil); get.Node.Value != "v" || get.Node.TTL != 20 || kv.grants != 2 {
+		t.Errorf("refresh to another ttl %+v, %d grants", get.Node, kv.grants)
+	}
+
+	// so does a key without one, and a refresh of a missing key fails
+	b.Set(ctx, "/plain", "p", nil)
+	if _, err := b.Set(ctx, "/plain", "", &etcdv2.SetOptions{TTL: 10 * time.Second, Refresh: true}); err != nil {
+		t.Fatal(err)
+	}
+	if get, _ := b.Get(ctx, "/plain", nil); get.Node.Value != "p" || get.Node.TTL != 10 {
+		t.Errorf("refreshed plain key %+v", get.Node)
+	}
+	if _, err := b.Set(ctx, "/none", "", &etcdv2.SetOptions{TTL: 10 * time.Second, Refresh: true}); !IsEtcdNotFound(err) {
+		t.Errorf("refresh of a missing key: %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package etcd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// DefaultChunkSize keeps each chunk, base64 encoded, well below the 1 MiB
+// value limit of the server.
+const DefaultChunkSize = 512 << 10
+
+// BlobStore keeps values too large for one key as chunks under a
+// directory:
+//
+//	<dir>/<name>/manifest                 current generation, size, checksum
+//	<dir>/<name>/<generation>/000000 ...  base64 chunks of one generation
+//
+// Put writes a whole new generation, then swaps the manifest by index, so a
+// reader sees the old blob or the new one, never a mix; two concurrent Puts
+// of the same name do not both win, the loser gets a compare failed error.
+// The generation a Put replaces is deleted right away, GC removes those
+// left behind by writers that died half way.
+type BlobStore struct {
+	c         *Client
+	dir       string
+	chunkSize int
+}
+
+type BlobManifest struct {
+	Generation string `json:"generation"`
+	Size       int    `json:"size"`
+	SHA256     string `json:"sha256"`
+	Chunks     int    `json:"chunks"`
+	ChunkSize  int    `json:"chunkSize"`
+}
+
+// NewBlobStore keeps blobs under dir in chunks of chunkSize bytes,
+// DefaultChunkSize if 0.
+func NewBlobStore(c *Client, dir string, chunkSize int) *BlobStore {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &BlobStore{c: c, dir: etcdpath.Clean(dir), chunkSize: chunkSize}
+}
+
+func (s *BlobStore) key(name string, elem ...string) string {
+	return etcdpath.Join(append([]string{s.dir, name}, elem...)...)
+}
+
+// newGeneration names a generation after its creation time, GC tells
+// abandoned ones from running writes by it.
+func newGeneration() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("g%d-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+func generationTime(gen string) (time.Time, bool) {
+	if !strings.HasPrefix(gen, "g") {
+		return time.Time{}, false
+	}
+	i := strings.Index(gen, "-")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(gen[1:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// manifest returns the manifest of name and its index, 0 when there is none.
+func (s *BlobStore) manifest(name string) (*BlobManifest, uint64, error) {
+	ctx, cancel := s.c.newContextWithTimeout()
+	resp, err := s.c.backend.Get(ctx, s.key(name, "manifest"), &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	if err != nil {
+		return nil, 0, err
+	}
+	var m BlobManifest
+	if err := json.Unmarshal([]byte(resp.Node.Value), &m); err != nil {
+		return nil, 0, fmt.Errorf("blob %s: bad manifest: %v", name, err)
+	}
+	return &m, resp.Node.ModifiedIndex, nil
+}
+
+// Put stores data as name, a single path segment.
+func (s *BlobStore) Put(name string, data []byte) (*BlobManifest, error) {
+	if segments := etcdpath.Split(name); len(segments) != 1 || segments[0] == ".." {
+		return nil, fmt.Errorf("blob name %q is not a single path segment", name)
+	}
+	old, index, err := s.manifest(name)
+	if err != nil && !IsEtcdNotFound(err) {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	m := &BlobManifest{
+		Generation: newGeneration(),
+		Size:       len(data),
+		SHA256:     hex.EncodeToString(sum[:]),
+		ChunkSize:  s.chunkSize,
+	}
+	for off := 0; off < len(data) || off == 0; off += s.chunkSize {
+		end := off + s.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := base64.StdEncoding.EncodeToString(data[off:end])
+		ctx, cancel := s.c.newContextWithTimeout()
+		_, err := s.c.backend.Set(ctx, s.key(name, m.Generation, fmt.Sprintf("%06d", m.Chunks)), chunk, nil)
+		cancel()
+		if err != nil {
+			s.deleteGeneration(name, m.Generation)
+			return nil, err
+		}
+		m.Chunks++
+		if end == len(data) {
+			break
+		}
+	}
+
+	value, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	opts := &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist}
+	if old != nil {
+		opts = &etcdv2.SetOptions{PrevIndex: index}
+	}
+	ctx, cancel := s.c.newContextWithTimeout()
+	_, err = s.c.backend.Set(ctx, s.key(name, "manifest"), string(value), opts)
+	cancel()
+	if err != nil {
+		s.deleteGeneration(name, m.Generation)
+		return nil, err
+	}
+
+	if old != nil {
+		s.deleteGeneration(name, old.Generation)
+	}
+	return m, nil
+}
+
+func (s *BlobStore) deleteGeneration(name, gen string) error {
+	ctx, cancel := s.c.newContextWithTimeout()
+	defer cancel()
+	_, err := s.c.backend.Delete(ctx, s.key(name, gen), &etcdv2.DeleteOptions{Dir: true, Recursive: true})
+	if err != nil && !IsEtcdNotFound(err) {
+		s.c.logger.Log(LevelWarn, "blob generation not deleted", Field{"key", s.key(name, gen)}, Field{"error", err.Error()})
+		return err
+	}
+	return nil
+}
+
+// Get returns the blob name, checked against its manifest. A Put that
+// replaces the blob while it is read makes Get read the new one.
+func (s *BlobStore) Get(name string) ([]byte, *BlobManifest, error) {
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		m, _, err := s.manifest(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := s.read(name, m)
+		if err == nil {
+			return data, m, nil
+		}
+		lastErr = err
+		// the generation may have been replaced under us, check the manifest
+		if current, _, err := s.manifest(name); err != nil || current.Generation == m.Generation {
+			return nil, nil, lastErr
+		}
+	}
+	return nil, nil, lastErr
+}
+
+func (s *BlobStore) read(name string, m *BlobManifest) ([]byte, error) {
+	ctx, cancel := s.c.newContextWithTimeout()
+	resp, err := s.c.backend.Get(ctx, s.key(name, m.Generation), &etcdv2.GetOptions{Recursive: true, Sort: true, Quorum: true})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := resp.Node.Nodes
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key < nodes[j].Key })
+	if len(nodes) != m.Chunks {
+		return nil, fmt.Errorf("blob %s: %d of %d chunks", name, len(nodes), m.Chunks)
+	}
+	data := make([]byte, 0, m.Size)
+	for _, node := range nodes {
+		chunk, err := base64.StdEncoding.DecodeString(node.Value)
+		if err != nil {
+			return nil, fmt.Errorf("blob %s: chunk %s: %v", name, node.Key, err)
+		}
+		data = append(data, chunk...)
+	}
+	sum := sha256.Sum256(data)
+	if len(data) != m.Size || hex.EncodeToString(sum[:]) != m.SHA256 {
+		return nil, fmt.Errorf("blob %s: size or checksum mismatch", name)
+	}
+	return data, nil
+}
+
+// Delete removes the blob name with all its generations.
+func (s *BlobStore) Delete(name string) error {
+	ctx, cancel := s.c.newContextWithTimeout()
+	defer cancel()
+	_, err := s.c.backend.Delete(ctx, s.key(name), &etcdv2.DeleteOptions{Dir: true, Recursive: true})
+	return err
+}
+
+// List returns the names of the blobs.
+func (s *BlobStore) List() ([]string, error) {
+	ctx, cancel := s.c.newContextWithTimeout()
+	resp, err := s.c.backend.Get(ctx, s.dir, &etcdv2.GetOptions{Sort: true, Quorum: true})
+	cancel()
+	if err != nil {
+		if IsEtcdNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			names = append(names, etcdpath.Base(node.Key))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GC deletes the generations no manifest points at that are older than
+// minAge, which must exceed the time the slowest Put takes. It returns how
+// many it deleted.
+func (s *BlobStore) GC(minAge time.Duration) (int, error) {
+	names, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, name := range names {
+		current := ""
+		m, _, err := s.manifest(name)
+		switch {
+		case err == nil:
+			current = m.Generation
+		case !IsEtcdNotFound(err):
+			return deleted, err
+		}
+
+		ctx, cancel := s.c.newContextWithTimeout()
+		resp, err := s.c.backend.Get(ctx, s.key(name), &etcdv2.GetOptions{Quorum: true})
+		cancel()
+		if err != nil {
+			if IsEtcdNotFound(err) {
+				continue
+			}
+			return deleted, err
+		}
+		for _, node := range resp.Node.Nodes {
+			gen := etcdpath.Base(node.Key)
+			created, ok := generationTime(gen)
+			if !node.Dir || gen == current || !ok || time.Since(created) < minAge {
+				continue
+			}
+			if err := s.deleteGeneration(name, gen); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,180 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func TestBlobStore(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			c, err := NewClientWithConfig(Config{Backend: backend.new()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			s := NewBlobStore(c, "/blobs", 10)
+
+			data := []byte(strings.Repeat("0123456789", 5) + "xyz")
+			m, err := s.Put("a", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Chunks != 6 || m.Size != len(data) || m.ChunkSize != 10 {
+				t.Errorf("manifest %+v", m)
+			}
+			if got, gm, err := s.Get("a"); err != nil || !bytes.Equal(got, data) || *gm != *m {
+				t.Errorf("get %q, %+v: %v", got, gm, err)
+			}
+
+			// a Put replaces the generation and deletes the old one
+			m2, err := s.Put("a", []byte("short"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _, _ := s.Get("a"); string(got) != "short" {
+				t.Errorf("replaced blob %q", got)
+			}
+			if keys, _ := c.List("/blobs/a", false); !reflect.DeepEqual(keys, []string{"/blobs/a/" + m2.Generation, "/blobs/a/manifest"}) {
+				t.Errorf("keys after replace %v", keys)
+			}
+
+			if m, err := s.Put("e", nil); err != nil || m.Chunks != 1 {
+				t.Errorf("empty blob %+v: %v", m, err)
+			}
+			if got, _, err := s.Get("e"); err != nil || len(got) != 0 {
+				t.Errorf("empty blob read %q: %v", got, err)
+			}
+			if names, _ := s.List(); !reflect.DeepEqual(names, []string{"a", "e"}) {
+				t.Errorf("names %v", names)
+			}
+
+			if err := s.Delete("a"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.Get("a"); !IsEtcdNotFound(err) {
+				t.Errorf("get after delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestBlobStoreErrors(t *testing.T) {
+	c := newTestClient(t)
+	s := NewBlobStore(c, "/blobs", 4)
+
+	for _, name := range []string{"a/b", "..", "", "/"} {
+		if _, err := s.Put(name, []byte("x")); err == nil {
+			t.Errorf("put %q accepted", name)
+		}
+	}
+	if names, err := s.List(); names != nil || err != nil {
+		t.Errorf("list of no blobs %v: %v", names, err)
+	}
+
+	m, _ := s.Put("a", []byte("abcdefgh"))
+	chunk := "/blobs/a/" + m.Generation + "/000001"
+	c.Set(chunk, "eHl6dw==", 0, "", 0)
+	if _, _, err := s.Get("a"); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("changed chunk: %v", err)
+	}
+	c.Set(chunk, "!", 0, "", 0)
+	if _, _, err := s.Get("a"); err == nil {
+		t.Error("bad base64 chunk read")
+	}
+	c.RM(chunk, false, false, "", 0)
+	if _, _, err := s.Get("a"); err == nil || !strings.Contains(err.Error(), "1 of 2 chunks") {
+		t.Errorf("missing chunk: %v", err)
+	}
+	c.Set("/blobs/a/manifest", "{", 0, "", 0)
+	if _, _, err := s.Get("a"); err == nil || !strings.Contains(err.Error(), "bad manifest") {
+		t.Errorf("bad manifest: %v", err)
+	}
+}
+
+// blobHookBackend runs hook once, before the first write or read of a
+// generation directory.
+type blobHookBackend struct {
+	Backend
+	hook func()
+}
+
+func (b *blobHookBackend) run(key string) {
+	if hook := b.hook; hook != nil && strings.Contains(key, "/g") {
+		b.hook = nil
+		hook()
+	}
+}
+
+func (b *blobHookBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	b.run(key)
+	return b.Backend.Set(ctx, key, value, opts)
+}
+
+func (b *blobHookBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	b.run(key)
+	return b.Backend.Get(ctx, key, opts)
+}
+
+func TestBlobStoreConcurrentPut(t *testing.T) {
+	b := &blobHookBackend{Backend: NewMemoryBackend()}
+	c, err := NewClientWithConfig(Config{Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s := NewBlobStore(c, "/blobs", 0)
+	s.Put("a", []byte("first"))
+
+	// another writer swaps the manifest while this Put writes its chunks
+	b.hook = func() { s.Put("a", []byte("other")) }
+	if _, err := s.Put("a", []byte("loser")); !IsEtcdTestFailed(err) {
+		t.Errorf("losing put: %v", err)
+	}
+	got, m, _ := s.Get("a")
+	if string(got) != "other" {
+		t.Errorf("blob %q", got)
+	}
+	if keys, _ := c.List("/blobs/a", false); len(keys) != 2 || keys[0] != "/blobs/a/"+m.Generation {
+		t.Errorf("generations left %v", keys)
+	}
+
+	// the blob is replaced while Get reads it
+	b.hook = func() { s.Put("a", []byte("newer")) }
+	if got, _, err := s.Get("a"); string(got) != "newer" || err != nil {
+		t.Errorf("get across a replace %q: %v", got, err)
+	}
+}
+
+func TestBlobStoreGC(t *testing.T) {
+	c := newTestClient(t)
+	s := NewBlobStore(c, "/blobs", 0)
+	m, _ := s.Put("a", []byte("data"))
+
+	// abandoned by a writer long ago, one still being written and a stray
+	// directory not named as a generation
+	c.Set("/blobs/a/g1-dead/000000", "eA==", 0, "", 0)
+	c.Set("/blobs/a/"+newGeneration()+"/000000", "eA==", 0, "", 0)
+	c.Set("/blobs/a/other/x", "x", 0, "", 0)
+	c.Set("/blobs/orphan/g2-dead/000000", "eA==", 0, "", 0)
+
+	if n, err := s.GC(time.Minute); err != nil || n != 2 {
+		t.Errorf("gc deleted %d: %v", n, err)
+	}
+	keys, _ := c.List("/blobs/a", false)
+	if len(keys) != 4 || keys[0] != "/blobs/a/"+m.Generation {
+		t.Errorf("keys after gc %v", keys)
+	}
+	if got, _, _ := s.Get("a"); string(got) != "data" {
+		t.Errorf("blob after gc %q", got)
+	}
+	if n, _ := s.GC(0); n != 1 {
+		t.Errorf("gc of the recent generation deleted %d", n)
+	}
+}
@@ -0,0 +1,289 @@
+package etcd
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// CachedClient is a Client that answers Gets and Lists under its prefixes
+// from memory. Each prefix is loaded with one quorum read and kept fresh by
+// a recursive watch; until it is loaded, while it reloads after a cleared
+// watch index or an error, and for keys it does not hold, requests go to
+// the cluster as usual. Writes always go to the cluster and reach the cache
+// through the watch, so a Get right after a Set may still see the old
+// value; check State when that matters.
+type CachedClient struct {
+	*Client
+	src    *Client
+	caches []*prefixCache
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// CacheState tells how fresh the cache of a prefix is.
+type CacheState struct {
+	Prefix string
+	// Ready is false until the prefix is loaded and while it reloads, reads
+	// go to the cluster then.
+	Ready bool
+	// Index is the etcd index of the last change applied.
+	Index uint64
+	// Updated is when the last change was applied.
+	Updated time.Time
+}
+
+type prefixCache struct {
+	prefix string
+	// implied is set on v3, where a directory without a marker goes away
+	// with its last key
+	implied bool
+
+	mu      sync.RWMutex
+	ready   bool
+	index   uint64
+	updated time.Time
+	// nodes holds every node under prefix, prefix itself included, without
+	// their children
+	nodes map[string]*etcdv2.Node
+}
+
+// NewCachedClient caches prefixes of c. The caches fill in the background,
+// Close stops them; c stays open.
+func NewCachedClient(c *Client, prefixes ...string) *CachedClient {
+	cc := &CachedClient{src: c}
+	cc.ctx, cc.cancel = context.WithCancel(c.ctx)
+	_, implied := c.V3()
+	for _, prefix := range prefixes {
+		cc.caches = append(cc.caches, &prefixCache{prefix: etcdpath.Clean(prefix), implied: implied})
+	}
+	cc.Client = c.view()
+	cc.Client.backend = &cacheBackend{next: c.backend, caches: cc.caches}
+
+	for _, pc := range cc.caches {
+		cc.wg.Add(1)
+		go func(pc *prefixCache) {
+			defer cc.wg.Done()
+			cc.run(pc)
+		}(pc)
+	}
+	return cc
+}
+
+// State reports the freshness of each prefix.
+func (cc *CachedClient) State() []CacheState {
+	states := make([]CacheState, 0, len(cc.caches))
+	for _, pc := range cc.caches {
+		pc.mu.RLock()
+		states = append(states, CacheState{Prefix: pc.prefix, Ready: pc.ready, Index: pc.index, Updated: pc.updated})
+		pc.mu.RUnlock()
+	}
+	return states
+}
+
+// Close stops the caches, the Client it was made from stays open.
+func (cc *CachedClient) Close() error {
+	cc.cancel()
+	cc.wg.Wait()
+	return nil
+}
+
+func (cc *CachedClient) run(pc *prefixCache) {
+	for cc.ctx.Err() == nil {
+		index, err := cc.load(pc)
+		if err == nil {
+			err = cc.src.watchFrom(cc.ctx, pc.prefix, true, index, func(resp *etcdv2.Response) bool {
+				pc.apply(resp)
+				return false
+			})
+		}
+
+		pc.mu.Lock()
+		pc.ready = false
+		pc.mu.Unlock()
+		if cc.ctx.Err() != nil {
+			return
+		}
+		cc.src.metrics.watchReconnected()
+		if IsEtcdWatchExpired(err) {
+			cc.src.logger.Log(LevelInfo, "cache watch index cleared, reloading", Field{"key", pc.prefix})
+			continue
+		}
+		cc.src.logger.Log(LevelWarn, "cache failed, retrying", Field{"key", pc.prefix}, Field{"code", errorLabel(err)}, Field{"error", err.Error()})
+		select {
+		case <-time.After(time.Second):
+		case <-cc.ctx.Done():
+		}
+	}
+}
+
+// load reads the whole prefix and returns the index to watch from.
+func (cc *CachedClient) load(pc *prefixCache) (uint64, error) {
+	ctx, cancel := context.WithTimeout(cc.ctx, cc.src.timeout)
+	defer cancel()
+	resp, err := cc.src.backend.Get(ctx, pc.prefix, &etcdv2.GetOptions{Recursive: true, Quorum: true})
+	nodes := make(map[string]*etcdv2.Node)
+	switch {
+	case err == nil:
+		walkNodes(resp.Node, func(node *etcdv2.Node) {
+			nodes[node.Key] = leaf(node)
+		})
+	case isEtcdErrorNum(err, etcdv2.ErrorCodeKeyNotFound):
+		// cache the absence, the watch brings the prefix when it appears
+		resp = &etcdv2.Response{Index: err.(etcdv2.Error).Index}
+	default:
+		return 0, err
+	}
+
+	pc.mu.Lock()
+	pc.nodes = nodes
+	pc.index = resp.Index
+	pc.updated = time.Now()
+	pc.ready = true
+	pc.mu.Unlock()
+	return resp.Index, nil
+}
+
+// leaf copies node without its children.
+func leaf(node *etcdv2.Node) *etcdv2.Node {
+	n := *node
+	n.Nodes = nil
+	return &n
+}
+
+func (pc *prefixCache) apply(resp *etcdv2.Response) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	node := resp.Node
+	switch resp.Action {
+	case "delete", "compareAndDelete", "expire":
+		for key := range pc.nodes {
+			if underPrefix(key, node.Key) {
+				delete(pc.nodes, key)
+			}
+		}
+		if pc.implied {
+			// forget the directories left empty, a Get of one that still
+			// has a marker then goes to the cluster
+			for dir := parentKey(node.Key); len(dir) > len(pc.prefix) && pc.empty(dir); dir = parentKey(dir) {
+				delete(pc.nodes, dir)
+			}
+		}
+	default:
+		// a write creates the missing directories above the key
+		for dir := parentKey(node.Key); len(dir) >= len(pc.prefix); dir = parentKey(dir) {
+			if _, ok := pc.nodes[dir]; ok {
+				break
+			}
+			pc.nodes[dir] = &etcdv2.Node{Key: dir, Dir: true, CreatedIndex: node.ModifiedIndex, ModifiedIndex: node.ModifiedIndex}
+		}
+		pc.nodes[node.Key] = leaf(node)
+	}
+	pc.index = node.ModifiedIndex
+	pc.updated = time.Now()
+}
+
+func (pc *prefixCache) empty(dir string) bool {
+	for key := range pc.nodes {
+		if key != dir && parentKey(key) == dir {
+			return false
+		}
+	}
+	return true
+}
+
+func underPrefix(key, prefix string) bool {
+	return prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+func parentKey(key string) string {
+	i := strings.LastIndex(key, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return key[:i]
+}
+
+// get answers a Get of key, or returns false when the cluster must.
+func (pc *prefixCache) get(key string, opts *etcdv2.GetOptions) (*etcdv2.Response, bool) {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	if !pc.ready {
+		return nil, false
+	}
+	node, ok := pc.nodes[key]
+	if !ok {
+		// a miss may be a key we have not seen yet, ask the cluster
+		return nil, false
+	}
+
+	recursive := opts != nil && opts.Recursive
+	sorted := opts != nil && opts.Sort
+	now := time.Now()
+	var build func(n *etcdv2.Node, depth int) *etcdv2.Node
+	build = func(n *etcdv2.Node, depth int) *etcdv2.Node {
+		out := leaf(n)
+		if out.Expiration != nil {
+			out.TTL = int64((out.Expiration.Sub(now) + time.Second - 1) / time.Second)
+		}
+		if !n.Dir || depth > 0 && !recursive {
+			return out
+		}
+		out.Nodes = etcdv2.Nodes{}
+		for k, child := range pc.nodes {
+			if parentKey(k) == n.Key && k != n.Key {
+				out.Nodes = append(out.Nodes, build(child, depth+1))
+			}
+		}
+		if sorted {
+			sort.Slice(out.Nodes, func(i, j int) bool { return out.Nodes[i].Key < out.Nodes[j].Key })
+		}
+		return out
+	}
+	return &etcdv2.Response{Action: "get", Node: build(node, 0), Index: pc.index}, true
+}
+
+// cacheBackend answers Gets from the caches and passes the rest on.
+type cacheBackend struct {
+	next   Backend
+	caches []*prefixCache
+}
+
+func (b *cacheBackend) Unwrap() Backend {
+	return b.next
+}
+
+func (b *cacheBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	clean := etcdpath.Clean(key)
+	for _, pc := range b.caches {
+		if !underPrefix(clean, pc.prefix) {
+			continue
+		}
+		if resp, ok := pc.get(clean, opts); ok {
+			return resp, nil
+		}
+	}
+	return b.next.Get(ctx, key, opts)
+}
+
+func (b *cacheBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	return b.next.Set(ctx, key, value, opts)
+}
+
+func (b *cacheBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	return b.next.Delete(ctx, key, opts)
+}
+
+func (b *cacheBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	return b.next.CreateInOrder(ctx, dir, value, opts)
+}
+
+func (b *cacheBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	return b.next.Watcher(key, opts)
+}
@@ -0,0 +1,124 @@
+package etcd
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// countingBackend counts the Gets reaching it.
+type countingBackend struct {
+	Backend
+	gets int32
+}
+
+func (b *countingBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	atomic.AddInt32(&b.gets, 1)
+	return b.Backend.Get(ctx, key, opts)
+}
+
+func newCachedTestClient(t *testing.T, backend Backend, prefixes ...string) (*Client, *CachedClient, *countingBackend) {
+	b := &countingBackend{Backend: backend}
+	c, err := NewClientWithConfig(Config{Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Set("/cfg/a", "1", 0, "", 0)
+	c.Set("/cfg/sub/b", "2", 0, "", 0)
+	cc := NewCachedClient(c, prefixes...)
+	t.Cleanup(func() { cc.Close() })
+	eventually(t, "cache ready", func() bool {
+		for _, state := range cc.State() {
+			if !state.Ready {
+				return false
+			}
+		}
+		return true
+	})
+	return c, cc, b
+}
+
+func TestCachedClient(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			c, cc, b := newCachedTestClient(t, backend.new(), "/cfg")
+
+			gets := atomic.LoadInt32(&b.gets)
+			if v, err := cc.Get("/cfg/a"); v != "1" || err != nil {
+				t.Errorf("cached get %q, %v", v, err)
+			}
+			if keys, _ := cc.List("/cfg", true); !reflect.DeepEqual(keys, []string{"/cfg/a", "/cfg/sub", "/cfg/sub/b"}) {
+				t.Errorf("cached list %v", keys)
+			}
+			if n := atomic.LoadInt32(&b.gets) - gets; n != 0 {
+				t.Errorf("%d gets reached the cluster", n)
+			}
+
+			// writes come back through the watch
+			c.Set("/cfg/a", "3", 0, "", 0)
+			c.Set("/cfg/new/x", "4", 60, "", 0)
+			c.RM("/cfg/sub", true, true, "", 0)
+			eventually(t, "writes applied", func() bool {
+				v, _ := cc.Get("/cfg/a")
+				return v == "3"
+			})
+			eventually(t, "delete applied", func() bool {
+				keys, _ := cc.List("/cfg", true)
+				return reflect.DeepEqual(keys, []string{"/cfg/a", "/cfg/new", "/cfg/new/x"})
+			})
+			if ttl, _, _ := cc.TTL("/cfg/new/x"); ttl <= 0 {
+				t.Errorf("cached ttl %v", ttl)
+			}
+			if state := cc.State()[0]; state.Prefix != "/cfg" || state.Index == 0 || state.Updated.IsZero() {
+				t.Errorf("state %+v", state)
+			}
+
+			// misses and keys outside the prefixes go to the cluster
+			gets = atomic.LoadInt32(&b.gets)
+			if _, err := cc.Get("/cfg/missing"); !IsEtcdNotFound(err) {
+				t.Errorf("missing key: %v", err)
+			}
+			c.Set("/other", "o", 0, "", 0)
+			if v, _ := cc.Get("/other"); v != "o" {
+				t.Errorf("key outside the prefix %q", v)
+			}
+			if n := atomic.LoadInt32(&b.gets) - gets; n != 2 {
+				t.Errorf("%d gets reached the cluster, want 2", n)
+			}
+		})
+	}
+}
+
+func TestCachedClientMissingPrefix(t *testing.T) {
+	c, cc, _ := newCachedTestClient(t, NewMemoryBackend(), "/later")
+	c.Set("/later/k", "v", 0, "", 0)
+	eventually(t, "prefix created", func() bool {
+		v, _ := cc.Get("/later/k")
+		return v == "v"
+	})
+}
+
+func TestCachedClientClose(t *testing.T) {
+	c, cc, b := newCachedTestClient(t, NewMemoryBackend(), "/cfg")
+	cc.Close()
+	if state := cc.State()[0]; state.Ready {
+		t.Errorf("ready after Close: %+v", state)
+	}
+
+	// reads still work, from the cluster
+	c.Set("/cfg/a", "after", 0, "", 0)
+	gets := atomic.LoadInt32(&b.gets)
+	if v, _ := cc.Get("/cfg/a"); v != "after" {
+		t.Errorf("read after Close %q", v)
+	}
+	if atomic.LoadInt32(&b.gets) == gets {
+		t.Error("read after Close served from the cache")
+	}
+	if _, err := c.Get("/cfg/a"); err != nil {
+		t.Errorf("client closed with the cache: %v", err)
+	}
+}
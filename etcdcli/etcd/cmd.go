@@ -10,15 +10,20 @@ import (
 	"strings"
 	"errors"
 	"context"
-	"log"
 	"os"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
 	etcdv2 "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
 )
 
 type  OnChangeCallback func(action string, path string, value string) bool //return true exit watch
 
 
 
+// Deprecated: ClientAPIs is kept for callers that name it; *Client does not
+// implement it, use *Client directly or Backend for the storage.
 type ClientAPIs  interface {
 	Set(key string, value string, ttl int64, swapValue string, swapIndex int64) error
 	SetDir(key string, ttl int64) error
@@ -36,7 +41,7 @@ type ClientAPIs  interface {
 
 type Client struct {
 	sync.Mutex
-	etcdKeysApi etcdv2.KeysAPI
+	backend Backend
 	timeout time.Duration
 
 	closed  bool
@@ -45,6 +50,20 @@ type Client struct {
 
 	client etcdv2.Client
 
+	format    string
+	transport etcdv2.CancelableTransport
+	// closeBackend releases a backend the client created itself
+	closeBackend func() error
+
+	metrics *Metrics
+	logger  Logger
+	tracer  Tracer
+	// limits is the limitedBackend in backend, if the client has Limits
+	limits *limitedBackend
+	// endpoint is the endpoint list for logs and spans, without credentials
+	endpoint string
+	// values are the values of the context given to WithContext
+	values context.Context
 }
 
 /*
@@ -53,214 +72,419 @@ func NewClientAPIs() {
 }
 */
 
-func printResponseKey(resp *etcdv2.Response, format string) {
-	// Format the result.
-	switch format {
-	case "simple":
-		if resp.Action != "delete" {
-			fmt.Println(resp.Node.Value)
-		} else {
-			fmt.Println("PrevNode.Value:", resp.PrevNode.Value)
-		}
-	case "extended":
-		// Extended prints in a rfc2822 style format
-		fmt.Println("Key:", resp.Node.Key)
-		fmt.Println("Created-Index:", resp.Node.CreatedIndex)
-		fmt.Println("Modified-Index:", resp.Node.ModifiedIndex)
-
-		if resp.PrevNode != nil {
-			fmt.Println("PrevNode.Value:", resp.PrevNode.Value)
-		}
+func (c *Client) printResponse(resp *etcdv2.Response) {
+	if c.format == "" {
+		return
+	}
+	if err := PrintResponse(os.Stdout, resp, c.format); err != nil {
+		c.logger.Log(LevelError, "print response failed", Field{"key", resp.Node.Key}, Field{"error", err.Error()})
+	}
+}
+
+// Config is the full set of options accepted by NewClientWithConfig.
+type Config struct {
+	Endpoints []string
+	Auth      string // user:password
+	Timeout   time.Duration
+
+	// TLS settings, all optional. When any of them is set the endpoints
+	// default to https.
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// API picks the backend built from the settings above: "v2" (default) or
+	// "v3". Backend, when set, is used as is and the settings are ignored,
+	// e.g. NewMemoryBackend() in tests.
+	API     string
+	Backend Backend
+
+	// Metrics, when set, records every operation of the client.
+	Metrics *Metrics
+
+	// Encryption, when set, encrypts the values under its prefixes.
+	Encryption *Encryption
+
+	// Compression, when set, compresses large values.
+	Compression *Compression
+
+	// Limits, when set, caps the request rate and concurrency of the client.
+	// It runs inside Metrics: the time a request is held back counts in its
+	// latency, and a request rejected with FailFast counts with code
+	// throttled.
+	Limits *Limits
+
+	// Tracer, when set, traces every operation and watch of the client.
+	Tracer Tracer
+
+	// Logger receives the client diagnostics, nothing is logged without one.
+	Logger Logger
+
+	// Interceptors wrap every operation of the client, the first one
+	// outermost. StreamInterceptors do the same for watches. Both run inside
+	// Metrics, so short-circuited and failed calls are still counted.
+	Interceptors       []Interceptor
+	StreamInterceptors []StreamInterceptor
+
+	// Format selects how each response is echoed to stdout, see Formats for
+	// the registered names. Leave it empty to keep the client quiet.
+	Format string
+}
+
+func NewClient(ips []string, auth string, timeout time.Duration) (*Client, error) {
+	return NewClientWithConfig(Config{Endpoints: ips, Auth: auth, Timeout: timeout, Format: "extended"})
+}
+
+func NewClientWithConfig(cfg Config) (*Client, error) {
+	timeout := cfg.Timeout
+	if (timeout <= 0) {
+		timeout = time.Second * 5
+		//return nil, errors.New("timeout is le 0")
+	}
 
-		fmt.Println("TTL:", resp.Node.TTL)
-		fmt.Println("Index:", resp.Index)
-		if resp.Action != "delete" {
-			fmt.Println("")
-			fmt.Println(resp.Node.Value)
+	logger := cfg.Logger
+	if logger == nil {
+		logger = NopLogger()
+	}
+	client := &Client{timeout: timeout, format: cfg.Format, transport: etcdv2.DefaultTransport, logger: logger}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	if cfg.Backend != nil {
+		client.backend = cfg.Backend
+	} else if err := client.dial(cfg); err != nil {
+		return nil, err
+	}
+	client.backend = &pathBackend{next: client.backend}
+	if cfg.Encryption != nil {
+		b, err := newEncryptedBackend(client.backend, *cfg.Encryption)
+		if err != nil {
+			client.Close()
+			return nil, err
 		}
-	case "json":
-		b, err := json.Marshal(resp)
+		client.backend = b
+	}
+	if cfg.Compression != nil {
+		b, err := newCompressedBackend(client.backend, *cfg.Compression)
 		if err != nil {
-			panic(err)
+			client.Close()
+			return nil, err
 		}
-		fmt.Println(string(b))
-	default:
-		fmt.Fprintln(os.Stderr, "Unsupported output format:", format)
+		client.backend = b
+	}
+
+	interceptors := append([]Interceptor(nil), cfg.Interceptors...)
+	if cfg.Tracer != nil {
+		client.tracer = cfg.Tracer
+		interceptors = append(interceptors, traceInterceptor(cfg.Tracer, client.endpoint))
+	}
+	if cfg.Logger != nil {
+		interceptors = append(interceptors, logInterceptor(cfg.Logger, client.endpoint))
+	}
+	if len(interceptors) > 0 || len(cfg.StreamInterceptors) > 0 {
+		client.backend = &interceptedBackend{next: client.backend, interceptors: interceptors, streams: cfg.StreamInterceptors}
+	}
+	if cfg.Limits != nil {
+		client.limits = newLimitedBackend(client.backend, *cfg.Limits, cfg.Metrics)
+		client.backend = client.limits
+	}
+	if cfg.Metrics != nil {
+		client.metrics = cfg.Metrics
+		client.backend = &instrumentedBackend{next: client.backend, metrics: cfg.Metrics}
 	}
-}
 
+	//cntx, cancle := client.newContextWithTimeout()
+	//cancle = cancle
+	//resp, resperr := client.backend.Set(cntx, "/temp", "123", &etcdv2.SetOptions{})
+	//fmt.Printf("temp: [%v][%v]\n", resp, resperr)
+	return client, nil
+}
 
-func NewClient(ips []string, auth string, timeout time.Duration) (*Client, error) {
+// dial builds the v2 or v3 backend described by cfg.
+func (client *Client) dial(cfg Config) error {
+	ips := cfg.Endpoints
 	if len(ips) == 0 {
-		return nil, errors.New("endpoint is empty")
+		return errors.New("endpoint is empty")
 	}
 
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	scheme := "http://"
+	if tlsConfig != nil {
+		scheme = "https://"
+		client.transport = newTransport(tlsConfig)
+	}
 	for i, ip := range ips {
-		if ip != "" && !strings.HasPrefix(ip, "http://") {
-			ips[i] = "http://" + ip
+		if ip != "" && !strings.HasPrefix(ip, "http://") && !strings.HasPrefix(ip, "https://") {
+			ips[i] = scheme + ip
 		}
 	}
 
-	if (timeout <= 0) {
-		timeout = time.Second * 5
-		//return nil, errors.New("timeout is le 0")
+	var username, password string
+	if cfg.Auth != "" {
+		split := strings.SplitN(cfg.Auth, ":", 2)
+		if len(split) != 2 || split[0] == "" {
+			return errors.New("invalid auth")
+		}
+		username, password = split[0], split[1]
 	}
 
+	switch cfg.API {
+	case "", "v2":
+		config := etcdv2.Config{
+			Endpoints: ips,
+			Transport: client.transport,
+			HeaderTimeoutPerRequest: client.timeout,
+			Username: username,
+			Password: password,
+		}
 
-	config := etcdv2.Config{
-		Endpoints: ips,
-		Transport: etcdv2.DefaultTransport,
-		HeaderTimeoutPerRequest: timeout * time.Second,
+		c, err := etcdv2.New(config)
+		if err != nil {
+			return errors.New(fmt.Sprintf("etcd new %v", ips))
+		}
+		client.client = c
+		client.backend = etcdv2.NewKeysAPI(c)
+
+	case "v3":
+		c, err := clientv3.New(clientv3.Config{
+			Endpoints:   ips,
+			DialTimeout: client.timeout,
+			TLS:         tlsConfig,
+			Username:    username,
+			Password:    password,
+		})
+		if err != nil {
+			return fmt.Errorf("etcd v3 new %v: %v", ips, err)
+		}
+		client.backend = NewV3Backend(NewV3Client(c))
+		client.closeBackend = c.Close
+
+	default:
+		return fmt.Errorf("unknown api version %q", cfg.API)
 	}
 
-	if auth != "" {
-		split := strings.SplitN(auth, ":", 2)
-		if len(split) != 2 || split[0] == "" {
-			return nil, errors.New("invalid auth")
-		}
-		config.Username = split[0]
-		config.Password = split[1]
+	client.endpoint = redactEndpoints(ips)
+	client.logger.Log(LevelInfo, "etcd client created", Field{"endpoints", client.endpoint}, Field{"api", cfg.API}, Field{"tls", tlsConfig != nil})
+	return nil
+}
+
+// newTLSConfig returns nil unless TLS was requested.
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
 	}
 
-	c, err := etcdv2.New(config)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("etcd new %v", config))
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca file %s: no certificates found", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func newTransport(tlsConfig *tls.Config) etcdv2.CancelableTransport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+}
+
+func (c *Client) newContextWithTimeout() (context.Context, context.CancelFunc){
+	//return context.WithTimeout(context.Background(), c.timeout)
+	return context.WithTimeout(c.baseContext(), c.timeout)
+}
 
-	fmt.Printf("config:%+v\n", config)
-	client := &Client{
-		etcdKeysApi: etcdv2.NewKeysAPI(c), timeout: timeout, client: c,
+// newAdmittedContext is newContextWithTimeout for one request of class
+// ("read" or "write"), which has already waited for its rate token. Call it
+// before c.Lock(), a throttled request then does not hold up the others.
+func (c *Client) newAdmittedContext(class string) (context.Context, context.CancelFunc) {
+	ctx, cancel := c.newContextWithTimeout()
+	if c.limits != nil {
+		ctx = c.limits.admit(ctx, class)
 	}
+	return ctx, cancel
+}
 
-	client.ctx, client.cancel = context.WithCancel(context.Background())
-	//cntx, cancle := client.newContextWithTimeout()
-	//cancle = cancle
-	//resp, resperr := client.etcdKeysApi.Set(cntx, "/temp", "123", &etcdv2.SetOptions{})
-	//fmt.Printf("temp: [%v][%v]\n", resp, resperr)
-	return client, nil
+// baseContext is the context requests of c derive from: cancelled by Close,
+// with the values of the context given to WithContext.
+func (c *Client) baseContext() context.Context {
+	if c.values == nil {
+		return c.ctx
+	}
+	return valueContext{Context: c.ctx, values: c.values}
 }
 
+type valueContext struct {
+	context.Context
+	values context.Context
+}
 
-func (c *Client) newContextWithTimeout() (context.Context, context.CancelFunc){
-	//return context.WithTimeout(context.Background(), c.timeout)
-	return context.WithTimeout(c.ctx, c.timeout)
+func (v valueContext) Value(key interface{}) interface{} {
+	if value := v.Context.Value(key); value != nil {
+		return value
+	}
+	return v.values.Value(key)
+}
+
+// WithContext returns a view of c whose requests carry the values of ctx,
+// such as the caller's trace span, to the interceptors and the tracer. The
+// view shares the connection of c and stops when c is closed; neither the
+// deadline nor the cancellation of ctx apply to it and closing the view
+// does nothing.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	v := c.view()
+	v.values = ctx
+	return v
+}
+
+// view returns a Client sharing the connection and settings of c whose
+// Close does nothing.
+func (c *Client) view() *Client {
+	return &Client{
+		backend:   c.backend,
+		timeout:   c.timeout,
+		closed:    true,
+		cancel:    func() {},
+		ctx:       c.ctx,
+		values:    c.values,
+		client:    c.client,
+		format:    c.format,
+		transport: c.transport,
+		metrics:   c.metrics,
+		logger:    c.logger,
+		tracer:    c.tracer,
+		limits:    c.limits,
+		endpoint:  c.endpoint,
+	}
 }
 
 func (c *Client) Set(key string, value string, ttl int64, prevValue string, prevIndex int64) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Set(ctx, key, value, &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, PrevIndex: uint64(prevIndex), PrevValue: prevValue})
+	resp, err := c.backend.Set(ctx, key, value, &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, PrevIndex: uint64(prevIndex), PrevValue: prevValue})
 	cancel()
 	if err != nil {
-		fmt.Printf("err: %v\n", err)
 		return err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return nil
 }
 
 func (c *Client) SetDir(key string, ttl int64) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Set(ctx, key, "", &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, Dir: true, PrevExist: etcdv2.PrevIgnore})
+	resp, err := c.backend.Set(ctx, key, "", &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, Dir: true, PrevExist: etcdv2.PrevIgnore})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return err
 }
 
 func (c *Client) Update(key string, value string, ttl int64) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Set(ctx, key, value, &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, PrevExist: etcdv2.PrevExist})
+	resp, err := c.backend.Set(ctx, key, value, &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, PrevExist: etcdv2.PrevExist})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return nil
 
 }
 
 func (c *Client) UpdateDir(key string, value string, ttl int64) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Set(ctx, key, "", &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, Dir: true, PrevExist: etcdv2.PrevExist})
+	resp, err := c.backend.Set(ctx, key, "", &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, Dir: true, PrevExist: etcdv2.PrevExist})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return nil
 }
 
 func (c *Client) RM(key string, dir bool, recursive bool,  prevValue string, prevIndex int64) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Delete(ctx, key, &etcdv2.DeleteOptions{PrevIndex: uint64(prevIndex), PrevValue: prevValue, Dir: dir, Recursive: recursive})
+	resp, err := c.backend.Delete(ctx, key, &etcdv2.DeleteOptions{PrevIndex: uint64(prevIndex), PrevValue: prevValue, Dir: dir, Recursive: recursive})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return nil
 }
 
 func (c *Client) RMDir(key string) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Delete(ctx, key, &etcdv2.DeleteOptions{Dir: true})
+	resp, err := c.backend.Delete(ctx, key, &etcdv2.DeleteOptions{Dir: true})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return nil
 }
 
 func (c *Client) Get(key string) (string, error) {
+	ctx, cancel := c.newAdmittedContext("read")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Get(ctx, key, &etcdv2.GetOptions{Sort: true, Quorum: true})
+	resp, err := c.backend.Get(ctx, key, &etcdv2.GetOptions{Sort: true, Quorum: true})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return "", err
 	}
 	if resp.Node.Dir {
-		fmt.Printf("%s", fmt.Sprintf("%s: is a directory", resp.Node.Key))
 		return "", errors.New(fmt.Sprintf("%s: is a directory", resp.Node.Key))
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return resp.Node.Value, nil
 }
 
 func (c *Client) List(path string, recursive bool) ([] string, error) {
+	ctx, cancel := c.newAdmittedContext("read")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Get(ctx, path, &etcdv2.GetOptions{Sort: true, Quorum: true, Recursive: recursive})
+	resp, err := c.backend.Get(ctx, path, &etcdv2.GetOptions{Sort: true, Quorum: true, Recursive: recursive})
 	cancel()
 	switch {
 	case err != nil:
-		fmt.Printf("etcd list node %s failed: %s", path, err)
 		return nil, err
 	case !resp.Node.Dir:
-		log.Printf("etcd list node %s failed: not a dir", path)
+		c.logger.Log(LevelWarn, "etcd list node failed: not a dir", Field{"op", "list"}, Field{"key", path})
 		return nil, err
 	default:
 		/*
@@ -270,96 +494,182 @@ func (c *Client) List(path string, recursive bool) ([] string, error) {
 		}
 		*/
 
-		printResponseKey(resp, "extended")
+		c.printResponse(resp)
 		return nodesToStringSlice(resp.Node.Nodes), nil
 	}
 }
 
 func (c *Client) MK(key string, value string, ttl int64, inorder bool) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
 	var err error
 	var resp *etcdv2.Response
 
 	if !inorder {
-		resp, err = c.etcdKeysApi.Set(ctx, key, value, &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, PrevExist: etcdv2.PrevNoExist})
+		resp, err = c.backend.Set(ctx, key, value, &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, PrevExist: etcdv2.PrevNoExist})
 		if (err != nil) {
 
 		} else {
-			printResponseKey(resp, "extended")
+			c.printResponse(resp)
 		}
 
 	} else {
-		resp, err = c.etcdKeysApi.CreateInOrder(ctx, key, value, &etcdv2.CreateInOrderOptions{TTL: time.Duration(ttl) * time.Second})
+		resp, err = c.backend.CreateInOrder(ctx, key, value, &etcdv2.CreateInOrderOptions{TTL: time.Duration(ttl) * time.Second})
 		if (err != nil) {
 
 		} else {
-			printResponseKey(resp, "extended")
+			c.printResponse(resp)
 		}
 	}
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return err
 	}
 	return nil
 }
 
 func (c *Client) MKDir(key string, ttl int64) error {
+	ctx, cancel := c.newAdmittedContext("write")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Set(ctx, key, "", &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, Dir: true, PrevExist: etcdv2.PrevNoExist})
+	resp, err := c.backend.Set(ctx, key, "", &etcdv2.SetOptions{TTL: time.Duration(ttl) * time.Second, Dir: true, PrevExist: etcdv2.PrevNoExist})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return nil
 }
 
 func (c *Client) GetResonse(key string, sort bool, recursive bool) (*etcdv2.Response, error) {
+	ctx, cancel := c.newAdmittedContext("read")
 	c.Lock()
 	defer c.Unlock()
-	ctx, cancel := c.newContextWithTimeout()
-	resp, err := c.etcdKeysApi.Get(ctx, key, &etcdv2.GetOptions{Sort: sort, Quorum: true, Recursive: recursive})
+	resp, err := c.backend.Get(ctx, key, &etcdv2.GetOptions{Sort: sort, Quorum: true, Recursive: recursive})
 	cancel()
 	if err != nil {
-		fmt.Printf("err %v\n", err)
 		return resp, err
 	}
-	printResponseKey(resp, "extended")
+	c.printResponse(resp)
 	return resp, err
 }
 
 //can not return until err from server
 func (c *Client) Watch(key string, recursive bool, onChange OnChangeCallback) (error) {
+	return c.watch(c.baseContext(), key, recursive, func(resp *etcdv2.Response) bool {
+		return onChange(resp.Action, resp.Node.Key, resp.Node.Value)
+	})
+}
+
+// watch is Watch with the full responses, until ctx is done.
+func (c *Client) watch(ctx context.Context, key string, recursive bool, onResponse func(resp *etcdv2.Response) bool) error {
 	//c.Lock()
 	//defer c.Unlock()
 	//exit := make(chan struct{},1)
+	c.metrics.watchStarted()
+	defer c.metrics.watchStopped()
+	base := ctx
+	ctx, span := c.startWatchSpan(base, key, recursive)
 	afterIndex := uint64(0)
-	watcher := c.etcdKeysApi.Watcher(key, &etcdv2.WatcherOptions{AfterIndex: afterIndex, Recursive: recursive})
+	watcher := c.backend.Watcher(key, &etcdv2.WatcherOptions{AfterIndex: afterIndex, Recursive: recursive})
 	for {
 		//resp, err := watcher.Next(context.Background())
-		resp, err := watcher.Next(c.ctx)
+		resp, err := watcher.Next(ctx)
 		if err != nil {
 			if shouldIgnoreError(err) {
+				// the events after afterIndex are gone, watch again from now
+				if afterIndex, err = c.currentIndex(ctx, key); err != nil {
+					endSpan(span, err)
+					return err
+				}
+				watcher = c.backend.Watcher(key, &etcdv2.WatcherOptions{AfterIndex: afterIndex, Recursive: recursive})
+				c.metrics.watchReconnected()
+				c.logger.Log(LevelInfo, "watch index cleared, watching again", Field{"op", "watch"}, Field{"key", key}, Field{"index", afterIndex})
 				continue
 			}
 
+			endSpan(span, err)
 			return err
 		}
 
+		c.traceWatchEvent(base, span, resp)
 		afterIndex = resp.Index
-		if (true == onChange(resp.Action, resp.Node.Key, resp.Node.Value)) {
+		if (true == onResponse(resp)) {
+			endSpan(span, nil)
 			return err
 		}
 
 	}
 }
 
+// WatchFrom is Watch with the full responses, starting after afterIndex (0
+// means from now). Unlike Watch it gives up on every error, including event
+// index cleared, so the caller can resync.
+func (c *Client) WatchFrom(key string, recursive bool, afterIndex uint64, onResponse func(resp *etcdv2.Response) bool) error {
+	return c.watchFrom(c.baseContext(), key, recursive, afterIndex, onResponse)
+}
+
+func (c *Client) watchFrom(ctx context.Context, key string, recursive bool, afterIndex uint64, onResponse func(resp *etcdv2.Response) bool) error {
+	c.metrics.watchStarted()
+	defer c.metrics.watchStopped()
+	base := ctx
+	ctx, span := c.startWatchSpan(base, key, recursive)
+	watcher := c.backend.Watcher(key, &etcdv2.WatcherOptions{AfterIndex: afterIndex, Recursive: recursive})
+	for {
+		resp, err := watcher.Next(ctx)
+		if err != nil {
+			endSpan(span, err)
+			return err
+		}
+		c.traceWatchEvent(base, span, resp)
+		if onResponse(resp) {
+			endSpan(span, nil)
+			return nil
+		}
+	}
+}
+
+func (c *Client) Members() ([]etcdv2.Member, error) {
+	ctx, cancel := c.newContextWithTimeout()
+	defer cancel()
+	if c.client != nil {
+		return etcdv2.NewMembersAPI(c.client).List(ctx)
+	}
+	isLister := func(b Backend) bool { _, ok := b.(memberLister); return ok }
+	if lister, ok := findBackend(c.backend, isLister).(memberLister); ok {
+		return lister.Members(ctx)
+	}
+	return nil, errors.New("backend does not expose cluster members")
+}
+
+// MemberHealth queries /health on each client URL of m and returns nil for
+// the first one that reports healthy.
+func (c *Client) MemberHealth(m etcdv2.Member) error {
+	hc := http.Client{Transport: c.transport, Timeout: c.timeout}
+	var lastErr error
+	for _, url := range m.ClientURLs {
+		resp, err := hc.Get(url + "/health")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if lastErr = EtcdHealthCheck(data); lastErr == nil {
+			return nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("member %s has no client urls", m.ID)
+	}
+	return lastErr
+}
+
 func (c *Client) Close() error {
 	c.Lock()
 	defer c.Unlock()
@@ -369,16 +679,29 @@ func (c *Client) Close() error {
 
 	c.closed = true
 	c.cancel()
+	if c.closeBackend != nil {
+		return c.closeBackend()
+	}
 	return nil
 }
 
 func shouldIgnoreError(err error) bool {
-	switch err := err.(type) {
-	default:
-		return false
-	case *etcdv2.Error:
-		return err.Code == etcdv2.ErrorCodeEventIndexCleared
+	return ErrorCode(err) == etcdv2.ErrorCodeEventIndexCleared
+}
+
+// currentIndex returns the index of the store, for a watch to start again
+// from once the events it waited for are cleared.
+func (c *Client) currentIndex(ctx context.Context, key string) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	resp, err := c.backend.Get(ctx, key, &etcdv2.GetOptions{Quorum: true})
+	if IsEtcdNotFound(err) {
+		return err.(etcdv2.Error).Index, nil
 	}
+	if err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
 }
 
 /*
@@ -424,8 +747,24 @@ func IsEtcdWatchExpired(err error) bool {
 }
 
 
+// IsEtcdUnreachable reports whether no member of the cluster could be
+// reached; the v2 client returns a *ClusterError with the error of each.
 func IsEtcdUnreachable(err error) bool {
-	return err == etcdv2.ErrClusterUnavailable
+	return err == etcdv2.ErrClusterUnavailable || errors.As(err, new(*etcdv2.ClusterError))
+}
+
+
+func IsEtcdUnauthorized(err error) bool {
+	return isEtcdErrorNum(err, etcdv2.ErrorCodeUnauthorized)
+}
+
+// ErrorCode returns the etcd error code carried by err, or 0 when err is not
+// an etcd error.
+func ErrorCode(err error) int {
+	if etcdError, ok := err.(etcdv2.Error); ok {
+		return etcdError.Code
+	}
+	return 0
 }
 
 
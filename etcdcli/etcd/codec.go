@@ -0,0 +1,289 @@
+package etcd
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	etcdv2 "github.com/coreos/etcd/client"
+	"gopkg.in/yaml.v2"
+)
+
+// Codec turns values into the strings etcd stores and back. Binary codecs
+// store base64, etcd v2 values must be valid UTF-8.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) (string, error)
+	// Unmarshal decodes data into v, a pointer.
+	Unmarshal(data string, v interface{}) error
+}
+
+var (
+	JSONCodec Codec = jsonCodec{}
+	YAMLCodec Codec = yamlCodec{}
+	GobCodec  Codec = gobCodec{}
+	// TextCodec stores strings, byte slices, booleans and numbers as they
+	// print, and any encoding.TextMarshaler as its text.
+	TextCodec Codec = textCodec{}
+)
+
+// DecodeError is returned for a value its codec cannot decode.
+type DecodeError struct {
+	Key   string
+	Codec string
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("etcd: decode %s as %s: %v", e.Key, e.Codec, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func decode(codec Codec, key, data string, v interface{}) error {
+	if err := codec.Unmarshal(data, v); err != nil {
+		return &DecodeError{Key: key, Codec: codec.Name(), Err: err}
+	}
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (jsonCodec) Unmarshal(data string, v interface{}) error {
+	return json.Unmarshal([]byte(data), v)
+}
+
+type yamlCodec struct{}
+
+func (yamlCodec) Name() string { return "yaml" }
+
+func (yamlCodec) Marshal(v interface{}) (string, error) {
+	data, err := yaml.Marshal(v)
+	return string(data), err
+}
+
+func (yamlCodec) Unmarshal(data string, v interface{}) error {
+	return yaml.Unmarshal([]byte(data), v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func (gobCodec) Unmarshal(data string, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// ProtoMessage is a message with its own wire encoding, as generated by
+// gogo/protobuf.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// ProtoCodec stores protocol buffers in base64. With MarshalFunc and
+// UnmarshalFunc nil it takes messages implementing ProtoMessage; set them
+// to proto.Marshal and proto.Unmarshal, wrapped, for other generators.
+type ProtoCodec struct {
+	MarshalFunc   func(v interface{}) ([]byte, error)
+	UnmarshalFunc func(data []byte, v interface{}) error
+}
+
+func (ProtoCodec) Name() string { return "protobuf" }
+
+func (p ProtoCodec) Marshal(v interface{}) (string, error) {
+	var data []byte
+	var err error
+	if p.MarshalFunc != nil {
+		data, err = p.MarshalFunc(v)
+	} else if m, ok := v.(ProtoMessage); ok {
+		data, err = m.Marshal()
+	} else {
+		err = fmt.Errorf("%T is not a ProtoMessage", v)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (p ProtoCodec) Unmarshal(data string, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	if p.UnmarshalFunc != nil {
+		return p.UnmarshalFunc(b, v)
+	}
+	if m, ok := v.(ProtoMessage); ok {
+		return m.Unmarshal(b)
+	}
+	return fmt.Errorf("%T is not a ProtoMessage", v)
+}
+
+type textCodec struct{}
+
+func (textCodec) Name() string { return "text" }
+
+func (textCodec) Marshal(v interface{}) (string, error) {
+	if m, ok := v.(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits()), nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return string(rv.Bytes()), nil
+		}
+	}
+	return "", fmt.Errorf("text: cannot encode %T", v)
+}
+
+func (textCodec) Unmarshal(data string, v interface{}) error {
+	if u, ok := v.(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(data))
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("text: cannot decode into %T, not a pointer", v)
+	}
+	rv = rv.Elem()
+	switch rv.Kind() {
+	case reflect.String:
+		rv.SetString(data)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(data)
+		if err != nil {
+			return err
+		}
+		rv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(data, 10, rv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		rv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(data, 10, rv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		rv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(data, rv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		rv.SetFloat(f)
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("text: cannot decode into %T", v)
+		}
+		rv.SetBytes([]byte(data))
+	default:
+		return fmt.Errorf("text: cannot decode into %T", v)
+	}
+	return nil
+}
+
+// GetValue decodes the value of key into v with codec.
+func (c *Client) GetValue(key string, codec Codec, v interface{}) error {
+	value, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	return decode(codec, key, value, v)
+}
+
+// SetValue encodes v with codec and sets it as the value of key.
+func (c *Client) SetValue(key string, codec Codec, v interface{}, ttl int64) error {
+	value, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("etcd: encode %s as %s: %v", key, codec.Name(), err)
+	}
+	return c.Set(key, value, ttl, "", 0)
+}
+
+// ValueEvent is a watch event with the values decoded. Value is nil for
+// deletes and directories, PrevValue when there was no previous value. Err
+// is a *DecodeError when either could not be decoded; the watch goes on.
+type ValueEvent struct {
+	Action    string
+	Key       string
+	Index     uint64
+	Value     interface{}
+	PrevValue interface{}
+	Err       error
+}
+
+// WatchValues is Watch with the values decoded with codec into what
+// newValue returns, a new pointer for every value.
+func (c *Client) WatchValues(key string, recursive bool, codec Codec, newValue func() interface{}, onEvent func(ev *ValueEvent) bool) error {
+	decodeNode := func(node *etcdv2.Node) (interface{}, error) {
+		if node == nil || node.Dir {
+			return nil, nil
+		}
+		v := newValue()
+		if err := decode(codec, node.Key, node.Value, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	return c.watch(c.baseContext(), key, recursive, func(resp *etcdv2.Response) bool {
+		ev := &ValueEvent{Action: resp.Action, Key: resp.Node.Key, Index: resp.Index}
+		if !isRemovalAction(resp.Action) {
+			ev.Value, ev.Err = decodeNode(resp.Node)
+		}
+		prev, err := decodeNode(resp.PrevNode)
+		ev.PrevValue = prev
+		if ev.Err == nil {
+			ev.Err = err
+		}
+		return onEvent(ev)
+	})
+}
+
+func isRemovalAction(action string) bool {
+	return action == "delete" || action == "expire" || action == "compareAndDelete"
+}
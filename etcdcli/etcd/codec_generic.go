@@ -0,0 +1,45 @@
+//go:build go1.18
+// +build go1.18
+
+package etcd
+
+// GetAs returns the value of key decoded with codec.
+func GetAs[T any](c *Client, key string, codec Codec) (T, error) {
+	var v T
+	err := c.GetValue(key, codec, &v)
+	return v, err
+}
+
+// SetAs sets v, encoded with codec, as the value of key.
+func SetAs[T any](c *Client, key string, codec Codec, v T, ttl int64) error {
+	return c.SetValue(key, codec, v, ttl)
+}
+
+// Event is a ValueEvent with typed values. HasValue and HasPrev tell a zero
+// value from no value.
+type Event[T any] struct {
+	Action    string
+	Key       string
+	Index     uint64
+	Value     T
+	HasValue  bool
+	PrevValue T
+	HasPrev   bool
+	Err       error
+}
+
+// WatchAs is Watch with the values decoded with codec before onEvent sees
+// them.
+func WatchAs[T any](c *Client, key string, recursive bool, codec Codec, onEvent func(ev Event[T]) bool) error {
+	newValue := func() interface{} { return new(T) }
+	return c.WatchValues(key, recursive, codec, newValue, func(ev *ValueEvent) bool {
+		typed := Event[T]{Action: ev.Action, Key: ev.Key, Index: ev.Index, Err: ev.Err}
+		if v, ok := ev.Value.(*T); ok {
+			typed.Value, typed.HasValue = *v, true
+		}
+		if v, ok := ev.PrevValue.(*T); ok {
+			typed.PrevValue, typed.HasPrev = *v, true
+		}
+		return onEvent(typed)
+	})
+}
@@ -0,0 +1,68 @@
+//go:build go1.18
+// +build go1.18
+
+package etcd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetSetAs(t *testing.T) {
+	c := newTestClient(t)
+	want := codecConfig{Name: "a", N: 3, Hosts: []string{"h1"}}
+	for _, codec := range []Codec{JSONCodec, YAMLCodec, GobCodec} {
+		if err := SetAs(c, "/c/x", codec, want, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := GetAs[codecConfig](c, "/c/x", codec); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v: %v", codec.Name(), got, err)
+		}
+	}
+
+	SetAs(c, "/c/n", TextCodec, 42, 0)
+	if n, err := GetAs[int64](c, "/c/n", TextCodec); n != 42 || err != nil {
+		t.Errorf("number %d: %v", n, err)
+	}
+	if n, err := GetAs[int8](c, "/c/x", TextCodec); n != 0 || err == nil {
+		t.Errorf("bad number %d: %v", n, err)
+	}
+}
+
+func TestWatchAs(t *testing.T) {
+	c := newTestClient(t)
+	SetAs(c, "/w/n", TextCodec, 1, 0)
+	got := make(chan Event[int], 10)
+	go WatchAs(c, "/w", true, TextCodec, func(ev Event[int]) bool {
+		got <- ev
+		return ev.Action == "delete"
+	})
+	time.Sleep(50 * time.Millisecond)
+	SetAs(c, "/w/n", TextCodec, 0, 0)
+	c.Set("/w/n", "x", 0, "", 0)
+	SetAs(c, "/w/n", TextCodec, 2, 0)
+	c.RM("/w/n", false, false, "", 0)
+
+	// the text "x" fails to decode as the value, then as the previous one
+	for _, want := range []struct {
+		ev     Event[int]
+		failed bool
+	}{
+		{Event[int]{Action: "set", Key: "/w/n", Value: 0, HasValue: true, PrevValue: 1, HasPrev: true}, false},
+		{Event[int]{Action: "set", Key: "/w/n", PrevValue: 0, HasPrev: true}, true},
+		{Event[int]{Action: "set", Key: "/w/n", Value: 2, HasValue: true}, true},
+		{Event[int]{Action: "delete", Key: "/w/n", PrevValue: 2, HasPrev: true}, false},
+	} {
+		select {
+		case ev := <-got:
+			failed := ev.Err != nil
+			ev.Index, ev.Err = 0, nil
+			if ev != want.ev || failed != want.failed {
+				t.Errorf("event %+v, error %v, want %+v", ev, failed, want.ev)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event")
+		}
+	}
+}
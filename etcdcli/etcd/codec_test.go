@@ -0,0 +1,191 @@
+package etcd
+
+import (
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type codecConfig struct {
+	Name  string   `json:"name" yaml:"name"`
+	N     int      `json:"n" yaml:"n"`
+	Hosts []string `json:"hosts" yaml:"hosts"`
+}
+
+// protoMessage encodes itself as its text, like a generated message would
+// as its wire format.
+type protoMessage struct {
+	text string
+}
+
+func (m *protoMessage) Marshal() ([]byte, error) { return []byte(m.text), nil }
+
+func (m *protoMessage) Unmarshal(data []byte) error {
+	m.text = string(data)
+	return nil
+}
+
+func TestCodecs(t *testing.T) {
+	c := newTestClient(t)
+	want := codecConfig{Name: "a", N: 3, Hosts: []string{"h1", "h2"}}
+	for _, codec := range []Codec{JSONCodec, YAMLCodec, GobCodec} {
+		if err := c.SetValue("/c/"+codec.Name(), codec, want, 0); err != nil {
+			t.Fatal(err)
+		}
+		var got codecConfig
+		if err := c.GetValue("/c/"+codec.Name(), codec, &got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %+v: %v", codec.Name(), got, err)
+		}
+	}
+	if v, _ := c.Get("/c/json"); v != `{"name":"a","n":3,"hosts":["h1","h2"]}` {
+		t.Errorf("json stored as %q", v)
+	}
+	if v, _ := c.Get("/c/yaml"); v != "name: a\n\"n\": 3\nhosts:\n- h1\n- h2\n" {
+		t.Errorf("yaml stored as %q", v)
+	}
+
+	codec := ProtoCodec{}
+	c.SetValue("/c/proto", codec, &protoMessage{"\x00wire"}, 0)
+	if v, _ := c.Get("/c/proto"); v != "AHdpcmU=" {
+		t.Errorf("protobuf stored as %q", v)
+	}
+	var m protoMessage
+	if err := c.GetValue("/c/proto", codec, &m); err != nil || m.text != "\x00wire" {
+		t.Errorf("protobuf read %q: %v", m.text, err)
+	}
+	if err := c.SetValue("/c/proto", codec, want, 0); err == nil {
+		t.Error("protobuf encoded a plain struct")
+	}
+	codec = ProtoCodec{
+		MarshalFunc:   func(v interface{}) ([]byte, error) { return []byte(v.(string)), nil },
+		UnmarshalFunc: func(data []byte, v interface{}) error { *v.(*string) = string(data); return nil },
+	}
+	c.SetValue("/c/proto", codec, "funcs", 0)
+	var s string
+	if err := c.GetValue("/c/proto", codec, &s); err != nil || s != "funcs" {
+		t.Errorf("protobuf with funcs %q: %v", s, err)
+	}
+}
+
+func TestTextCodec(t *testing.T) {
+	n := 7
+	for _, tt := range []struct {
+		v    interface{}
+		text string
+	}{
+		{"s", "s"},
+		{[]byte("b"), "b"},
+		{true, "true"},
+		{int8(-8), "-8"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{float32(0.1), "0.1"},
+		{1.5, "1.5"},
+		{net.ParseIP("10.0.0.1"), "10.0.0.1"},
+		{5 * time.Second, "5000000000"},
+	} {
+		text, err := TextCodec.Marshal(tt.v)
+		if err != nil || text != tt.text {
+			t.Errorf("%T: %q, %v", tt.v, text, err)
+			continue
+		}
+		got := reflect.New(reflect.TypeOf(tt.v))
+		if err := TextCodec.Unmarshal(text, got.Interface()); err != nil || !reflect.DeepEqual(got.Elem().Interface(), tt.v) {
+			t.Errorf("%T: read back %v, %v", tt.v, got.Elem(), err)
+		}
+	}
+
+	if text, err := TextCodec.Marshal(&n); text != "7" || err != nil {
+		t.Errorf("pointer %q, %v", text, err)
+	}
+	for _, v := range []interface{}{[]int{1}, struct{}{}, nil} {
+		if _, err := TextCodec.Marshal(v); err == nil {
+			t.Errorf("%T encoded", v)
+		}
+	}
+	var i8 int8
+	var u uint
+	var b bool
+	for _, tt := range []struct {
+		text string
+		v    interface{}
+	}{
+		{"1", i8},
+		{"300", &i8},
+		{"-1", &u},
+		{"yes", &b},
+		{"x", &[]int{}},
+	} {
+		if err := TextCodec.Unmarshal(tt.text, tt.v); err == nil {
+			t.Errorf("%q decoded into %T", tt.text, tt.v)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	c := newTestClient(t)
+	c.Set("/bad", "zz", 0, "", 0)
+
+	var n int
+	err := c.GetValue("/bad", TextCodec, &n)
+	var de *DecodeError
+	if !errors.As(err, &de) || de.Key != "/bad" || de.Codec != "text" {
+		t.Fatalf("error %#v", err)
+	}
+	if !errors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("cause %v", de.Err)
+	}
+	if err.Error() != `etcd: decode /bad as text: strconv.ParseInt: parsing "zz": invalid syntax` {
+		t.Errorf("message %q", err)
+	}
+	if err := c.GetValue("/missing", TextCodec, &n); !IsEtcdNotFound(err) {
+		t.Errorf("missing key: %v", err)
+	}
+	if err := c.SetValue("/ch", JSONCodec, make(chan int), 0); err == nil {
+		t.Error("channel encoded")
+	}
+	if _, err := c.Get("/ch"); !IsEtcdNotFound(err) {
+		t.Errorf("value set after an encode error: %v", err)
+	}
+}
+
+func TestWatchValues(t *testing.T) {
+	c := newTestClient(t)
+	got := make(chan *ValueEvent, 10)
+	go c.WatchValues("/w", true, JSONCodec, func() interface{} { return new(codecConfig) }, func(ev *ValueEvent) bool {
+		got <- ev
+		return ev.Action == "delete"
+	})
+	time.Sleep(50 * time.Millisecond)
+	c.SetValue("/w/a", JSONCodec, codecConfig{Name: "x"}, 0)
+	c.Set("/w/a", "{", 0, "", 0)
+	c.MKDir("/w/d", 0)
+	c.RM("/w/a", false, false, "", 0)
+
+	next := func() *ValueEvent {
+		select {
+		case ev := <-got:
+			return ev
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event")
+			return nil
+		}
+	}
+	if ev := next(); ev.Key != "/w/a" || ev.Value.(*codecConfig).Name != "x" || ev.PrevValue != nil || ev.Err != nil {
+		t.Errorf("set %+v", ev)
+	}
+	// the watch goes on after a value it cannot decode
+	if ev := next(); ev.Value != nil || ev.PrevValue.(*codecConfig).Name != "x" || ev.Err == nil {
+		t.Errorf("bad value %+v", ev)
+	}
+	if ev := next(); ev.Key != "/w/d" || ev.Value != nil || ev.Err != nil {
+		t.Errorf("dir %+v", ev)
+	}
+	var de *DecodeError
+	if ev := next(); ev.Action != "delete" || ev.Value != nil || !errors.As(ev.Err, &de) || de.Key != "/w/a" {
+		t.Errorf("delete %+v", ev)
+	}
+}
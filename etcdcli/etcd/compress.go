@@ -0,0 +1,251 @@
+package etcd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	etcdv2 "github.com/coreos/etcd/client"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedPrefix starts every compressed value, followed by the algorithm
+// and the base64 of the compressed bytes:
+//
+//	zip:v1:gzip:<base64>
+const compressedPrefix = "zip:v1:"
+
+// DefaultMaxDecompressedSize caps what a compressed value may expand to.
+const DefaultMaxDecompressedSize = 64 << 20
+
+// Compression compresses written values of at least Threshold bytes with
+// Algorithm, "gzip" or "zstd", when that makes them smaller. Every
+// compressed value carries a header, so a reader decompresses whatever it
+// finds whatever its own settings; a plain value that happens to start with
+// the header "zip:v1:" is taken for a compressed one.
+//
+// With Encryption as well, values are compressed before they are encrypted.
+// Snapshot and Export dump compressed values as they are stored.
+type Compression struct {
+	Algorithm string
+	// Threshold is the smallest value compressed, 1 KiB by default.
+	Threshold int
+	// MaxDecompressedSize guards against values that expand without end,
+	// DefaultMaxDecompressedSize by default.
+	MaxDecompressedSize int
+}
+
+type compressedBackend struct {
+	next      Backend
+	algorithm string
+	threshold int
+	max       int
+	zenc      *zstd.Encoder
+	zdec      *zstd.Decoder
+}
+
+func newCompressedBackend(next Backend, cfg Compression) (*compressedBackend, error) {
+	b := &compressedBackend{next: next, algorithm: cfg.Algorithm, threshold: cfg.Threshold, max: cfg.MaxDecompressedSize}
+	switch b.algorithm {
+	case "":
+		b.algorithm = "gzip"
+	case "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("compression: unknown algorithm %q", cfg.Algorithm)
+	}
+	if b.threshold <= 0 {
+		b.threshold = 1024
+	}
+	if b.max <= 0 {
+		b.max = DefaultMaxDecompressedSize
+	}
+
+	var err error
+	if b.zenc, err = zstd.NewWriter(nil); err != nil {
+		return nil, err
+	}
+	if b.zdec, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(b.max))); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *compressedBackend) Unwrap() Backend {
+	return b.next
+}
+
+// compress returns value compressed, or as it is when it is small or does
+// not shrink.
+func (b *compressedBackend) compress(value string) (string, error) {
+	if len(value) < b.threshold {
+		return value, nil
+	}
+	var data []byte
+	switch b.algorithm {
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := io.WriteString(w, value); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		data = buf.Bytes()
+	case "zstd":
+		data = b.zenc.EncodeAll([]byte(value), nil)
+	}
+	compressed := compressedPrefix + b.algorithm + ":" + base64.StdEncoding.EncodeToString(data)
+	if len(compressed) >= len(value) {
+		return value, nil
+	}
+	return compressed, nil
+}
+
+func (b *compressedBackend) decompress(key, value string) (string, error) {
+	if !strings.HasPrefix(value, compressedPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(value[len(compressedPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("compression: %s: invalid header", key)
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("compression: %s: %v", key, err)
+	}
+
+	var out []byte
+	switch parts[0] {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("compression: %s: %v", key, err)
+		}
+		out, err = ioutil.ReadAll(io.LimitReader(r, int64(b.max)+1))
+		if err != nil {
+			return "", fmt.Errorf("compression: %s: %v", key, err)
+		}
+		if len(out) > b.max {
+			return "", fmt.Errorf("compression: %s: %v", key, errTooLarge)
+		}
+	case "zstd":
+		if out, err = b.zdec.DecodeAll(data, nil); err != nil {
+			return "", fmt.Errorf("compression: %s: %v", key, err)
+		}
+	default:
+		return "", fmt.Errorf("compression: %s: unknown algorithm %q", key, parts[0])
+	}
+	return string(out), nil
+}
+
+var errTooLarge = errors.New("decompressed value larger than the limit")
+
+// storedAsIs reports whether value is too small for this client to have
+// compressed it. A compare by such a value is first sent as it is, which
+// saves reading the stored value; only when it fails, the stored value may
+// have been compressed by a client with a lower threshold, is it read and
+// compared decompressed.
+func (b *compressedBackend) storedAsIs(value string) bool {
+	return len(value) < b.threshold
+}
+
+func (b *compressedBackend) decompressNode(node *etcdv2.Node) error {
+	var err error
+	walkNodes(node, func(n *etcdv2.Node) {
+		if err != nil || n.Dir {
+			return
+		}
+		n.Value, err = b.decompress(n.Key, n.Value)
+	})
+	return err
+}
+
+func (b *compressedBackend) response(resp *etcdv2.Response, err error) (*etcdv2.Response, error) {
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	if err := b.decompressNode(resp.Node); err != nil {
+		return nil, err
+	}
+	if err := b.decompressNode(resp.PrevNode); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (b *compressedBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	if storedValues(ctx) {
+		return b.next.Get(ctx, key, opts)
+	}
+	return b.response(b.next.Get(ctx, key, opts))
+}
+
+func (b *compressedBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	if storedValues(ctx) && (strings.HasPrefix(value, compressedPrefix) || strings.HasPrefix(value, encryptedPrefix)) {
+		return b.next.Set(ctx, key, value, opts)
+	}
+	if opts != nil && (opts.Dir || opts.Refresh) {
+		return b.response(b.next.Set(ctx, key, value, opts))
+	}
+	value, err := b.compress(value)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.PrevValue != "" {
+		if b.storedAsIs(opts.PrevValue) {
+			resp, err := b.next.Set(ctx, key, value, opts)
+			if !IsEtcdTestFailed(err) {
+				return b.response(resp, err)
+			}
+		}
+		index, err := compareByIndex(ctx, b.next, key, opts.PrevValue, opts.PrevIndex, b.decompress)
+		if err != nil {
+			return nil, err
+		}
+		o := *opts
+		o.PrevValue, o.PrevIndex = "", index
+		opts = &o
+	}
+	return b.response(b.next.Set(ctx, key, value, opts))
+}
+
+func (b *compressedBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	if opts != nil && opts.PrevValue != "" {
+		if b.storedAsIs(opts.PrevValue) {
+			resp, err := b.next.Delete(ctx, key, opts)
+			if !IsEtcdTestFailed(err) {
+				return b.response(resp, err)
+			}
+		}
+		index, err := compareByIndex(ctx, b.next, key, opts.PrevValue, opts.PrevIndex, b.decompress)
+		if err != nil {
+			return nil, err
+		}
+		o := *opts
+		o.PrevValue, o.PrevIndex = "", index
+		opts = &o
+	}
+	return b.response(b.next.Delete(ctx, key, opts))
+}
+
+func (b *compressedBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	value, err := b.compress(value)
+	if err != nil {
+		return nil, err
+	}
+	return b.response(b.next.CreateInOrder(ctx, dir, value, opts))
+}
+
+func (b *compressedBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	next := b.next.Watcher(key, opts)
+	return WatcherFunc(func(ctx context.Context) (*etcdv2.Response, error) {
+		return b.response(next.Next(ctx))
+	})
+}
@@ -0,0 +1,173 @@
+package etcd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newCompressedClient returns a client compressing with cfg and a plain one
+// on the same store.
+func newCompressedClient(t *testing.T, cfg Compression) (*Client, *Client) {
+	raw := newTestClient(t)
+	c, err := NewClientWithConfig(Config{Backend: raw.Backend(), Compression: &cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, raw
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("compressible ", 200)
+	for _, algorithm := range []string{"gzip", "zstd"} {
+		t.Run(algorithm, func(t *testing.T) {
+			c, raw := newCompressedClient(t, Compression{Algorithm: algorithm})
+
+			c.Set("/large", large, 0, "", 0)
+			c.Set("/small", "tiny", 0, "", 0)
+			stored, _ := raw.Get("/large")
+			if !strings.HasPrefix(stored, "zip:v1:"+algorithm+":") || len(stored) >= len(large) {
+				t.Errorf("stored %d bytes: %.40q", len(stored), stored)
+			}
+			if v, _ := raw.Get("/small"); v != "tiny" {
+				t.Errorf("value under the threshold stored as %q", v)
+			}
+			if v, _ := c.Get("/large"); v != large {
+				t.Errorf("read back %d bytes", len(v))
+			}
+			resp, _ := c.GetResonse("/", true, true)
+			for _, node := range resp.Node.Nodes {
+				if node.Key == "/large" && node.Value != large {
+					t.Error("listing not decompressed")
+				}
+			}
+
+			// compare by the plain value
+			if err := c.Set("/large", "x", 0, "wrong", 0); !IsEtcdTestFailed(err) {
+				t.Errorf("swap from a wrong value: %v", err)
+			}
+			if err := c.Set("/large", large+"!", 0, large, 0); err != nil {
+				t.Errorf("swap: %v", err)
+			}
+			if err := c.RM("/large", false, false, large+"!", 0); err != nil {
+				t.Errorf("compare and delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressionReaders(t *testing.T) {
+	large := strings.Repeat("a", 4096)
+	gz, raw := newCompressedClient(t, Compression{Algorithm: "gzip", Threshold: 100})
+	gz.Set("/k", large, 0, "", 0)
+
+	// the header decides, not the reader's settings
+	zs, _ := NewClientWithConfig(Config{Backend: raw.Backend(), Compression: &Compression{Algorithm: "zstd"}})
+	if v, _ := zs.Get("/k"); v != large {
+		t.Errorf("zstd reader got %d bytes", len(v))
+	}
+	// incompressible values stay as they are
+	random := "0123456789abcdefghijklmnopqrstuvwxyz"
+	gz.Set("/r", random+random[:20], 0, "", 0)
+	if v, _ := raw.Get("/r"); v != random+random[:20] {
+		t.Errorf("incompressible stored as %q", v)
+	}
+
+	if _, err := NewClientWithConfig(Config{Backend: raw.Backend(), Compression: &Compression{Algorithm: "lz4"}}); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
+
+func TestCompressionLimit(t *testing.T) {
+	c, raw := newCompressedClient(t, Compression{MaxDecompressedSize: 1000})
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(bytes.Repeat([]byte{0}, 10000))
+	w.Close()
+	raw.Set("/bomb", "zip:v1:gzip:"+base64.StdEncoding.EncodeToString(buf.Bytes()), 0, "", 0)
+	if _, err := c.Get("/bomb"); err == nil || !strings.Contains(err.Error(), errTooLarge.Error()) {
+		t.Errorf("value over the limit: %v", err)
+	}
+
+	for _, bad := range []string{"zip:v1:gzip", "zip:v1:gzip:!!", "zip:v1:lz4:AAAA"} {
+		raw.Set("/bad", bad, 0, "", 0)
+		if _, err := c.Get("/bad"); err == nil {
+			t.Errorf("read of %q", bad)
+		}
+	}
+}
+
+func TestCompressionWithEncryption(t *testing.T) {
+	raw := newTestClient(t)
+	c, err := NewClientWithConfig(Config{
+		Backend:     raw.Backend(),
+		Compression: &Compression{},
+		Encryption:  &Encryption{Prefixes: []string{"/"}, Keys: []EncryptionKey{testKey1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("secret ", 1000)
+	c.Set("/k", large, 0, "", 0)
+
+	stored, _ := raw.Get("/k")
+	if !strings.HasPrefix(stored, "enc:v1:") || len(stored) >= len(large) {
+		t.Errorf("stored %d bytes: %.40q", len(stored), stored)
+	}
+	if v, _ := c.Get("/k"); v != large {
+		t.Errorf("read back %d bytes", len(v))
+	}
+}
+
+func TestCompressionCompareRoundTrips(t *testing.T) {
+	b := &countingBackend{Backend: NewMemoryBackend()}
+	c, err := NewClientWithConfig(Config{Backend: b, Compression: &Compression{Threshold: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	low, _ := NewClientWithConfig(Config{Backend: b.Backend, Compression: &Compression{Threshold: 1}})
+	large := strings.Repeat("compressible ", 20)
+	small := strings.Repeat("ab", 45)
+
+	for _, tt := range []struct {
+		stored  *Client
+		value   string
+		swapped bool
+		gets    int32
+	}{
+		// a value under the threshold is compared by the cluster
+		{c, small, true, 0},
+		{c, small, false, 1},
+		// a larger one may be compressed, it is read first
+		{c, large, true, 1},
+		{c, large, false, 1},
+		// a small value compressed by another client is found on a retry
+		{low, small, true, 1},
+	} {
+		tt.stored.Set("/k", tt.value, 0, "", 0)
+		prev := tt.value
+		if !tt.swapped {
+			prev = tt.value[1:]
+		}
+		atomic.StoreInt32(&b.gets, 0)
+		err := c.Set("/k", "new", 0, prev, 0)
+		if (err == nil) != tt.swapped || err != nil && !IsEtcdTestFailed(err) {
+			t.Errorf("swap from %d bytes: %v", len(prev), err)
+		}
+		if n := atomic.LoadInt32(&b.gets); n != tt.gets {
+			t.Errorf("swap from %d bytes read %d times, want %d", len(prev), n, tt.gets)
+		}
+
+		tt.stored.Set("/k", tt.value, 0, "", 0)
+		atomic.StoreInt32(&b.gets, 0)
+		err = c.RM("/k", false, false, prev, 0)
+		if (err == nil) != tt.swapped || atomic.LoadInt32(&b.gets) != tt.gets {
+			t.Errorf("delete from %d bytes: %v, %d reads", len(prev), err, atomic.LoadInt32(&b.gets))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"etcdcli/etcdpath"
+)
+
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Change is one difference between two subtrees. Key is relative to the
+// compared prefixes; Old is nil for Added and New is nil for Removed.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	Key  string     `json:"key"`
+	Old  *DumpNode  `json:"old,omitempty"`
+	New  *DumpNode  `json:"new,omitempty"`
+}
+
+type DiffOptions struct {
+	// Ignore holds path.Match patterns applied to the relative key, e.g.
+	// "/locks/*". A key is ignored when it or one of its parents matches.
+	Ignore []string
+}
+
+// Diff compares prefix a on c with prefix b on other, which may be c itself.
+func (c *Client) Diff(a string, other *Client, b string, opts DiffOptions) ([]Change, error) {
+	old, err := c.Snapshot(a)
+	if err != nil && !IsEtcdNotFound(err) {
+		return nil, err
+	}
+	if old == nil {
+		old = &Dump{Prefix: a}
+	}
+
+	cur, err := other.Snapshot(b)
+	if err != nil && !IsEtcdNotFound(err) {
+		return nil, err
+	}
+	if cur == nil {
+		cur = &Dump{Prefix: b}
+	}
+	return DiffDumps(old, cur, opts)
+}
+
+// DiffDumps compares two snapshots, old on the left and cur on the right.
+// Use it with ReadDump and Snapshot to compare an export with live data.
+func DiffDumps(old *Dump, cur *Dump, opts DiffOptions) ([]Change, error) {
+	for _, pattern := range opts.Ignore {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("bad ignore pattern %q: %v", pattern, err)
+		}
+	}
+
+	left := relativeNodes(old, opts.Ignore)
+	right := relativeNodes(cur, opts.Ignore)
+
+	var changes []Change
+	for key, o := range left {
+		o := o
+		n, ok := right[key]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: Removed, Key: key, Old: &o})
+		case o.Dir != n.Dir || o.Value != n.Value:
+			changes = append(changes, Change{Kind: Changed, Key: key, Old: &o, New: &n})
+		}
+	}
+	for key, n := range right {
+		n := n
+		if _, ok := left[key]; !ok {
+			changes = append(changes, Change{Kind: Added, Key: key, New: &n})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes, nil
+}
+
+// relativeNodes indexes d by key relative to d.Prefix, dropping the root
+// directory itself and ignored keys.
+func relativeNodes(d *Dump, ignore []string) map[string]DumpNode {
+	// dumps from files may carry the prefix as it was typed
+	prefix := strings.TrimSuffix(etcdpath.Clean(d.Prefix), "/")
+	nodes := make(map[string]DumpNode, len(d.Nodes))
+	for _, node := range d.Nodes {
+		key := strings.TrimPrefix(etcdpath.Clean(node.Key), prefix)
+		if key == "" {
+			if node.Dir {
+				continue
+			}
+			// comparing two single keys
+			key = "/"
+		} else if ignored(key, ignore) {
+			continue
+		}
+		nodes[key] = node
+	}
+	return nodes
+}
+
+func ignored(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		for k := key; k != "/" && k != "."; k = path.Dir(k) {
+			if ok, _ := path.Match(pattern, k); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteDiff prints changes as "text", a unified diff style listing headed by
+// the two labels, or as "json".
+func WriteDiff(w io.Writer, changes []Change, format string, oldLabel string, newLabel string) error {
+	switch format {
+	case "json":
+		if changes == nil {
+			changes = []Change{}
+		}
+		b, err := json.MarshalIndent(changes, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	case "text":
+		if len(changes) == 0 {
+			return nil
+		}
+		fmt.Fprintf(w, "--- %s\n+++ %s\n", oldLabel, newLabel)
+		for _, change := range changes {
+			if change.Old != nil {
+				fmt.Fprintf(w, "-%s\n", diffLine(change.Key, change.Old))
+			}
+			if change.New != nil {
+				fmt.Fprintf(w, "+%s\n", diffLine(change.Key, change.New))
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported diff format: %s", format)
+}
+
+func diffLine(key string, node *DumpNode) string {
+	if node.Dir {
+		return key + "/"
+	}
+	return fmt.Sprintf("%s = %q", key, node.Value)
+}
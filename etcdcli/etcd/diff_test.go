@@ -0,0 +1,127 @@
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// changeKinds returns the changes as "kind key".
+func changeKinds(changes []Change) []string {
+	var kinds []string
+	for _, change := range changes {
+		kinds = append(kinds, string(change.Kind)+" "+change.Key)
+	}
+	return kinds
+}
+
+func TestDiff(t *testing.T) {
+	c := newTestClient(t)
+	for key, value := range map[string]string{
+		"/a/same": "1", "/a/changed": "old", "/a/removed": "r", "/a/locks/l": "1", "/a/kind": "file",
+		"/b/same": "1", "/b/changed": "new", "/b/added": "n", "/b/locks/l": "2", "/b/kind/x": "dir",
+	} {
+		c.Set(key, value, 0, "", 0)
+	}
+
+	changes, err := c.Diff("/a", c, "/b", DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"added /added", "changed /changed", "changed /kind", "added /kind/x", "changed /locks/l", "removed /removed"}
+	if kinds := changeKinds(changes); !reflect.DeepEqual(kinds, want) {
+		t.Errorf("changes %v, want %v", kinds, want)
+	}
+	if changes[1].Old.Value != "old" || changes[1].New.Value != "new" {
+		t.Errorf("changed %+v %+v", changes[1].Old, changes[1].New)
+	}
+
+	changes, _ = c.Diff("/a", c, "/b", DiffOptions{Ignore: []string{"/locks", "/k*"}})
+	want = []string{"added /added", "changed /changed", "removed /removed"}
+	if kinds := changeKinds(changes); !reflect.DeepEqual(kinds, want) {
+		t.Errorf("changes ignoring %v, want %v", kinds, want)
+	}
+	if _, err := c.Diff("/a", c, "/b", DiffOptions{Ignore: []string{"["}}); err == nil {
+		t.Error("bad pattern accepted")
+	}
+
+	// prefixes are compared as the keys are stored
+	for _, tt := range []struct{ a, b string }{{"a", "/b"}, {"/a/", "b/"}, {" a/.", "//b"}} {
+		changes, _ = c.Diff(tt.a, c, tt.b, DiffOptions{})
+		if len(changes) != 6 {
+			t.Errorf("diff %q %q: %v", tt.a, tt.b, changeKinds(changes))
+		}
+	}
+	old := &Dump{Prefix: "a/", Nodes: []DumpNode{{Key: "/a/x", Value: "1"}}}
+	cur := &Dump{Prefix: "/b/", Nodes: []DumpNode{{Key: "/b/x", Value: "1"}}}
+	if changes, _ = DiffDumps(old, cur, DiffOptions{}); len(changes) != 0 {
+		t.Errorf("dumps with raw prefixes %v", changeKinds(changes))
+	}
+
+	// a missing side is empty
+	changes, _ = c.Diff("/a/locks", c, "/missing", DiffOptions{})
+	if kinds := changeKinds(changes); !reflect.DeepEqual(kinds, []string{"removed /l"}) {
+		t.Errorf("against a missing prefix %v", kinds)
+	}
+	// two single keys
+	changes, _ = c.Diff("/a/same", c, "/b/changed", DiffOptions{})
+	if kinds := changeKinds(changes); !reflect.DeepEqual(kinds, []string{"changed /"}) {
+		t.Errorf("single keys %v", kinds)
+	}
+}
+
+func TestDiffAcrossClients(t *testing.T) {
+	a, b := newTestClient(t), newTestClient(t)
+	a.Set("/cfg/x", "1", 0, "", 0)
+	b.Set("/copy/x", "1", 0, "", 0)
+	if changes, err := a.Diff("/cfg", b, "/copy", DiffOptions{}); len(changes) != 0 || err != nil {
+		t.Errorf("equal trees %v: %v", changes, err)
+	}
+
+	d, _ := a.Snapshot("/cfg")
+	b.Set("/copy/y", "2", 0, "", 0)
+	cur, _ := b.Snapshot("/copy")
+	changes, _ := DiffDumps(d, cur, DiffOptions{})
+	if kinds := changeKinds(changes); !reflect.DeepEqual(kinds, []string{"added /y"}) {
+		t.Errorf("dumps %v", kinds)
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	changes := []Change{
+		{Kind: Added, Key: "/n", New: &DumpNode{Key: "/b/n", Value: "v"}},
+		{Kind: Changed, Key: "/c", Old: &DumpNode{Key: "/a/c", Value: "1"}, New: &DumpNode{Key: "/b/c", Dir: true}},
+		{Kind: Removed, Key: "/r", Old: &DumpNode{Key: "/a/r", Value: "x"}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDiff(&buf, changes, "text", "/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	want := "--- /a\n+++ /b\n+/n = \"v\"\n-/c = \"1\"\n+/c/\n-/r = \"x\"\n"
+	if buf.String() != want {
+		t.Errorf("text\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	WriteDiff(&buf, nil, "text", "/a", "/b")
+	if buf.Len() != 0 {
+		t.Errorf("no changes printed %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteDiff(&buf, nil, "json", "", ""); err != nil || buf.String() != "[]\n" {
+		t.Errorf("empty json %q: %v", buf.String(), err)
+	}
+	buf.Reset()
+	WriteDiff(&buf, changes, "json", "", "")
+	var decoded []Change
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, changes) {
+		t.Errorf("json %s: %v", buf.String(), err)
+	}
+
+	if err := WriteDiff(&buf, changes, "html", "", ""); err == nil {
+		t.Error("html diff")
+	}
+}
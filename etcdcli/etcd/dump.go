@@ -0,0 +1,133 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+	"gopkg.in/yaml.v2"
+)
+
+// DumpVersion is the version written by Export. Bump it whenever the layout
+// of Dump changes in a way older readers cannot handle.
+const DumpVersion = 1
+
+// Dump is a portable snapshot of a subtree.
+type Dump struct {
+	Version int    `json:"version" yaml:"version"`
+	Prefix  string `json:"prefix" yaml:"prefix"`
+	// ClusterIndex is the etcd index the snapshot was taken at. Watching from
+	// ClusterIndex+1 replays everything that happened after the export.
+	ClusterIndex uint64    `json:"clusterIndex" yaml:"clusterIndex"`
+	CreatedAt    time.Time `json:"createdAt" yaml:"createdAt"`
+	// Nodes is the flattened subtree, parents always before their children.
+	Nodes []DumpNode `json:"nodes" yaml:"nodes"`
+}
+
+// DumpNode is one key or directory in a Dump. Keys are absolute.
+type DumpNode struct {
+	Key        string     `json:"key" yaml:"key"`
+	Dir        bool       `json:"dir,omitempty" yaml:"dir,omitempty"`
+	Value      string     `json:"value,omitempty" yaml:"value,omitempty"`
+	TTL        int64      `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	Expiration *time.Time `json:"expiration,omitempty" yaml:"expiration,omitempty"`
+
+	// index is the ModifiedIndex at the snapshot, not part of the dump
+	index uint64
+}
+
+type storedValuesKey struct{}
+
+// withStoredValues marks the requests made with ctx to read values as they
+// are stored, still encrypted and compressed, and to write the values that
+// already carry an encryption or compression header as they are.
+func withStoredValues(ctx context.Context) context.Context {
+	return context.WithValue(ctx, storedValuesKey{}, true)
+}
+
+func storedValues(ctx context.Context) bool {
+	stored, _ := ctx.Value(storedValuesKey{}).(bool)
+	return stored
+}
+
+// Snapshot reads prefix recursively with a quorum Get and returns it as a Dump.
+//
+// Values are dumped as they are stored: on a client with Encryption or
+// Compression, encrypted and compressed values stay so, secrets do not end
+// up in plaintext in an export. Import writes them back as they are, a
+// client with the keys reads them again.
+func (c *Client) Snapshot(prefix string) (*Dump, error) {
+	return c.snapshot(prefix, true)
+}
+
+// snapshot is Snapshot, with the values decrypted and decompressed unless
+// stored is set.
+func (c *Client) snapshot(prefix string, stored bool) (*Dump, error) {
+	ctx, cancel := c.newAdmittedContext("read")
+	if stored {
+		ctx = withStoredValues(ctx)
+	}
+	c.Lock()
+	resp, err := c.backend.Get(ctx, prefix, &etcdv2.GetOptions{Sort: true, Quorum: true, Recursive: true})
+	cancel()
+	c.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dump{
+		Version:      DumpVersion,
+		Prefix:       etcdpath.Clean(prefix),
+		ClusterIndex: resp.Index,
+		CreatedAt:    time.Now().UTC(),
+	}
+	walkNodes(resp.Node, func(node *etcdv2.Node) {
+		d.Nodes = append(d.Nodes, DumpNode{
+			Key:        node.Key,
+			Dir:        node.Dir,
+			Value:      node.Value,
+			TTL:        node.TTL,
+			Expiration: node.Expiration,
+			index:      node.ModifiedIndex,
+		})
+	})
+	return d, nil
+}
+
+// Export writes a JSON dump of prefix to w.
+func (c *Client) Export(prefix string, w io.Writer) error {
+	return c.ExportFormat(prefix, w, "json")
+}
+
+// ExportFormat writes a dump of prefix to w as json or yaml.
+func (c *Client) ExportFormat(prefix string, w io.Writer, format string) error {
+	d, err := c.Snapshot(prefix)
+	if err != nil {
+		return err
+	}
+	return WriteDump(w, d, format)
+}
+
+// WriteDump encodes d as json or yaml.
+func WriteDump(w io.Writer, d *Dump, format string) error {
+	var b []byte
+	var err error
+	switch format {
+	case "json":
+		b, err = json.MarshalIndent(d, "", "  ")
+		b = append(b, '\n')
+	case "yaml":
+		b, err = yaml.Marshal(d)
+	default:
+		return fmt.Errorf("unsupported dump format: %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,119 @@
+package etcd
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dumpKeys returns the keys of d in order, directories with a trailing
+// slash.
+func dumpKeys(d *Dump) []string {
+	var keys []string
+	for _, node := range d.Nodes {
+		key := node.Key
+		if node.Dir {
+			key += "/"
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newTestClient(t)
+	c.Set("/src/x", "1", 0, "", 0)
+	c.Set("/src/d/y", "2", 100, "", 0)
+	c.MKDir("/src/e", 0)
+	c.Set("/other", "o", 0, "", 0)
+
+	d, err := c.Snapshot("/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version != DumpVersion || d.Prefix != "/src" || d.ClusterIndex == 0 || d.CreatedAt.IsZero() {
+		t.Errorf("dump header %+v", d)
+	}
+	// parents before their children
+	want := []string{"/src/", "/src/d/", "/src/d/y", "/src/e/", "/src/x"}
+	if keys := dumpKeys(d); !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys %v, want %v", keys, want)
+	}
+	for _, node := range d.Nodes {
+		if node.Key == "/src/d/y" && (node.TTL <= 0 || node.Expiration == nil) {
+			t.Errorf("ttl not dumped: %+v", node)
+		}
+	}
+
+	// the prefix is stored like the keys, so they can be re-rooted
+	for _, prefix := range []string{"src", "/src/", " src/./"} {
+		d, err := c.Snapshot(prefix)
+		if err != nil || d.Prefix != "/src" {
+			t.Errorf("%q: prefix %q: %v", prefix, d.Prefix, err)
+			continue
+		}
+		dst := newTestClient(t)
+		if _, err := dst.ImportDump(d, ImportOptions{Prefix: "copy/"}); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := dst.Get("/copy/d/y"); v != "2" {
+			t.Errorf("%q: imported as %v", prefix, dumpKeys(mustSnapshot(t, dst, "/")))
+		}
+	}
+
+	if _, err := c.Snapshot("/missing"); !IsEtcdNotFound(err) {
+		t.Errorf("snapshot of a missing prefix: %v", err)
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	c := newTestClient(t)
+	c.Set("/src/x", "1", 0, "", 0)
+	c.Set("/src/d/y", "multi\nline", 0, "", 0)
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := c.ExportFormat("/src", &buf, format); err != nil {
+				t.Fatal(err)
+			}
+			d, err := ReadDump(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshot, _ := c.Snapshot("/src")
+			if !reflect.DeepEqual(dumpKeys(d), dumpKeys(snapshot)) || d.ClusterIndex != snapshot.ClusterIndex {
+				t.Errorf("read back %+v", d)
+			}
+			for _, node := range d.Nodes {
+				if node.Key == "/src/d/y" && node.Value != "multi\nline" {
+					t.Errorf("value %q", node.Value)
+				}
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := c.ExportFormat("/src", &buf, "xml"); err == nil {
+		t.Error("xml export")
+	}
+}
+
+func TestReadDumpVersion(t *testing.T) {
+	for _, tt := range []struct {
+		dump string
+		ok   bool
+	}{
+		{`{"version": 1, "prefix": "/a", "nodes": []}`, true},
+		{"version: 1\nprefix: /a\n", true},
+		{`{"version": 0}`, false},
+		{`{"version": 2}`, false},
+		{`{"version": "x"}`, false},
+	} {
+		_, err := ReadDump(strings.NewReader(tt.dump))
+		if (err == nil) != tt.ok {
+			t.Errorf("ReadDump(%s): %v", tt.dump, err)
+		}
+	}
+}
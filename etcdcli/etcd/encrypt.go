@@ -0,0 +1,366 @@
+package etcd
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// encryptedPrefix starts every encrypted value, followed by the algorithm,
+// the key ID and the base64 payload, separated by colons:
+//
+//	enc:v1:aes-gcm:2024-01:<base64>
+//
+// The payload is an envelope: a random data key sealed with the key named
+// by the ID, then the value sealed with the data key, each with its nonce.
+const encryptedPrefix = "enc:v1:"
+
+const encryptionAlgorithm = "aes-gcm"
+
+// EncryptionKey is a key encryption key, 16, 24 or 32 bytes for AES-128,
+// AES-192 or AES-256. The ID is stored with every value it encrypts and must
+// not contain a colon.
+type EncryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// Encryption encrypts the values under Prefixes. Prefixes are cluster keys,
+// a namespace view does not change them.
+//
+// Keys[0] encrypts new values, every key decrypts; to rotate, put the new
+// key first, keep the old ones until Reencrypt has run over the prefixes.
+// Values without the encryption header are returned as they are, which
+// lets existing plaintext be read until Reencrypt encrypts it.
+//
+// Compare-and-swap by previous value still works, the client reads and
+// decrypts the current value and swaps by index instead. Clients without
+// the keys, etcdctl export for one, see the ciphertext; Snapshot and Export
+// dump it whether the client has the keys or not.
+type Encryption struct {
+	Prefixes []string
+	Keys     []EncryptionKey
+}
+
+// ErrUnknownEncryptionKey is returned for a value encrypted with a key the
+// client does not have.
+var ErrUnknownEncryptionKey = errors.New("etcd: value encrypted with an unknown key")
+
+type encryptedBackend struct {
+	next     Backend
+	prefixes []string
+	primary  string
+	keys     map[string]cipher.AEAD
+}
+
+func newEncryptedBackend(next Backend, enc Encryption) (*encryptedBackend, error) {
+	if len(enc.Keys) == 0 {
+		return nil, errors.New("encryption: no keys")
+	}
+	b := &encryptedBackend{next: next, primary: enc.Keys[0].ID, keys: make(map[string]cipher.AEAD)}
+	for _, key := range enc.Keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") {
+			return nil, fmt.Errorf("encryption: invalid key id %q", key.ID)
+		}
+		if _, ok := b.keys[key.ID]; ok {
+			return nil, fmt.Errorf("encryption: duplicate key id %q", key.ID)
+		}
+		aead, err := newAEAD(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %s: %v", key.ID, err)
+		}
+		b.keys[key.ID] = aead
+	}
+	for _, prefix := range enc.Prefixes {
+		b.prefixes = append(b.prefixes, etcdpath.Clean(prefix))
+	}
+	return b, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (b *encryptedBackend) Unwrap() Backend {
+	return b.next
+}
+
+func (b *encryptedBackend) covers(key string) bool {
+	for _, prefix := range b.prefixes {
+		if etcdpath.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (b *encryptedBackend) encrypt(value string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(b.keys[b.primary], dataKey)
+	if err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(data, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	payload := base64.StdEncoding.EncodeToString(append(wrapped, sealed...))
+	return encryptedPrefix + encryptionAlgorithm + ":" + b.primary + ":" + payload, nil
+}
+
+// keyID returns the ID of the key value is encrypted with, "" for a value
+// that is not encrypted.
+func keyID(value string) string {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return ""
+	}
+	parts := strings.SplitN(value[len(encryptedPrefix):], ":", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+func (b *encryptedBackend) decrypt(key, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.SplitN(value[len(encryptedPrefix):], ":", 3)
+	if len(parts) != 3 || parts[0] != encryptionAlgorithm {
+		return "", fmt.Errorf("encryption: %s: unsupported header", key)
+	}
+	kek, ok := b.keys[parts[1]]
+	if !ok {
+		return "", fmt.Errorf("%v: %s: key id %q", ErrUnknownEncryptionKey, key, parts[1])
+	}
+	payload, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("encryption: %s: %v", key, err)
+	}
+
+	wrappedSize := kek.NonceSize() + 32 + kek.Overhead()
+	if len(payload) < wrappedSize {
+		return "", fmt.Errorf("encryption: %s: payload too short", key)
+	}
+	wrapped, sealed := payload[:wrappedSize], payload[wrappedSize:]
+	n := kek.NonceSize()
+	dataKey, err := kek.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("encryption: %s: %v", key, err)
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < data.NonceSize() {
+		return "", fmt.Errorf("encryption: %s: payload too short", key)
+	}
+	plaintext, err := data.Open(nil, sealed[:data.NonceSize()], sealed[data.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("encryption: %s: %v", key, err)
+	}
+	return string(plaintext), nil
+}
+
+// decryptNode decrypts node and its children in place.
+func (b *encryptedBackend) decryptNode(node *etcdv2.Node) error {
+	var err error
+	walkNodes(node, func(n *etcdv2.Node) {
+		if err != nil || n.Dir {
+			return
+		}
+		n.Value, err = b.decrypt(n.Key, n.Value)
+	})
+	return err
+}
+
+func (b *encryptedBackend) response(resp *etcdv2.Response, err error) (*etcdv2.Response, error) {
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	if err := b.decryptNode(resp.Node); err != nil {
+		return nil, err
+	}
+	if err := b.decryptNode(resp.PrevNode); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (b *encryptedBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	if storedValues(ctx) {
+		return b.next.Get(ctx, key, opts)
+	}
+	return b.response(b.next.Get(ctx, key, opts))
+}
+
+func (b *encryptedBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	if storedValues(ctx) && strings.HasPrefix(value, encryptedPrefix) {
+		return b.next.Set(ctx, key, value, opts)
+	}
+	if !b.covers(key) || opts != nil && (opts.Dir || opts.Refresh) {
+		return b.response(b.next.Set(ctx, key, value, opts))
+	}
+	if opts != nil && opts.PrevValue != "" {
+		index, err := compareByIndex(ctx, b.next, key, opts.PrevValue, opts.PrevIndex, b.decrypt)
+		if err != nil {
+			return nil, err
+		}
+		o := *opts
+		o.PrevValue, o.PrevIndex = "", index
+		opts = &o
+	}
+	encrypted, err := b.encrypt(value)
+	if err != nil {
+		return nil, err
+	}
+	return b.response(b.next.Set(ctx, key, encrypted, opts))
+}
+
+func (b *encryptedBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	if b.covers(key) && opts != nil && opts.PrevValue != "" {
+		index, err := compareByIndex(ctx, b.next, key, opts.PrevValue, opts.PrevIndex, b.decrypt)
+		if err != nil {
+			return nil, err
+		}
+		o := *opts
+		o.PrevValue, o.PrevIndex = "", index
+		opts = &o
+	}
+	return b.response(b.next.Delete(ctx, key, opts))
+}
+
+func (b *encryptedBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	if b.covers(dir) {
+		encrypted, err := b.encrypt(value)
+		if err != nil {
+			return nil, err
+		}
+		value = encrypted
+	}
+	return b.response(b.next.CreateInOrder(ctx, dir, value, opts))
+}
+
+func (b *encryptedBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	next := b.next.Watcher(key, opts)
+	return WatcherFunc(func(ctx context.Context) (*etcdv2.Response, error) {
+		return b.response(next.Next(ctx))
+	})
+}
+
+// Reencrypt encrypts every value under prefix with the first key of
+// Config.Encryption, values encrypted with an older key and plaintext ones
+// alike, and returns how many it rewrote. Each value is swapped by index, a
+// value changed meanwhile is left to the writer, who encrypts it with the
+// current key anyway. The reads and writes go through the whole client,
+// Limits, Metrics and Interceptors included.
+//
+// On a WithNamespace view prefix is in the namespace like any other key.
+func (c *Client) Reencrypt(prefix string) (int, error) {
+	isEncrypted := func(b Backend) bool { _, ok := b.(*encryptedBackend); return ok }
+	b, ok := findBackend(c.backend, isEncrypted).(*encryptedBackend)
+	if !ok {
+		return 0, errors.New("client has no encryption configured")
+	}
+	// b is below the namespaces of the view, scope keys the way they do to
+	// know which ones it covers
+	clusterKey := func(key string) (string, error) {
+		for l := c.backend; l != Backend(b); l = l.(unwrapper).Unwrap() {
+			if ns, ok := l.(*namespacedBackend); ok {
+				var err error
+				if key, err = ns.key(key); err != nil {
+					return "", err
+				}
+			}
+		}
+		return key, nil
+	}
+
+	// read and write the values as stored, they are encrypted here
+	ctx, cancel := c.newContextWithTimeout()
+	resp, err := c.backend.Get(withStoredValues(ctx), prefix, &etcdv2.GetOptions{Recursive: true, Quorum: true})
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	var nodes []*etcdv2.Node
+	var walkErr error
+	walkNodes(resp.Node, func(node *etcdv2.Node) {
+		if walkErr != nil || node.Dir || keyID(node.Value) == b.primary {
+			return
+		}
+		key, err := clusterKey(node.Key)
+		if err != nil {
+			walkErr = err
+			return
+		}
+		if b.covers(key) {
+			nodes = append(nodes, node)
+		}
+	})
+	if walkErr != nil {
+		return 0, walkErr
+	}
+
+	count := 0
+	for _, node := range nodes {
+		value, err := b.decrypt(node.Key, node.Value)
+		if err != nil {
+			return count, err
+		}
+		encrypted, err := b.encrypt(value)
+		if err != nil {
+			return count, err
+		}
+		opts := &etcdv2.SetOptions{PrevIndex: node.ModifiedIndex}
+		if node.Expiration != nil {
+			left := time.Until(*node.Expiration)
+			if left <= 0 {
+				continue
+			}
+			opts.TTL = (left + time.Second - 1) / time.Second * time.Second
+		}
+		ctx, cancel := c.newContextWithTimeout()
+		_, err = c.backend.Set(withStoredValues(ctx), node.Key, encrypted, opts)
+		cancel()
+		switch {
+		case err == nil:
+			count++
+		case IsEtcdTestFailed(err), IsEtcdNotFound(err):
+			// rewritten or removed meanwhile
+		default:
+			return count, err
+		}
+	}
+	return count, nil
+}
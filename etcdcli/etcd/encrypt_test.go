@@ -0,0 +1,217 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+var (
+	testKey1 = EncryptionKey{ID: "k1", Key: bytes.Repeat([]byte{1}, 32)}
+	testKey2 = EncryptionKey{ID: "k2", Key: bytes.Repeat([]byte{2}, 16)}
+)
+
+// newEncryptedClient returns a client encrypting under prefixes with keys
+// and a plain one on the same store.
+func newEncryptedClient(t *testing.T, prefixes []string, keys ...EncryptionKey) (*Client, *Client) {
+	raw, err := NewClientWithConfig(Config{Backend: NewMemoryBackend()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClientWithConfig(Config{Backend: raw.Backend(), Encryption: &Encryption{Prefixes: prefixes, Keys: keys}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, raw
+}
+
+func TestEncryption(t *testing.T) {
+	c, raw := newEncryptedClient(t, []string{"/secret"}, testKey1)
+
+	c.Set("/secret/pw", "hunter2", 0, "", 0)
+	c.Set("/public", "x", 0, "", 0)
+	if v, _ := raw.Get("/secret/pw"); !strings.HasPrefix(v, "enc:v1:aes-gcm:k1:") || strings.Contains(v, "hunter2") {
+		t.Errorf("stored %q", v)
+	}
+	if v, _ := c.Get("/secret/pw"); v != "hunter2" {
+		t.Errorf("read %q", v)
+	}
+	if v, _ := raw.Get("/public"); v != "x" {
+		t.Errorf("outside the prefixes %q", v)
+	}
+
+	// compare by the plaintext
+	if err := c.Set("/secret/pw", "new", 0, "wrong", 0); !IsEtcdTestFailed(err) {
+		t.Errorf("swap from a wrong value: %v", err)
+	}
+	if err := c.Set("/secret/pw", "new", 0, "hunter2", 0); err != nil {
+		t.Errorf("swap: %v", err)
+	}
+
+	// plaintext written before encryption is read as it is
+	raw.Set("/secret/old", "plain", 0, "", 0)
+	if v, _ := c.Get("/secret/old"); v != "plain" {
+		t.Errorf("plaintext read %q", v)
+	}
+
+	other, _ := NewClientWithConfig(Config{Backend: raw.Backend(), Encryption: &Encryption{Prefixes: []string{"/secret"}, Keys: []EncryptionKey{testKey2}}})
+	if _, err := other.Get("/secret/pw"); err == nil {
+		t.Error("read a value encrypted with a key the client does not have")
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	c, raw := newEncryptedClient(t, []string{"/secret"}, testKey1)
+	raw.Set("/secret/plain", "p", 0, "", 0)
+	c.Set("/secret/a", "a", 60, "", 0)
+
+	rotated, _ := NewClientWithConfig(Config{Backend: raw.Backend(), Encryption: &Encryption{Prefixes: []string{"/secret"}, Keys: []EncryptionKey{testKey2, testKey1}}})
+	if v, _ := rotated.Get("/secret/a"); v != "a" {
+		t.Fatalf("read with the old key %q", v)
+	}
+	n, err := rotated.Reencrypt("/secret")
+	if err != nil || n != 2 {
+		t.Fatalf("reencrypted %d: %v", n, err)
+	}
+	for key, value := range map[string]string{"/secret/plain": "p", "/secret/a": "a"} {
+		if v, _ := raw.Get(key); !strings.Contains(v, ":k2:") {
+			t.Errorf("%s stored %q", key, v)
+		}
+		if v, _ := rotated.Get(key); v != value {
+			t.Errorf("%s read %q", key, v)
+		}
+	}
+	if ttl, _, _ := rotated.TTL("/secret/a"); ttl <= 0 {
+		t.Errorf("ttl lost: %d", ttl)
+	}
+	if n, _ := rotated.Reencrypt("/secret"); n != 0 {
+		t.Errorf("second run rewrote %d", n)
+	}
+}
+
+func TestReencryptNamespace(t *testing.T) {
+	c, raw := newEncryptedClient(t, []string{"/tenant/secret"}, testKey1)
+	raw.Set("/tenant/secret/a", "a", 0, "", 0)
+	raw.Set("/secret/b", "b", 0, "", 0)
+
+	n, err := c.WithNamespace("/tenant").Reencrypt("/secret")
+	if err != nil || n != 1 {
+		t.Fatalf("reencrypted %d: %v", n, err)
+	}
+	if v, _ := raw.Get("/tenant/secret/a"); !strings.HasPrefix(v, "enc:v1:") {
+		t.Errorf("namespaced key stored %q", v)
+	}
+	if v, _ := raw.Get("/secret/b"); v != "b" {
+		t.Errorf("key outside the namespace stored %q", v)
+	}
+	if _, err := c.WithNamespace("/tenant").Reencrypt("/../secret"); err != ErrOutsideNamespace {
+		t.Errorf("prefix outside the namespace: %v", err)
+	}
+}
+
+func TestEncryptedDump(t *testing.T) {
+	for _, compression := range []*Compression{nil, {Threshold: 100}} {
+		newClient := func() (*Client, *Client) {
+			raw := newTestClient(t)
+			c, err := NewClientWithConfig(Config{
+				Backend:     raw.Backend(),
+				Compression: compression,
+				Encryption:  &Encryption{Prefixes: []string{"/secret"}, Keys: []EncryptionKey{testKey1}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c, raw
+		}
+		c, _ := newClient()
+		large := strings.Repeat("large ", 100)
+		c.Set("/secret/pw", "hunter2", 0, "", 0)
+		c.Set("/secret/large", large, 0, "", 0)
+		c.Set("/public", large, 0, "", 0)
+
+		var buf bytes.Buffer
+		if err := c.Export("/", &buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), "hunter2") || strings.Contains(buf.String(), "large large") != (compression == nil) {
+			t.Fatalf("compression %v: plaintext in the dump:\n%s", compression, buf.String())
+		}
+		d, err := ReadDump(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the dump goes back as it is, under its prefix or elsewhere
+		restored, raw := newClient()
+		if _, err := restored.ImportDump(d, ImportOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := restored.ImportDump(d, ImportOptions{Prefix: "/copy"}); err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range map[string]string{
+			"/secret/pw": "hunter2", "/secret/large": large, "/public": large,
+			"/copy/secret/pw": "hunter2", "/copy/secret/large": large,
+		} {
+			if v, err := restored.Get(key); v != value || err != nil {
+				t.Errorf("compression %v: %s read %.20q: %v", compression, key, v, err)
+			}
+		}
+		if stored, _ := raw.Get("/secret/pw"); stored != d.Nodes[len(d.Nodes)-1].Value {
+			t.Errorf("compression %v: imported %q, dumped %q", compression, stored, d.Nodes[len(d.Nodes)-1].Value)
+		}
+
+		// a plaintext dump is encrypted on the way in
+		plain := &Dump{Version: DumpVersion, Prefix: "/", Nodes: []DumpNode{{Key: "/secret/new", Value: "s3cret"}}}
+		restored.ImportDump(plain, ImportOptions{})
+		if stored, _ := raw.Get("/secret/new"); !strings.HasPrefix(stored, encryptedPrefix) {
+			t.Errorf("compression %v: plaintext import stored %q", compression, stored)
+		}
+	}
+}
+
+func TestReencryptThroughClient(t *testing.T) {
+	var sets []string
+	record := func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+		if call.Op == "set" {
+			sets = append(sets, call.Key)
+		}
+		return next(ctx, call)
+	}
+	raw := newTestClient(t)
+	raw.Set("/secret/a", "a", 0, "", 0)
+	raw.Set("/secret/b", "b", 0, "", 0)
+	raw.Set("/public", "p", 0, "", 0)
+	m := NewMetrics()
+	c, err := NewClientWithConfig(Config{
+		Backend:      raw.Backend(),
+		Encryption:   &Encryption{Prefixes: []string{"/secret"}, Keys: []EncryptionKey{testKey1}},
+		Interceptors: []Interceptor{record},
+		Metrics:      m,
+		Limits:       &Limits{Writes: Rate{PerSecond: 0.001}, FailFast: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the write limit lets one rewrite through
+	n, err := c.Reencrypt("/")
+	if n != 1 || err != ErrThrottled {
+		t.Errorf("reencrypted %d: %v", n, err)
+	}
+	if strings.Join(sets, ",") != "/secret/a" {
+		t.Errorf("intercepted sets %v", sets)
+	}
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	if !strings.Contains(buf.String(), `etcdcli_requests_total{op="cas",code="ok"} 1`+"\n") {
+		t.Errorf("rewrites not counted:\n%s", buf.String())
+	}
+	if v, _ := c.Get("/secret/a"); v != "a" {
+		t.Errorf("read %q", v)
+	}
+}
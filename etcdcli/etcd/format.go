@@ -0,0 +1,259 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	etcdv2 "github.com/coreos/etcd/client"
+	"gopkg.in/yaml.v2"
+)
+
+// Formatter renders a response. Register new ones with RegisterFormat and
+// select them by name in Config.Format, PrintResponse or the etcdctl -o flag.
+type Formatter interface {
+	Format(w io.Writer, resp *etcdv2.Response) error
+}
+
+// FormatterFunc adapts a plain function to Formatter.
+type FormatterFunc func(w io.Writer, resp *etcdv2.Response) error
+
+func (f FormatterFunc) Format(w io.Writer, resp *etcdv2.Response) error {
+	return f(w, resp)
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]Formatter{}
+)
+
+func init() {
+	RegisterFormat("simple", FormatterFunc(formatSimple))
+	RegisterFormat("extended", FormatterFunc(formatExtended))
+	RegisterFormat("json", FormatterFunc(formatJSON))
+	RegisterFormat("tree", FormatterFunc(formatTree))
+	RegisterFormat("table", FormatterFunc(formatTable))
+	RegisterFormat("yaml", FormatterFunc(formatYAML))
+	RegisterFormat("env", FormatterFunc(formatEnv))
+}
+
+// RegisterFormat makes f available under name, replacing any formatter
+// previously registered with that name.
+func RegisterFormat(name string, f Formatter) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[name] = f
+}
+
+// Formats returns the registered format names, sorted.
+func Formats() []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PrintResponse writes resp to w using the formatter registered as format.
+func PrintResponse(w io.Writer, resp *etcdv2.Response, format string) error {
+	formatsMu.RLock()
+	f, ok := formats[format]
+	formatsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unsupported output format: %s", format)
+	}
+	return f.Format(w, resp)
+}
+
+func formatSimple(w io.Writer, resp *etcdv2.Response) error {
+	switch {
+	case resp.Action != "delete" && resp.Node.Dir:
+		// Like etcdctl ls: one key per line
+		for _, key := range nodesToStringSlice(resp.Node.Nodes) {
+			fmt.Fprintln(w, key)
+		}
+	case resp.Action != "delete":
+		fmt.Fprintln(w, resp.Node.Value)
+	case resp.PrevNode != nil:
+		fmt.Fprintln(w, "PrevNode.Value:", resp.PrevNode.Value)
+	}
+	return nil
+}
+
+// formatExtended prints in a rfc2822 style format
+func formatExtended(w io.Writer, resp *etcdv2.Response) error {
+	fmt.Fprintln(w, "Key:", resp.Node.Key)
+	fmt.Fprintln(w, "Created-Index:", resp.Node.CreatedIndex)
+	fmt.Fprintln(w, "Modified-Index:", resp.Node.ModifiedIndex)
+
+	if resp.PrevNode != nil {
+		fmt.Fprintln(w, "PrevNode.Value:", resp.PrevNode.Value)
+	}
+
+	fmt.Fprintln(w, "TTL:", resp.Node.TTL)
+	fmt.Fprintln(w, "Index:", resp.Index)
+	if resp.Action != "delete" {
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, resp.Node.Value)
+	}
+	return nil
+}
+
+func formatJSON(w io.Writer, resp *etcdv2.Response) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// formatTree draws the node and its children as an ASCII tree:
+//
+//	/foo/
+//	├── bar = 1
+//	└── dir/
+//	    └── baz = 2
+func formatTree(w io.Writer, resp *etcdv2.Response) error {
+	node := resp.Node
+	if node.Dir {
+		fmt.Fprintln(w, node.Key+"/")
+	} else {
+		fmt.Fprintf(w, "%s = %s\n", node.Key, node.Value)
+	}
+	writeTree(w, node.Nodes, "")
+	return nil
+}
+
+func writeTree(w io.Writer, nodes etcdv2.Nodes, indent string) {
+	for i, node := range nodes {
+		branch, next := "├── ", "│   "
+		if i == len(nodes)-1 {
+			branch, next = "└── ", "    "
+		}
+
+		name := path.Base(node.Key)
+		if node.Dir {
+			fmt.Fprintf(w, "%s%s%s/\n", indent, branch, name)
+			writeTree(w, node.Nodes, indent+next)
+		} else {
+			fmt.Fprintf(w, "%s%s%s = %s\n", indent, branch, name, node.Value)
+		}
+	}
+}
+
+// formatTable prints one row per node with its value, TTL and indexes.
+func formatTable(w io.Writer, resp *etcdv2.Response) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tTTL\tCREATED\tMODIFIED")
+	walkNodes(resp.Node, func(node *etcdv2.Node) {
+		key, value := node.Key, node.Value
+		if node.Dir {
+			key, value = key+"/", ""
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", key, value, node.TTL, node.CreatedIndex, node.ModifiedIndex)
+	})
+	return tw.Flush()
+}
+
+type yamlNode struct {
+	Key           string      `yaml:"key"`
+	Dir           bool        `yaml:"dir,omitempty"`
+	Value         string      `yaml:"value,omitempty"`
+	TTL           int64       `yaml:"ttl,omitempty"`
+	CreatedIndex  uint64      `yaml:"createdIndex"`
+	ModifiedIndex uint64      `yaml:"modifiedIndex"`
+	Nodes         []*yamlNode `yaml:"nodes,omitempty"`
+}
+
+type yamlResponse struct {
+	Action   string    `yaml:"action"`
+	Index    uint64    `yaml:"index"`
+	Node     *yamlNode `yaml:"node"`
+	PrevNode *yamlNode `yaml:"prevNode,omitempty"`
+}
+
+func toYAMLNode(node *etcdv2.Node) *yamlNode {
+	if node == nil {
+		return nil
+	}
+	y := &yamlNode{
+		Key:           node.Key,
+		Dir:           node.Dir,
+		Value:         node.Value,
+		TTL:           node.TTL,
+		CreatedIndex:  node.CreatedIndex,
+		ModifiedIndex: node.ModifiedIndex,
+	}
+	for _, child := range node.Nodes {
+		y.Nodes = append(y.Nodes, toYAMLNode(child))
+	}
+	return y
+}
+
+func formatYAML(w io.Writer, resp *etcdv2.Response) error {
+	b, err := yaml.Marshal(&yamlResponse{
+		Action:   resp.Action,
+		Index:    resp.Index,
+		Node:     toYAMLNode(resp.Node),
+		PrevNode: toYAMLNode(resp.PrevNode),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// formatEnv prints every value as a KEY=value line that a shell can source.
+// /app/db/host becomes APP_DB_HOST.
+func formatEnv(w io.Writer, resp *etcdv2.Response) error {
+	walkNodes(resp.Node, func(node *etcdv2.Node) {
+		if node.Dir {
+			return
+		}
+		fmt.Fprintf(w, "%s=%s\n", envName(node.Key), shellQuote(node.Value))
+	})
+	return nil
+}
+
+func envName(key string) string {
+	name := []byte(strings.ToUpper(strings.Trim(key, "/")))
+	for i, ch := range name {
+		if !(ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+	return string(name)
+}
+
+func shellQuote(value string) string {
+	if value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:@,+", r))
+	}) < 0 {
+		return value
+	}
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// walkNodes calls fn for node and all its descendants, depth first.
+func walkNodes(node *etcdv2.Node, fn func(node *etcdv2.Node)) {
+	if node == nil {
+		return
+	}
+	fn(node)
+	for _, child := range node.Nodes {
+		walkNodes(child, fn)
+	}
+}
@@ -0,0 +1,144 @@
+package etcd
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func formatResponse() *etcdv2.Response {
+	return &etcdv2.Response{
+		Action: "get",
+		Index:  9,
+		Node: &etcdv2.Node{Key: "/app", Dir: true, CreatedIndex: 2, ModifiedIndex: 2, Nodes: etcdv2.Nodes{
+			{Key: "/app/db", Dir: true, CreatedIndex: 3, ModifiedIndex: 3, Nodes: etcdv2.Nodes{
+				{Key: "/app/db/host", Value: "10.0.0.1", CreatedIndex: 3, ModifiedIndex: 5},
+				{Key: "/app/db/pass", Value: "it's a secret", TTL: 60, CreatedIndex: 4, ModifiedIndex: 4},
+			}},
+			{Key: "/app/name", Value: "demo", CreatedIndex: 6, ModifiedIndex: 6},
+		}},
+	}
+}
+
+func TestFormats(t *testing.T) {
+	for _, tt := range []struct {
+		format string
+		want   string
+	}{
+		{"tree", `/app/
+├── db/
+│   ├── host = 10.0.0.1
+│   └── pass = it's a secret
+└── name = demo
+`},
+		{"table", `KEY           VALUE          TTL  CREATED  MODIFIED
+/app/                        0    2        2
+/app/db/                     0    3        3
+/app/db/host  10.0.0.1       0    3        5
+/app/db/pass  it's a secret  60   4        4
+/app/name     demo           0    6        6
+`},
+		{"yaml", `action: get
+index: 9
+node:
+  key: /app
+  dir: true
+  createdIndex: 2
+  modifiedIndex: 2
+  nodes:
+  - key: /app/db
+    dir: true
+    createdIndex: 3
+    modifiedIndex: 3
+    nodes:
+    - key: /app/db/host
+      value: 10.0.0.1
+      createdIndex: 3
+      modifiedIndex: 5
+    - key: /app/db/pass
+      value: it's a secret
+      ttl: 60
+      createdIndex: 4
+      modifiedIndex: 4
+  - key: /app/name
+    value: demo
+    createdIndex: 6
+    modifiedIndex: 6
+`},
+		{"env", `APP_DB_HOST=10.0.0.1
+APP_DB_PASS='it'\''s a secret'
+APP_NAME=demo
+`},
+	} {
+		var buf bytes.Buffer
+		if err := PrintResponse(&buf, formatResponse(), tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.format, buf.String(), tt.want)
+		}
+	}
+
+	// a single key, and the previous node of a delete
+	resp := &etcdv2.Response{Action: "delete", Index: 3,
+		Node:     &etcdv2.Node{Key: "/k", CreatedIndex: 2, ModifiedIndex: 3},
+		PrevNode: &etcdv2.Node{Key: "/k", Value: "v", CreatedIndex: 2, ModifiedIndex: 2},
+	}
+	var buf bytes.Buffer
+	PrintResponse(&buf, resp, "tree")
+	PrintResponse(&buf, resp, "yaml")
+	if want := "/k = \naction: delete\nindex: 3\nnode:\n  key: /k\n  createdIndex: 2\n  modifiedIndex: 3\nprevNode:\n  key: /k\n  value: v\n  createdIndex: 2\n  modifiedIndex: 2\n"; buf.String() != want {
+		t.Errorf("delete:\n%s", buf.String())
+	}
+	if err := PrintResponse(&buf, resp, "xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for key, want := range map[string]string{
+		"/app/db/host":  "APP_DB_HOST",
+		"/app/db-1.url": "APP_DB_1_URL",
+		"/1st/key":      "_1ST_KEY",
+		"/a/é":          "A___",
+		"/":             "",
+		"top":           "TOP",
+	} {
+		if name := envName(key); name != want {
+			t.Errorf("%s: %q, want %q", key, name, want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	values := map[string]string{
+		"plain":             "plain",
+		"a-b_c./d:e@f,g+h":  "a-b_c./d:e@f,g+h",
+		"":                  "''",
+		"two words":         "'two words'",
+		"it's":              `'it'\''s'`,
+		"''":                `''\'''\'''`,
+		`say "hi"`:          `'say "hi"'`,
+		"line1\nline2":      "'line1\nline2'",
+		"$HOME `id` \\ * ;": "'$HOME `id` \\ * ;'",
+	}
+	for value, want := range values {
+		if quoted := shellQuote(value); quoted != want {
+			t.Errorf("%q: %s, want %s", value, quoted, want)
+		}
+	}
+
+	// the shell reads every value back unchanged
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	for value := range values {
+		out, err := exec.Command(sh, "-c", "V="+shellQuote(value)+`; printf %s "$V"`).Output()
+		if err != nil || string(out) != value {
+			t.Errorf("%q read back as %q: %v", value, out, err)
+		}
+	}
+}
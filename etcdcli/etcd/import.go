@@ -0,0 +1,372 @@
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+	"gopkg.in/yaml.v2"
+)
+
+// ImportMode decides what happens to keys that already exist at the target.
+type ImportMode int
+
+const (
+	// ImportSkipExisting leaves existing keys untouched.
+	ImportSkipExisting ImportMode = iota
+	// ImportOverwrite replaces existing keys with the dumped values.
+	ImportOverwrite
+	// ImportMirror is ImportOverwrite plus deleting every key under the
+	// target prefix that is not in the dump.
+	ImportMirror
+)
+
+func (m ImportMode) String() string {
+	switch m {
+	case ImportSkipExisting:
+		return "skip-existing"
+	case ImportOverwrite:
+		return "overwrite"
+	case ImportMirror:
+		return "mirror"
+	}
+	return fmt.Sprintf("ImportMode(%d)", int(m))
+}
+
+// ParseImportMode is the inverse of ImportMode.String.
+func ParseImportMode(s string) (ImportMode, error) {
+	for _, m := range []ImportMode{ImportSkipExisting, ImportOverwrite, ImportMirror} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown import mode: %s", s)
+}
+
+type ImportOptions struct {
+	Mode ImportMode
+	// Prefix re-roots the dump: keys under Dump.Prefix are written under
+	// Prefix instead. Empty keeps the original keys.
+	Prefix string
+	// PreserveTTL writes keys with the TTL they had left at export time.
+	// Keys that have expired since are not imported.
+	PreserveTTL bool
+	// Parallel is the number of concurrent value writes, at least 1.
+	Parallel int
+	// DryRun only prints the plan to Out, stdout by default.
+	DryRun bool
+	Out    io.Writer
+}
+
+// ImportStats counts what an import did, or would do in a dry run.
+type ImportStats struct {
+	Created int
+	Updated int
+	Deleted int
+	Skipped int
+}
+
+type importOp int
+
+const (
+	opCreate importOp = iota
+	opUpdate
+	opDelete
+	opSkip
+)
+
+type importStep struct {
+	op   importOp
+	node DumpNode
+	// replace is set when an existing node of the other kind (file vs dir)
+	// must be removed first
+	replace bool
+}
+
+// ReadDump decodes a dump written by WriteDump, json or yaml.
+func ReadDump(r io.Reader) (*Dump, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dump{}
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(b, d)
+	} else {
+		err = yaml.Unmarshal(b, d)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode dump: %v", err)
+	}
+	if d.Version < 1 || d.Version > DumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d", d.Version)
+	}
+	return d, nil
+}
+
+// Import restores a dump read from r under prefix (empty keeps the dump's
+// own prefix), preserving TTLs.
+func (c *Client) Import(r io.Reader, prefix string, mode ImportMode) error {
+	_, err := c.ImportWithOptions(r, ImportOptions{Mode: mode, Prefix: prefix, PreserveTTL: true})
+	return err
+}
+
+func (c *Client) ImportWithOptions(r io.Reader, opts ImportOptions) (*ImportStats, error) {
+	d, err := ReadDump(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.ImportDump(d, opts)
+}
+
+// ImportDump is ImportWithOptions for an already decoded dump.
+func (c *Client) ImportDump(d *Dump, opts ImportOptions) (*ImportStats, error) {
+	if opts.Parallel < 1 {
+		opts.Parallel = 1
+	}
+	target := d.Prefix
+	if opts.Prefix != "" {
+		target = opts.Prefix
+	}
+
+	nodes := make([]DumpNode, 0, len(d.Nodes))
+	now := time.Now()
+	for _, node := range d.Nodes {
+		if isRoot(node.Key) {
+			continue
+		}
+		node.Key = rerootKey(node.Key, d.Prefix, opts.Prefix)
+		node.TTL = remainingTTL(node, now, opts.PreserveTTL)
+		if node.TTL < 0 {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	existing, err := c.Snapshot(target)
+	if err != nil && !IsEtcdNotFound(err) {
+		return nil, err
+	}
+	var current []DumpNode
+	if existing != nil {
+		for _, node := range existing.Nodes {
+			if !isRoot(node.Key) {
+				current = append(current, node)
+			}
+		}
+	}
+
+	steps := planImport(nodes, current, opts.Mode)
+	stats := &ImportStats{}
+	for _, step := range steps {
+		switch step.op {
+		case opCreate:
+			stats.Created++
+		case opUpdate:
+			stats.Updated++
+		case opDelete:
+			stats.Deleted++
+		case opSkip:
+			stats.Skipped++
+		}
+	}
+
+	if opts.DryRun {
+		out := opts.Out
+		if out == nil {
+			out = os.Stdout
+		}
+		printImportPlan(out, steps)
+		return stats, nil
+	}
+	return stats, c.applyImport(steps, opts.Parallel)
+}
+
+// remainingTTL returns the TTL to write: 0 for none, -1 when the key has
+// expired since the export.
+func remainingTTL(node DumpNode, now time.Time, preserve bool) int64 {
+	if !preserve || node.TTL == 0 {
+		return 0
+	}
+	if node.Expiration == nil {
+		return node.TTL
+	}
+	left := node.Expiration.Sub(now)
+	if left <= 0 {
+		return -1
+	}
+	return int64((left + time.Second - 1) / time.Second)
+}
+
+func planImport(nodes []DumpNode, current []DumpNode, mode ImportMode) []importStep {
+	have := make(map[string]DumpNode, len(current))
+	for _, node := range current {
+		have[node.Key] = node
+	}
+
+	var steps []importStep
+	want := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		want[node.Key] = true
+		old, ok := have[node.Key]
+		switch {
+		case !ok:
+			steps = append(steps, importStep{op: opCreate, node: node})
+		case mode == ImportSkipExisting:
+			steps = append(steps, importStep{op: opSkip, node: node})
+		case old.Dir != node.Dir:
+			steps = append(steps, importStep{op: opUpdate, node: node, replace: true})
+		case node.Dir || old.Value == node.Value && node.TTL == 0 && old.TTL == 0:
+			steps = append(steps, importStep{op: opSkip, node: node})
+		default:
+			steps = append(steps, importStep{op: opUpdate, node: node})
+		}
+	}
+
+	if mode == ImportMirror {
+		var deleted []string
+	Current:
+		for _, node := range current {
+			if want[node.Key] {
+				continue
+			}
+			for _, dir := range deleted {
+				if strings.HasPrefix(node.Key, dir+"/") {
+					continue Current
+				}
+			}
+			if node.Dir {
+				deleted = append(deleted, node.Key)
+			}
+			steps = append(steps, importStep{op: opDelete, node: node})
+		}
+	}
+	return steps
+}
+
+func printImportPlan(w io.Writer, steps []importStep) {
+	for _, step := range steps {
+		key := step.node.Key
+		if step.node.Dir {
+			key += "/"
+		}
+		switch step.op {
+		case opCreate:
+			fmt.Fprintf(w, "+ %s\n", key)
+		case opUpdate:
+			fmt.Fprintf(w, "~ %s\n", key)
+		case opDelete:
+			fmt.Fprintf(w, "- %s\n", key)
+		case opSkip:
+			fmt.Fprintf(w, "= %s\n", key)
+		}
+	}
+}
+
+// applyImport runs deletes and directory creation in order, then writes the
+// values with parallel workers.
+func (c *Client) applyImport(steps []importStep, parallel int) error {
+	var values []importStep
+	for _, step := range steps {
+		switch {
+		case step.op == opSkip:
+		case step.op == opDelete:
+			if err := c.importDelete(step.node); err != nil && !IsEtcdNotFound(err) {
+				return err
+			}
+		case step.node.Dir:
+			if err := c.importWrite(step); err != nil {
+				return err
+			}
+		default:
+			values = append(values, step)
+		}
+	}
+
+	work := make(chan importStep)
+	errc := make(chan error, parallel)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for step := range work {
+				if err := c.importWrite(step); err != nil {
+					errc <- fmt.Errorf("import %s: %v", step.node.Key, err)
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+Feed:
+	for _, step := range values {
+		select {
+		case work <- step:
+		case err = <-errc:
+			break Feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errc:
+		default:
+		}
+	}
+	return err
+}
+
+func (c *Client) importDelete(node DumpNode) error {
+	ctx, cancel := c.newContextWithTimeout()
+	defer cancel()
+	_, err := c.backend.Delete(ctx, node.Key, &etcdv2.DeleteOptions{Dir: node.Dir, Recursive: node.Dir})
+	return err
+}
+
+func (c *Client) importWrite(step importStep) error {
+	if step.replace {
+		if err := c.importDelete(DumpNode{Key: step.node.Key, Dir: !step.node.Dir}); err != nil && !IsEtcdNotFound(err) {
+			return err
+		}
+	}
+
+	ctx, cancel := c.newContextWithTimeout()
+	defer cancel()
+	// encrypted and compressed values of a dump are written as they are
+	ctx = withStoredValues(ctx)
+	opts := &etcdv2.SetOptions{TTL: time.Duration(step.node.TTL) * time.Second, Dir: step.node.Dir}
+	if step.node.Dir {
+		opts.PrevExist = etcdv2.PrevNoExist
+	}
+	_, err := c.backend.Set(ctx, step.node.Key, step.node.Value, opts)
+	if step.node.Dir && IsEtcdNodeExist(err) {
+		// created implicitly by an earlier key
+		return nil
+	}
+	return err
+}
+
+// rerootKey moves key from under prefix from to under prefix to.
+func rerootKey(key string, from string, to string) string {
+	if to == "" || !etcdpath.HasPrefix(key, from) {
+		return key
+	}
+	rel := strings.TrimPrefix(etcdpath.Clean(key), strings.TrimSuffix(etcdpath.Clean(from), "/"))
+	return etcdpath.Join(to, rel)
+}
+
+func isRoot(key string) bool {
+	return key == "" || key == "/"
+}
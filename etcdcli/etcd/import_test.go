@@ -0,0 +1,181 @@
+package etcd
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newImportSource returns a client with a dump of /src taken from it.
+func newImportSource(t *testing.T) (*Client, *Dump) {
+	c := newTestClient(t)
+	c.Set("/src/x", "1", 0, "", 0)
+	c.Set("/src/d/y", "2", 0, "", 0)
+	c.MKDir("/src/e", 0)
+	d, err := c.Snapshot("/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, d
+}
+
+func TestImportModes(t *testing.T) {
+	tests := []struct {
+		mode  ImportMode
+		stats ImportStats
+		want  map[string]string
+	}{
+		{ImportSkipExisting, ImportStats{Created: 3, Skipped: 2},
+			map[string]string{"/dst/x": "old", "/dst/d/y": "2", "/dst/extra": "e"}},
+		{ImportOverwrite, ImportStats{Created: 3, Updated: 1, Skipped: 1},
+			map[string]string{"/dst/x": "1", "/dst/d/y": "2", "/dst/extra": "e"}},
+		{ImportMirror, ImportStats{Created: 3, Updated: 1, Skipped: 1, Deleted: 1},
+			map[string]string{"/dst/x": "1", "/dst/d/y": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			c, d := newImportSource(t)
+			c.Set("/dst/x", "old", 0, "", 0)
+			c.Set("/dst/extra", "e", 0, "", 0)
+
+			stats, err := c.ImportDump(d, ImportOptions{Mode: tt.mode, Prefix: "/dst", Parallel: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *stats != tt.stats {
+				t.Errorf("stats %+v, want %+v", *stats, tt.stats)
+			}
+			got := make(map[string]string)
+			for _, node := range mustSnapshot(t, c, "/dst").Nodes {
+				if !node.Dir {
+					got[node.Key] = node.Value
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("imported %v, want %v", got, tt.want)
+			}
+			if _, err := c.GetResonse("/dst/e", false, false); err != nil {
+				t.Errorf("empty directory not imported: %v", err)
+			}
+		})
+	}
+}
+
+func mustSnapshot(t *testing.T, c *Client, prefix string) *Dump {
+	d, err := c.Snapshot(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestImportReplacesKind(t *testing.T) {
+	c, d := newImportSource(t)
+	// a file where the dump has a directory and the other way round
+	c.Set("/dst/d", "file", 0, "", 0)
+	c.Set("/dst/x/z", "in a dir", 0, "", 0)
+
+	if _, err := c.ImportDump(d, ImportOptions{Mode: ImportOverwrite, Prefix: "/dst"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("/dst/x"); v != "1" {
+		t.Errorf("x %q", v)
+	}
+	if v, _ := c.Get("/dst/d/y"); v != "2" {
+		t.Errorf("d/y %q", v)
+	}
+}
+
+func TestImportTTL(t *testing.T) {
+	c := newTestClient(t)
+	expired := time.Now().Add(-time.Second)
+	later := time.Now().Add(time.Minute)
+	d := &Dump{Version: DumpVersion, Prefix: "/t", Nodes: []DumpNode{
+		{Key: "/t", Dir: true},
+		{Key: "/t/gone", Value: "g", TTL: 10, Expiration: &expired},
+		{Key: "/t/left", Value: "l", TTL: 60, Expiration: &later},
+		{Key: "/t/plain", Value: "p"},
+	}}
+
+	stats, err := c.ImportDump(d, ImportOptions{PreserveTTL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Created != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+	if _, err := c.Get("/t/gone"); !IsEtcdNotFound(err) {
+		t.Errorf("expired key imported: %v", err)
+	}
+	if ttl, _, _ := c.TTL("/t/left"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("ttl %v", ttl)
+	}
+
+	c.RM("/t", true, true, "", 0)
+	if _, err := c.ImportDump(d, ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _, _ := c.TTL("/t/left"); ttl != 0 {
+		t.Errorf("ttl %v without PreserveTTL", ttl)
+	}
+	if _, err := c.Get("/t/gone"); err != nil {
+		t.Errorf("key without its ttl: %v", err)
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	c, d := newImportSource(t)
+	c.Set("/dst/x", "old", 0, "", 0)
+	c.Set("/dst/extra", "e", 0, "", 0)
+
+	var out bytes.Buffer
+	stats, err := c.ImportDump(d, ImportOptions{Mode: ImportMirror, Prefix: "/dst", DryRun: true, Out: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "= /dst/\n+ /dst/d/\n+ /dst/d/y\n+ /dst/e/\n~ /dst/x\n- /dst/extra\n"
+	if out.String() != want {
+		t.Errorf("plan\n%s\nwant\n%s", out.String(), want)
+	}
+	if stats.Deleted != 1 || stats.Updated != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	if v, _ := c.Get("/dst/x"); v != "old" {
+		t.Errorf("dry run wrote x %q", v)
+	}
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	c, _ := newImportSource(t)
+	var buf bytes.Buffer
+	if err := c.ExportFormat("/src", &buf, "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Import(&buf, "/dst", ImportSkipExisting); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/dst/", "/dst/d/", "/dst/d/y", "/dst/e/", "/dst/x"}
+	if keys := dumpKeys(mustSnapshot(t, c, "/dst")); !reflect.DeepEqual(keys, want) {
+		t.Errorf("imported %v, want %v", keys, want)
+	}
+	if v, _ := c.Get("/dst/d/y"); v != "2" {
+		t.Errorf("d/y %q", v)
+	}
+
+	if err := c.Import(strings.NewReader("not a dump"), "/dst", ImportSkipExisting); err == nil {
+		t.Error("import of garbage")
+	}
+}
+
+func TestParseImportMode(t *testing.T) {
+	for _, mode := range []ImportMode{ImportSkipExisting, ImportOverwrite, ImportMirror} {
+		if got, err := ParseImportMode(mode.String()); got != mode || err != nil {
+			t.Errorf("%s parsed as %v, %v", mode, got, err)
+		}
+	}
+	if _, err := ParseImportMode("merge"); err == nil {
+		t.Error("unknown mode parsed")
+	}
+}
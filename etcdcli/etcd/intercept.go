@@ -0,0 +1,139 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// Call is one backend operation on its way through the interceptors.
+// Interceptors may change any field before passing it on.
+type Call struct {
+	// Op is the backend method: get, set, delete or create_in_order.
+	Op  string
+	Key string
+	// Value is the value to write, empty for get and delete.
+	Value string
+	// Options is the *etcdv2.GetOptions, *etcdv2.SetOptions,
+	// *etcdv2.DeleteOptions or *etcdv2.CreateInOrderOptions of the call, nil
+	// if the caller passed none.
+	Options interface{}
+}
+
+// Invoker runs a call, either the next interceptor or the backend itself.
+type Invoker func(ctx context.Context, call *Call) (*etcdv2.Response, error)
+
+// Interceptor sees every Get, Set, Delete and CreateInOrder. It can inspect
+// or change the call and the context, time it, or answer it without calling
+// next at all.
+type Interceptor func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error)
+
+// Streamer opens a watch, either through the next stream interceptor or on
+// the backend itself.
+type Streamer func(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher
+
+// StreamInterceptor sees every watch when it is opened. It can change the
+// key and options, wrap the returned watcher to see each Next, or return a
+// watcher of its own.
+type StreamInterceptor func(key string, opts *etcdv2.WatcherOptions, next Streamer) etcdv2.Watcher
+
+// interceptedBackend runs calls through the interceptors in order, the
+// first one outermost, then through next.
+type interceptedBackend struct {
+	next         Backend
+	interceptors []Interceptor
+	streams      []StreamInterceptor
+}
+
+func (b *interceptedBackend) Unwrap() Backend {
+	return b.next
+}
+
+func (b *interceptedBackend) invoke(ctx context.Context, call *Call) (*etcdv2.Response, error) {
+	var invoker Invoker = b.call
+	for i := len(b.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := b.interceptors[i], invoker
+		invoker = func(ctx context.Context, call *Call) (*etcdv2.Response, error) {
+			return interceptor(ctx, call, next)
+		}
+	}
+	return invoker(ctx, call)
+}
+
+// call runs the call on the backend. Options replaced by the wrong type
+// fail the call: run without them a compare-and-swap would be a blind write.
+func (b *interceptedBackend) call(ctx context.Context, call *Call) (*etcdv2.Response, error) {
+	switch call.Op {
+	case "get":
+		if opts, ok := call.Options.(*etcdv2.GetOptions); ok || call.Options == nil {
+			return b.next.Get(ctx, call.Key, opts)
+		}
+	case "set":
+		if opts, ok := call.Options.(*etcdv2.SetOptions); ok || call.Options == nil {
+			return b.next.Set(ctx, call.Key, call.Value, opts)
+		}
+	case "delete":
+		if opts, ok := call.Options.(*etcdv2.DeleteOptions); ok || call.Options == nil {
+			return b.next.Delete(ctx, call.Key, opts)
+		}
+	case "create_in_order":
+		if opts, ok := call.Options.(*etcdv2.CreateInOrderOptions); ok || call.Options == nil {
+			return b.next.CreateInOrder(ctx, call.Key, call.Value, opts)
+		}
+	default:
+		return nil, etcdError(etcdv2.ErrorCodeInvalidField, "unknown operation", call.Op, 0)
+	}
+	return nil, etcdError(etcdv2.ErrorCodeInvalidField, "options of the wrong type", fmt.Sprintf("%s %s: %T", call.Op, call.Key, call.Options), 0)
+}
+
+func (b *interceptedBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	call := &Call{Op: "get", Key: key}
+	if opts != nil {
+		call.Options = opts
+	}
+	return b.invoke(ctx, call)
+}
+
+func (b *interceptedBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	call := &Call{Op: "set", Key: key, Value: value}
+	if opts != nil {
+		call.Options = opts
+	}
+	return b.invoke(ctx, call)
+}
+
+func (b *interceptedBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	call := &Call{Op: "delete", Key: key}
+	if opts != nil {
+		call.Options = opts
+	}
+	return b.invoke(ctx, call)
+}
+
+func (b *interceptedBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	call := &Call{Op: "create_in_order", Key: dir, Value: value}
+	if opts != nil {
+		call.Options = opts
+	}
+	return b.invoke(ctx, call)
+}
+
+func (b *interceptedBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	streamer := Streamer(b.next.Watcher)
+	for i := len(b.streams) - 1; i >= 0; i-- {
+		interceptor, next := b.streams[i], streamer
+		streamer = func(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+			return interceptor(key, opts, next)
+		}
+	}
+	return streamer(key, opts)
+}
+
+// WatcherFunc adapts a function to etcdv2.Watcher, handy in stream
+// interceptors that wrap Next.
+type WatcherFunc func(ctx context.Context) (*etcdv2.Response, error)
+
+func (f WatcherFunc) Next(ctx context.Context) (*etcdv2.Response, error) {
+	return f(ctx)
+}
@@ -0,0 +1,183 @@
+package etcd
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func newInterceptedClient(t *testing.T, interceptors []Interceptor, streams []StreamInterceptor) (*Client, *countingBackend) {
+	b := &countingBackend{Backend: NewMemoryBackend()}
+	c, err := NewClientWithConfig(Config{Backend: b, Interceptors: interceptors, StreamInterceptors: streams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, b
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	var order []string
+	named := func(name string) Interceptor {
+		return func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+			order = append(order, name+" "+call.Op)
+			resp, err := next(ctx, call)
+			order = append(order, name+" done")
+			return resp, err
+		}
+	}
+	c, _ := newInterceptedClient(t, []Interceptor{named("outer"), named("inner")}, nil)
+
+	c.Set("/k", "v", 0, "", 0)
+	want := []string{"outer set", "inner set", "inner done", "outer done"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("order %v, want %v", order, want)
+	}
+	order = nil
+	c.Get("/k")
+	c.RM("/k", false, false, "", 0)
+	c.MK("/q", "v", 0, true)
+	if len(order) != 12 || order[0] != "outer get" || order[4] != "outer delete" || order[8] != "outer create_in_order" {
+		t.Errorf("ops %v", order)
+	}
+}
+
+func TestInterceptorModifiesCall(t *testing.T) {
+	// keys move under /tenant, and every set becomes a create
+	rewrite := func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+		call.Key = "/tenant" + call.Key
+		if call.Op == "set" {
+			opts, _ := call.Options.(*etcdv2.SetOptions)
+			if opts == nil {
+				opts = &etcdv2.SetOptions{}
+			}
+			opts.PrevExist = etcdv2.PrevNoExist
+			call.Options = opts
+		}
+		return next(ctx, call)
+	}
+	c, b := newInterceptedClient(t, []Interceptor{rewrite}, nil)
+	raw, _ := NewClientWithConfig(Config{Backend: b.Backend})
+
+	if err := c.Set("/k", "v", 0, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := raw.Get("/tenant/k"); v != "v" {
+		t.Errorf("rewritten key %q", v)
+	}
+	if err := c.Set("/k", "again", 60, "", 0); !IsEtcdNodeExist(err) {
+		t.Errorf("set turned create: %v", err)
+	}
+}
+
+func TestInterceptorWrongOptions(t *testing.T) {
+	for _, op := range []string{"get", "set", "delete", "create_in_order"} {
+		swap := func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+			if call.Op == op {
+				call.Options = &etcdv2.WatcherOptions{}
+			}
+			return next(ctx, call)
+		}
+		c, b := newInterceptedClient(t, []Interceptor{swap}, nil)
+		raw, _ := NewClientWithConfig(Config{Backend: b.Backend})
+		raw.Set("/d/k", "v", 0, "", 0)
+
+		var err error
+		switch op {
+		case "get":
+			_, err = c.Get("/d/k")
+		case "set":
+			err = c.Set("/d/k", "new", 0, "other", 0)
+		case "delete":
+			err = c.RM("/d", true, true, "", 0)
+		case "create_in_order":
+			err = c.MK("/d/q", "v", 0, true)
+		}
+		if ErrorCode(err) != etcdv2.ErrorCodeInvalidField || !strings.Contains(err.Error(), "*client.WatcherOptions") {
+			t.Errorf("%s with the wrong options: %v", op, err)
+		}
+		if v, _ := raw.Get("/d/k"); v != "v" {
+			t.Errorf("%s ran without its options: %q", op, v)
+		}
+	}
+}
+
+func TestInterceptorShortCircuit(t *testing.T) {
+	cached := func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+		if call.Op == "get" && call.Key == "/cached" {
+			return &etcdv2.Response{Action: "get", Node: &etcdv2.Node{Key: call.Key, Value: "from cache"}}, nil
+		}
+		return next(ctx, call)
+	}
+	denied := func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+		if call.Op != "get" {
+			return nil, etcdError(etcdv2.ErrorCodeUnauthorized, "The request requires user authentication", call.Key, 0)
+		}
+		return next(ctx, call)
+	}
+	c, b := newInterceptedClient(t, []Interceptor{cached, denied}, nil)
+
+	if v, err := c.Get("/cached"); v != "from cache" || err != nil {
+		t.Errorf("cached get %q: %v", v, err)
+	}
+	if n := atomic.LoadInt32(&b.gets); n != 0 {
+		t.Errorf("%d gets reached the backend", n)
+	}
+	if err := c.Set("/k", "v", 0, "", 0); !IsEtcdUnauthorized(err) {
+		t.Errorf("denied set: %v", err)
+	}
+	if _, err := c.Get("/k"); !IsEtcdNotFound(err) {
+		t.Errorf("denied set reached the backend: %v", err)
+	}
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	var opened []string
+	var seen int32
+	// the first one rewrites the key, the second counts the events
+	rewrite := func(key string, opts *etcdv2.WatcherOptions, next Streamer) etcdv2.Watcher {
+		opened = append(opened, "rewrite "+key)
+		return next("/watched"+key, opts)
+	}
+	count := func(key string, opts *etcdv2.WatcherOptions, next Streamer) etcdv2.Watcher {
+		opened = append(opened, "count "+key)
+		w := next(key, opts)
+		return WatcherFunc(func(ctx context.Context) (*etcdv2.Response, error) {
+			resp, err := w.Next(ctx)
+			if err == nil {
+				atomic.AddInt32(&seen, 1)
+			}
+			return resp, err
+		})
+	}
+	c, _ := newInterceptedClient(t, nil, []StreamInterceptor{rewrite, count})
+
+	got := make(chan string, 1)
+	go c.Watch("/k", false, func(action, key, value string) bool {
+		got <- key + "=" + value
+		return true
+	})
+	time.Sleep(50 * time.Millisecond)
+	c.Set("/k", "unwatched", 0, "", 0)
+	c.Set("/watched/k", "v", 0, "", 0)
+
+	select {
+	case event := <-got:
+		if event != "/watched/k=v" {
+			t.Errorf("event %s", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	if want := []string{"rewrite /k", "count /watched/k"}; !reflect.DeepEqual(opened, want) {
+		t.Errorf("opened %v, want %v", opened, want)
+	}
+	if n := atomic.LoadInt32(&seen); n != 1 {
+		t.Errorf("%d events seen", n)
+	}
+}
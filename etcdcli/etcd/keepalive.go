@@ -0,0 +1,222 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// KeepAlive keeps keys and directories with a TTL from expiring while the
+// process that owns them runs. Every registered node is refreshed at a third
+// of its TTL with a refresh-only Set, which leaves the value alone and
+// fires no watch event; on etcd v3 it renews the lease of the key. A node found missing, expired while the
+// cluster was out of reach or deleted by somebody else, is created again
+// with the value it was registered with and reported.
+//
+// Close stops the refreshes, the nodes then expire after their TTL.
+type KeepAlive struct {
+	c      *Client
+	report func(ev KeepAliveEvent)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	entries map[string]*keepAliveEntry
+
+	// interval is the time between two refreshes, a third of the TTL when
+	// zero
+	interval time.Duration
+}
+
+// KeepAliveEvent reports a node that was lost, or that could not be
+// refreshed. Recreated is set when the node was missing and has been
+// created again; Err when a refresh or the recreation failed.
+type KeepAliveEvent struct {
+	Key       string
+	Dir       bool
+	Recreated bool
+	Err       error
+}
+
+type keepAliveEntry struct {
+	key    string
+	value  string
+	dir    bool
+	ttl    time.Duration
+	cancel context.CancelFunc
+}
+
+// ErrKeepAliveClosed is returned by Add and AddDir after Close.
+var ErrKeepAliveClosed = errors.New("etcd: keepalive closed")
+
+// NewKeepAlive refreshes nodes through c. report, which may be nil, is
+// called from the refresh goroutines for every KeepAliveEvent.
+func NewKeepAlive(c *Client, report func(ev KeepAliveEvent)) *KeepAlive {
+	k := &KeepAlive{c: c, report: report, entries: make(map[string]*keepAliveEntry)}
+	k.ctx, k.cancel = context.WithCancel(c.baseContext())
+	return k
+}
+
+// Add sets key to value with ttl, rounded up to whole seconds, and keeps it
+// alive. Adding a key again replaces its value and TTL.
+func (k *KeepAlive) Add(key, value string, ttl time.Duration) error {
+	if k.ctx.Err() != nil {
+		return ErrKeepAliveClosed
+	}
+	e := &keepAliveEntry{key: etcdpath.Clean(key), value: value, ttl: roundTTL(ttl)}
+	ctx, cancel := context.WithTimeout(k.ctx, k.c.timeout)
+	_, err := k.c.backend.Set(ctx, e.key, value, &etcdv2.SetOptions{TTL: e.ttl})
+	cancel()
+	if err != nil {
+		return err
+	}
+	return k.start(e)
+}
+
+// AddDir keeps the directory key alive with ttl, rounded up to whole
+// seconds. An existing directory gets the TTL, a missing one is created.
+func (k *KeepAlive) AddDir(key string, ttl time.Duration) error {
+	if k.ctx.Err() != nil {
+		return ErrKeepAliveClosed
+	}
+	e := &keepAliveEntry{key: etcdpath.Clean(key), dir: true, ttl: roundTTL(ttl)}
+	err := k.refresh(k.ctx, e)
+	if IsEtcdNotFound(err) {
+		err = k.create(k.ctx, e)
+	}
+	if err != nil {
+		return err
+	}
+	return k.start(e)
+}
+
+// Remove stops keeping key alive, it expires after its TTL.
+func (k *KeepAlive) Remove(key string) {
+	key = etcdpath.Clean(key)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if e, ok := k.entries[key]; ok {
+		e.cancel()
+		delete(k.entries, key)
+	}
+}
+
+// Keys returns the keys kept alive.
+func (k *KeepAlive) Keys() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := make([]string, 0, len(k.entries))
+	for key := range k.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Close stops every refresh and waits for them to return. The nodes are
+// left to expire.
+func (k *KeepAlive) Close() error {
+	k.cancel()
+	k.wg.Wait()
+	k.mu.Lock()
+	k.entries = make(map[string]*keepAliveEntry)
+	k.mu.Unlock()
+	return nil
+}
+
+func roundTTL(ttl time.Duration) time.Duration {
+	if ttl < time.Second {
+		return time.Second
+	}
+	return (ttl + time.Second - 1) / time.Second * time.Second
+}
+
+func (k *KeepAlive) start(e *keepAliveEntry) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.ctx.Err() != nil {
+		return ErrKeepAliveClosed
+	}
+	if old, ok := k.entries[e.key]; ok {
+		old.cancel()
+	}
+	var ctx context.Context
+	ctx, e.cancel = context.WithCancel(k.ctx)
+	k.entries[e.key] = e
+
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		k.run(ctx, e)
+	}()
+	return nil
+}
+
+func (k *KeepAlive) run(ctx context.Context, e *keepAliveEntry) {
+	interval := k.interval
+	if interval <= 0 {
+		interval = e.ttl / 3
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := k.refresh(ctx, e)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if !IsEtcdNotFound(err) {
+			k.c.logger.Log(LevelWarn, "keepalive refresh failed", Field{"key", e.key}, Field{"error", err.Error()})
+			k.emit(KeepAliveEvent{Key: e.key, Dir: e.dir, Err: err})
+			continue
+		}
+
+		err = k.create(ctx, e)
+		if ctx.Err() != nil {
+			return
+		}
+		if IsEtcdNodeExist(err) {
+			// created by somebody else meanwhile, the next refresh adopts it
+			continue
+		}
+		if err != nil {
+			k.c.logger.Log(LevelError, "keepalive lost key not recreated", Field{"key", e.key}, Field{"error", err.Error()})
+			k.emit(KeepAliveEvent{Key: e.key, Dir: e.dir, Err: err})
+			continue
+		}
+		k.c.logger.Log(LevelWarn, "keepalive lost key, recreated", Field{"key", e.key})
+		k.emit(KeepAliveEvent{Key: e.key, Dir: e.dir, Recreated: true})
+	}
+}
+
+func (k *KeepAlive) emit(ev KeepAliveEvent) {
+	if k.report != nil {
+		k.report(ev)
+	}
+}
+
+// refresh resets the TTL of an existing node without touching its value.
+// The request stops with ctx, when the entry is removed or k closed.
+func (k *KeepAlive) refresh(ctx context.Context, e *keepAliveEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, k.c.timeout)
+	defer cancel()
+	_, err := k.c.backend.Set(ctx, e.key, "", &etcdv2.SetOptions{TTL: e.ttl, Refresh: true, Dir: e.dir, PrevExist: etcdv2.PrevExist})
+	return err
+}
+
+func (k *KeepAlive) create(ctx context.Context, e *keepAliveEntry) error {
+	ctx, cancel := context.WithTimeout(ctx, k.c.timeout)
+	defer cancel()
+	_, err := k.c.backend.Set(ctx, e.key, e.value, &etcdv2.SetOptions{TTL: e.ttl, Dir: e.dir, PrevExist: etcdv2.PrevNoExist})
+	return err
+}
@@ -0,0 +1,139 @@
+package etcd
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func TestKeepAlive(t *testing.T) {
+	for _, backend := range testBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Parallel()
+			c, err := NewClientWithConfig(Config{Backend: backend.new()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			events := make(chan KeepAliveEvent, 10)
+			k := NewKeepAlive(c, func(ev KeepAliveEvent) { events <- ev })
+			k.interval = 50 * time.Millisecond
+			defer k.Close()
+
+			watched := make(chan string, 100)
+			go c.Watch("/ka", true, func(action, key, value string) bool {
+				watched <- action + " " + key
+				return false
+			})
+			time.Sleep(50 * time.Millisecond)
+			if err := k.Add("/ka/key", "v", time.Second); err != nil {
+				t.Fatal(err)
+			}
+			c.MKDir("/ka/dir", 0)
+			if err := k.AddDir("/ka/dir", time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if err := k.AddDir("/ka/new", time.Second); err != nil {
+				t.Fatal(err)
+			}
+			kv, isV3 := c.V3()
+			var firstLease int64
+			if isV3 {
+				firstLease, _ = kv.Grant(context.Background(), 1)
+			}
+			time.Sleep(100 * time.Millisecond)
+			for len(watched) > 0 {
+				<-watched
+			}
+
+			// some twenty refreshes later
+			time.Sleep(1200 * time.Millisecond)
+			if v, err := c.Get("/ka/key"); v != "v" || err != nil {
+				t.Fatalf("key after its ttl: %q, %v", v, err)
+			}
+			for _, dir := range []string{"/ka/dir", "/ka/new"} {
+				if _, err := c.GetResonse(dir, false, false); err != nil {
+					t.Fatalf("%s after its ttl: %v", dir, err)
+				}
+			}
+			if n := len(watched); n != 0 {
+				t.Errorf("%d watch events for the refreshes, the first %s", n, <-watched)
+			}
+			if isV3 {
+				// the refreshes renew the leases, they grant none
+				if lease, _ := kv.Grant(context.Background(), 1); lease != firstLease+1 {
+					t.Errorf("%d leases granted by the refreshes", lease-firstLease-1)
+				}
+			}
+
+			c.RM("/ka/key", false, false, "", 0)
+			select {
+			case ev := <-events:
+				if ev.Key != "/ka/key" || !ev.Recreated || ev.Err != nil {
+					t.Fatalf("event %+v", ev)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("deleted key not recreated")
+			}
+			if v, _ := c.Get("/ka/key"); v != "v" {
+				t.Errorf("recreated with %q", v)
+			}
+
+			k.Remove("/ka/new")
+			k.Close()
+			if err := k.Add("/ka/x", "v", time.Second); err != ErrKeepAliveClosed {
+				t.Errorf("add after close: %v", err)
+			}
+			eventually(t, "expiry after close", func() bool {
+				_, err1 := c.GetResonse("/ka/key", false, false)
+				_, err2 := c.GetResonse("/ka/new", false, false)
+				return IsEtcdNotFound(err1) && IsEtcdNotFound(err2)
+			})
+		})
+	}
+}
+
+// hangingBackend holds every Set once hang is set, until its context is
+// done.
+type hangingBackend struct {
+	Backend
+	hang int32
+}
+
+func (b *hangingBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	if atomic.LoadInt32(&b.hang) != 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.Backend.Set(ctx, key, value, opts)
+}
+
+func TestKeepAliveCloseStopsRequests(t *testing.T) {
+	b := &hangingBackend{Backend: NewMemoryBackend()}
+	c, err := NewClientWithConfig(Config{Backend: b, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var events int32
+	k := NewKeepAlive(c, func(ev KeepAliveEvent) { atomic.AddInt32(&events, 1) })
+	if err := k.Add("/ka/key", "v", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first refresh hangs
+	atomic.StoreInt32(&b.hang, 1)
+	time.Sleep(500 * time.Millisecond)
+	start := time.Now()
+	k.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close waited %v for the refresh", elapsed)
+	}
+	if n := atomic.LoadInt32(&events); n != 0 {
+		t.Errorf("%d events for a cancelled refresh", n)
+	}
+}
@@ -0,0 +1,102 @@
+package etcd
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Field is one structured value of a log entry. The client uses the keys
+// op, key, endpoint, endpoints, duration, code and error.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the diagnostics of a Client. Set it in Config.Logger;
+// without one the client logs nothing. Credentials are never passed to it.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+// NopLogger returns a Logger that drops everything.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+// LoggerFunc adapts a function to Logger.
+type LoggerFunc func(level Level, msg string, fields ...Field)
+
+func (f LoggerFunc) Log(level Level, msg string, fields ...Field) {
+	f(level, msg, fields...)
+}
+
+// redactEndpoint drops the user info of an endpoint URL.
+func redactEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.User == nil {
+		return endpoint
+	}
+	u.User = nil
+	return u.String()
+}
+
+func redactEndpoints(endpoints []string) string {
+	redacted := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		redacted = append(redacted, redactEndpoint(endpoint))
+	}
+	return strings.Join(redacted, ",")
+}
+
+// logInterceptor logs every call: successes at debug, failures at warn.
+// Values are never logged, they may be secrets.
+func logInterceptor(logger Logger, endpoint string) Interceptor {
+	return func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+		start := time.Now()
+		resp, err := next(ctx, call)
+		fields := []Field{
+			{"op", opName(call)},
+			{"key", call.Key},
+			{"endpoint", endpoint},
+			{"duration", time.Since(start)},
+			{"code", errorLabel(err)},
+		}
+		if err != nil {
+			logger.Log(LevelWarn, "etcd request failed", append(fields, Field{"error", err.Error()})...)
+		} else {
+			logger.Log(LevelDebug, "etcd request", fields...)
+		}
+		return resp, err
+	}
+}
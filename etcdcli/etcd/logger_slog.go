@@ -0,0 +1,41 @@
+//go:build go1.21
+// +build go1.21
+
+package etcd
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger sends the client diagnostics to l.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (s slogLogger) Log(level Level, msg string, fields ...Field) {
+	var lvl slog.Level
+	switch level {
+	case LevelDebug:
+		lvl = slog.LevelDebug
+	case LevelInfo:
+		lvl = slog.LevelInfo
+	case LevelWarn:
+		lvl = slog.LevelWarn
+	default:
+		lvl = slog.LevelError
+	}
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, lvl) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		attrs = append(attrs, slog.Any(f.Key, f.Value))
+	}
+	s.l.LogAttrs(ctx, lvl, msg, attrs...)
+}
@@ -0,0 +1,318 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryV3Client is an in-memory V3Client for tests: revisions, leases with
+// real expiry, transactions and watches with full history, no network.
+type MemoryV3Client struct {
+	mu        sync.Mutex
+	rev       int64
+	compacted int64
+	kvs       map[string]V3KeyValue
+	leases    map[int64]time.Time
+	ttls      map[int64]int64 // the TTL each lease was granted with
+	nextLease int64
+	history   []V3Event
+	watchers  map[chan struct{}]struct{}
+}
+
+// NewMemoryV3Client returns an empty store at revision 1.
+func NewMemoryV3Client() *MemoryV3Client {
+	return &MemoryV3Client{
+		rev:      1,
+		kvs:      make(map[string]V3KeyValue),
+		leases:   make(map[int64]time.Time),
+		ttls:     make(map[int64]int64),
+		watchers: make(map[chan struct{}]struct{}),
+	}
+}
+
+// NewMemoryBackend returns a Backend kept in memory, for tests that need a
+// Client without a cluster.
+func NewMemoryBackend() Backend {
+	return NewV3Backend(NewMemoryV3Client())
+}
+
+var errLeaseNotFound = errors.New("etcdserver: requested lease not found")
+
+func (m *MemoryV3Client) Range(ctx context.Context, key string, prefix bool) ([]V3KeyValue, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+
+	var kvs []V3KeyValue
+	for k, kv := range m.kvs {
+		if k == key || prefix && strings.HasPrefix(k, key) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, m.rev, nil
+}
+
+func (m *MemoryV3Client) Txn(ctx context.Context, cmps []V3Cmp, ops []V3Op) (bool, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+
+	for _, cmp := range cmps {
+		ok, err := m.compareLocked(cmp)
+		if err != nil {
+			return false, m.rev, err
+		}
+		if !ok {
+			return false, m.rev, nil
+		}
+	}
+	for _, op := range ops {
+		if _, ok := m.leases[op.Lease]; !op.Delete && op.Lease != 0 && !ok {
+			return false, m.rev, errLeaseNotFound
+		}
+	}
+	if len(ops) == 0 {
+		return true, m.rev, nil
+	}
+
+	m.rev++
+	for _, op := range ops {
+		if op.Delete {
+			for k := range m.kvs {
+				if k == op.Key || op.Prefix && strings.HasPrefix(k, op.Key) {
+					m.deleteLocked(k)
+				}
+			}
+			continue
+		}
+
+		kv := V3KeyValue{Key: op.Key, Value: op.Value, CreateRevision: m.rev, ModRevision: m.rev, Lease: op.Lease}
+		var prevKv *V3KeyValue
+		if prev, ok := m.kvs[op.Key]; ok {
+			kv.CreateRevision = prev.CreateRevision
+			prevKv = &prev
+		}
+		m.kvs[op.Key] = kv
+		m.history = append(m.history, V3Event{Kv: kv, PrevKv: prevKv})
+	}
+	m.notifyLocked()
+	return true, m.rev, nil
+}
+
+func (m *MemoryV3Client) compareLocked(cmp V3Cmp) (bool, error) {
+	kvs := []V3KeyValue{m.kvs[cmp.Key]}
+	if _, ok := m.kvs[cmp.Key]; !ok && cmp.Target == "value" {
+		return false, nil
+	}
+	if cmp.RangeEnd != "" {
+		kvs = nil
+		for k, kv := range m.kvs {
+			if k >= cmp.Key && k < cmp.RangeEnd {
+				kvs = append(kvs, kv)
+			}
+		}
+		if len(kvs) == 0 {
+			if cmp.Target == "value" {
+				return false, nil
+			}
+			kvs = []V3KeyValue{{}}
+		}
+	}
+
+	for _, kv := range kvs {
+		switch cmp.Target {
+		case "value":
+			if kv.Value != cmp.Value {
+				return false, nil
+			}
+		case "mod":
+			if kv.ModRevision != cmp.Revision {
+				return false, nil
+			}
+		case "create":
+			if kv.CreateRevision != cmp.Revision {
+				return false, nil
+			}
+		default:
+			return false, errors.New("unknown compare target " + cmp.Target)
+		}
+	}
+	return true, nil
+}
+
+func (m *MemoryV3Client) deleteLocked(key string) {
+	prev := m.kvs[key]
+	delete(m.kvs, key)
+	m.history = append(m.history, V3Event{
+		Delete: true,
+		Kv:     V3KeyValue{Key: key, ModRevision: m.rev},
+		PrevKv: &prev,
+	})
+}
+
+func (m *MemoryV3Client) Grant(ctx context.Context, ttl int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextLease++
+	id := m.nextLease
+	d := time.Duration(ttl) * time.Second
+	m.leases[id] = time.Now().Add(d)
+	m.ttls[id] = ttl
+	m.expireAfterLocked(d)
+	return id, nil
+}
+
+func (m *MemoryV3Client) KeepAliveOnce(ctx context.Context, lease int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+	if _, ok := m.leases[lease]; !ok {
+		return 0, errLeaseNotFound
+	}
+	d := time.Duration(m.ttls[lease]) * time.Second
+	m.leases[lease] = time.Now().Add(d)
+	m.expireAfterLocked(d)
+	return m.ttls[lease], nil
+}
+
+// expireAfterLocked drops the leases expired by then, d from now.
+func (m *MemoryV3Client) expireAfterLocked(d time.Duration) {
+	time.AfterFunc(d, func() {
+		m.mu.Lock()
+		m.expireLocked()
+		m.mu.Unlock()
+	})
+}
+
+func (m *MemoryV3Client) TimeToLive(ctx context.Context, lease int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+	expiry, ok := m.leases[lease]
+	if !ok {
+		return -1, nil
+	}
+	return int64((time.Until(expiry) + time.Second - 1) / time.Second), nil
+}
+
+// expireLocked drops expired leases and their keys, all in one revision.
+func (m *MemoryV3Client) expireLocked() {
+	now := time.Now()
+	var expired []int64
+	for id, expiry := range m.leases {
+		if !expiry.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	var keys []string
+	for _, id := range expired {
+		delete(m.leases, id)
+		delete(m.ttls, id)
+		for k, kv := range m.kvs {
+			if kv.Lease == id {
+				keys = append(keys, k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+	m.rev++
+	for _, k := range keys {
+		m.deleteLocked(k)
+	}
+	m.notifyLocked()
+}
+
+// Compact forgets the history before rev, watches started earlier get a
+// compacted response like on a real cluster.
+func (m *MemoryV3Client) Compact(rev int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rev <= m.compacted {
+		return
+	}
+	m.compacted = rev
+	i := sort.Search(len(m.history), func(i int) bool { return m.history[i].Kv.ModRevision >= rev })
+	m.history = append([]V3Event(nil), m.history[i:]...)
+	m.notifyLocked()
+}
+
+func (m *MemoryV3Client) notifyLocked() {
+	for ch := range m.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *MemoryV3Client) Watch(ctx context.Context, key string, prefix bool, rev int64) <-chan V3WatchResponse {
+	out := make(chan V3WatchResponse)
+	wake := make(chan struct{}, 1)
+
+	m.mu.Lock()
+	if rev <= 0 {
+		rev = m.rev + 1
+	}
+	m.watchers[wake] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		defer close(out)
+		defer func() {
+			m.mu.Lock()
+			delete(m.watchers, wake)
+			m.mu.Unlock()
+		}()
+
+		for {
+			m.mu.Lock()
+			if rev < m.compacted {
+				m.mu.Unlock()
+				select {
+				case out <- V3WatchResponse{Compacted: true}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			var resp V3WatchResponse
+			for _, ev := range m.history {
+				if ev.Kv.ModRevision < rev {
+					continue
+				}
+				if ev.Kv.Key == key || prefix && strings.HasPrefix(ev.Kv.Key, key) {
+					resp.Events = append(resp.Events, ev)
+				}
+			}
+			next := m.rev + 1
+			m.mu.Unlock()
+
+			if len(resp.Events) > 0 {
+				select {
+				case out <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+			rev = next
+
+			select {
+			case <-wake:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,417 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// memoryV2HistorySize is how many events the v2 store keeps for watches,
+// older indexes are cleared.
+const memoryV2HistorySize = 1000
+
+// memoryV2Backend is the v2 keys store in memory: a tree of nodes, one
+// index for the whole store, TTLs that expire on time and a bounded event
+// history for watches. It follows the server where the v2 and v3 backends
+// differ: a plain set creates the node anew, directories stay when their
+// last child goes, hidden "_" nodes are left out of listings and recursive
+// watches.
+type memoryV2Backend struct {
+	mu       sync.Mutex
+	index    uint64
+	root     *memoryV2Node
+	history  []*etcdv2.Response
+	watchers map[chan struct{}]struct{}
+}
+
+type memoryV2Node struct {
+	key        string
+	dir        bool
+	value      string
+	created    uint64
+	modified   uint64
+	expiration *time.Time
+	parent     *memoryV2Node
+	children   map[string]*memoryV2Node
+}
+
+// NewMemoryV2Backend returns a Backend that keeps the v2 keys model in
+// memory, for tests that compare the v3 backend with v2 behaviour. The store
+// starts at index 1, so that AfterIndex can point before the first write.
+func NewMemoryV2Backend() Backend {
+	return &memoryV2Backend{
+		index:    1,
+		root:     &memoryV2Node{key: "/", dir: true, children: make(map[string]*memoryV2Node)},
+		watchers: make(map[chan struct{}]struct{}),
+	}
+}
+
+// find returns the node at key, nil when there is none.
+func (m *memoryV2Backend) find(key string) *memoryV2Node {
+	n := m.root
+	for _, segment := range strings.Split(strings.Trim(key, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		if !n.dir {
+			return nil
+		}
+		if n = n.children[segment]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// parentDir returns the directory key goes into, creating the missing ones
+// at index.
+func (m *memoryV2Backend) parentDir(key string, index uint64) (*memoryV2Node, error) {
+	n := m.root
+	segments := strings.Split(strings.Trim(key, "/"), "/")
+	for _, segment := range segments[:len(segments)-1] {
+		child := n.children[segment]
+		if child == nil {
+			child = &memoryV2Node{key: strings.TrimSuffix(n.key, "/") + "/" + segment, dir: true, created: index, modified: index, parent: n, children: make(map[string]*memoryV2Node)}
+			n.children[segment] = child
+		}
+		if !child.dir {
+			return nil, etcdError(etcdv2.ErrorCodeNotDir, "Not a directory", child.key, int64(m.index))
+		}
+		n = child
+	}
+	return n, nil
+}
+
+func (n *memoryV2Node) name() string {
+	return n.key[strings.LastIndex(n.key, "/")+1:]
+}
+
+func (n *memoryV2Node) remove() {
+	delete(n.parent.children, n.name())
+}
+
+// repr copies n for a response, with its children when recursive and one
+// level of them when listing a directory.
+func (n *memoryV2Node) repr(recursive, sorted, list bool) *etcdv2.Node {
+	node := &etcdv2.Node{Key: n.key, Dir: n.dir, CreatedIndex: n.created, ModifiedIndex: n.modified}
+	if !n.dir {
+		node.Value = n.value
+	}
+	if n.expiration != nil {
+		expiration := *n.expiration
+		node.Expiration = &expiration
+		left := time.Until(expiration)
+		node.TTL = int64(left / time.Second)
+		if left%time.Second > 0 {
+			node.TTL++
+		}
+	}
+	if n.dir && (recursive || list) {
+		node.Nodes = etcdv2.Nodes{}
+		for name, child := range n.children {
+			if etcdpath.IsHidden(name) {
+				continue
+			}
+			node.Nodes = append(node.Nodes, child.repr(recursive, sorted, false))
+		}
+		if sorted {
+			sort.Sort(node.Nodes)
+		}
+	}
+	return node
+}
+
+func ttlExpiration(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	expiration := time.Now().Add((ttl + time.Second - 1) / time.Second * time.Second)
+	return &expiration
+}
+
+// expireLocked removes the nodes whose TTL ran out, one event and index
+// each like the v2 store.
+func (m *memoryV2Backend) expireLocked() {
+	now := time.Now()
+	var expired []*memoryV2Node
+	var walk func(n *memoryV2Node)
+	walk = func(n *memoryV2Node) {
+		if n.expiration != nil && !n.expiration.After(now) {
+			expired = append(expired, n)
+			return
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+	}
+	walk(m.root)
+	sort.Slice(expired, func(i, j int) bool { return expired[i].key < expired[j].key })
+
+	for _, n := range expired {
+		m.index++
+		prev := n.repr(false, false, false)
+		n.remove()
+		m.recordLocked(&etcdv2.Response{
+			Action:   "expire",
+			Node:     &etcdv2.Node{Key: n.key, Dir: n.dir, CreatedIndex: n.created, ModifiedIndex: m.index},
+			PrevNode: prev,
+			Index:    m.index,
+		})
+	}
+}
+
+// scheduleExpiry wakes the store when expiration passes, so that watchers
+// see the expire event without another request.
+func (m *memoryV2Backend) scheduleExpiry(expiration *time.Time) {
+	if expiration == nil {
+		return
+	}
+	time.AfterFunc(time.Until(*expiration), func() {
+		m.mu.Lock()
+		m.expireLocked()
+		m.mu.Unlock()
+	})
+}
+
+func (m *memoryV2Backend) recordLocked(resp *etcdv2.Response) {
+	m.history = append(m.history, resp)
+	if len(m.history) > memoryV2HistorySize {
+		m.history = m.history[len(m.history)-memoryV2HistorySize:]
+	}
+	for ch := range m.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *memoryV2Backend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.GetOptions{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+
+	n := m.find(key)
+	if n == nil {
+		return nil, etcdError(etcdv2.ErrorCodeKeyNotFound, "Key not found", cleanKey(key), int64(m.index))
+	}
+	return &etcdv2.Response{Action: "get", Node: n.repr(opts.Recursive, opts.Sort, true), Index: m.index}, nil
+}
+
+func (m *memoryV2Backend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.SetOptions{}
+	}
+	key = cleanKey(key)
+	if key == "" {
+		return nil, etcdError(etcdv2.ErrorCodeRootROnly, "Cannot modify root directory", "/", 0)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+	return m.setLocked(key, value, opts)
+}
+
+func (m *memoryV2Backend) setLocked(key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	n := m.find(key)
+	cas := opts.PrevValue != "" || opts.PrevIndex != 0
+	action := "set"
+	switch {
+	case opts.Refresh:
+		action = "update"
+	case cas:
+		action = "compareAndSwap"
+	case opts.PrevExist == etcdv2.PrevNoExist:
+		action = "create"
+	case opts.PrevExist == etcdv2.PrevExist:
+		action = "update"
+	}
+
+	switch {
+	case opts.Refresh && value != "":
+		return nil, etcdError(etcdv2.ErrorCodeInvalidField, "Value provided on refresh", key, int64(m.index))
+	case n == nil && (cas || opts.PrevExist == etcdv2.PrevExist || opts.Refresh):
+		return nil, etcdError(etcdv2.ErrorCodeKeyNotFound, "Key not found", key, int64(m.index))
+	case n != nil && opts.PrevExist == etcdv2.PrevNoExist:
+		return nil, etcdError(etcdv2.ErrorCodeNodeExist, "Key already exists", key, int64(m.index))
+	case n != nil && n.dir && !(opts.Dir && action == "update"):
+		return nil, etcdError(etcdv2.ErrorCodeNotFile, "Not a file", key, int64(m.index))
+	case cas && (opts.PrevValue != "" && n.value != opts.PrevValue || opts.PrevIndex != 0 && n.modified != opts.PrevIndex):
+		return nil, etcdError(etcdv2.ErrorCodeTestFailed, "Compare failed", key, int64(m.index))
+	}
+
+	index := m.index + 1
+	parent, err := m.parentDir(key, index)
+	if err != nil {
+		return nil, err
+	}
+	m.index = index
+
+	var prev *etcdv2.Node
+	if n != nil {
+		prev = n.repr(false, false, false)
+	}
+	expiration := ttlExpiration(opts.TTL)
+	switch {
+	case opts.Refresh:
+		n.expiration = expiration
+		n.modified = index
+		m.scheduleExpiry(expiration)
+		// refreshes are not seen by watchers
+		return &etcdv2.Response{Action: action, Node: n.repr(false, false, false), PrevNode: prev, Index: index}, nil
+	case action == "update" || action == "compareAndSwap":
+		// the node stays, with a new value
+		if !n.dir {
+			n.value = value
+		}
+		n.dir = n.dir || opts.Dir
+		n.modified, n.expiration = index, expiration
+	default:
+		// set and create make a new node, with a new created index
+		if n != nil {
+			n.remove()
+		}
+		n = &memoryV2Node{key: key, dir: opts.Dir, created: index, modified: index, expiration: expiration, parent: parent}
+		if opts.Dir {
+			n.children = make(map[string]*memoryV2Node)
+		} else {
+			n.value = value
+		}
+		parent.children[n.name()] = n
+	}
+	m.scheduleExpiry(expiration)
+
+	resp := &etcdv2.Response{Action: action, Node: n.repr(false, false, false), PrevNode: prev, Index: index}
+	m.recordLocked(resp)
+	return resp, nil
+}
+
+func (m *memoryV2Backend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.DeleteOptions{}
+	}
+	key = cleanKey(key)
+	if key == "" {
+		return nil, etcdError(etcdv2.ErrorCodeRootROnly, "Cannot modify root directory", "/", 0)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+
+	n := m.find(key)
+	cas := opts.PrevValue != "" || opts.PrevIndex != 0
+	action := "delete"
+	if cas {
+		action = "compareAndDelete"
+	}
+	switch {
+	case n == nil:
+		return nil, etcdError(etcdv2.ErrorCodeKeyNotFound, "Key not found", key, int64(m.index))
+	case n.dir && (cas || !opts.Dir && !opts.Recursive):
+		return nil, etcdError(etcdv2.ErrorCodeNotFile, "Not a file", key, int64(m.index))
+	case n.dir && !opts.Recursive && len(n.children) > 0:
+		return nil, etcdError(etcdv2.ErrorCodeDirNotEmpty, "Directory not empty", key, int64(m.index))
+	case cas && (opts.PrevValue != "" && n.value != opts.PrevValue || opts.PrevIndex != 0 && n.modified != opts.PrevIndex):
+		return nil, etcdError(etcdv2.ErrorCodeTestFailed, "Compare failed", key, int64(m.index))
+	}
+
+	m.index++
+	prev := n.repr(false, false, false)
+	n.remove()
+	resp := &etcdv2.Response{
+		Action:   action,
+		Node:     &etcdv2.Node{Key: key, Dir: n.dir, CreatedIndex: n.created, ModifiedIndex: m.index},
+		PrevNode: prev,
+		Index:    m.index,
+	}
+	m.recordLocked(resp)
+	return resp, nil
+}
+
+func (m *memoryV2Backend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.CreateInOrderOptions{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked()
+
+	// the key is named after the index it is created at
+	key := fmt.Sprintf("%s/%020d", cleanKey(dir), m.index+1)
+	resp, err := m.setLocked(key, value, &etcdv2.SetOptions{TTL: opts.TTL, PrevExist: etcdv2.PrevNoExist})
+	if resp != nil {
+		resp.Action = "create"
+	}
+	return resp, err
+}
+
+func (m *memoryV2Backend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	if opts == nil {
+		opts = &etcdv2.WatcherOptions{}
+	}
+	return &memoryV2Watcher{m: m, key: cleanKey(key), recursive: opts.Recursive, next: opts.AfterIndex + 1, fromNow: opts.AfterIndex == 0}
+}
+
+type memoryV2Watcher struct {
+	m         *memoryV2Backend
+	key       string
+	recursive bool
+	next      uint64
+	fromNow   bool
+}
+
+func (w *memoryV2Watcher) matches(resp *etcdv2.Response) bool {
+	key := resp.Node.Key
+	if key == w.key {
+		return true
+	}
+	return w.recursive && strings.HasPrefix(key, w.key+"/") && !etcdpath.IsHidden(strings.TrimPrefix(key, w.key))
+}
+
+func (w *memoryV2Watcher) Next(ctx context.Context) (*etcdv2.Response, error) {
+	m := w.m
+	wake := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.watchers[wake] = struct{}{}
+	if w.fromNow {
+		w.next, w.fromNow = m.index+1, false
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.watchers, wake)
+		m.mu.Unlock()
+	}()
+
+	for {
+		m.mu.Lock()
+		if len(m.history) > 0 && w.next < m.history[0].Index && w.next <= m.index {
+			cause := fmt.Sprintf("the requested history has been cleared [%d/%d]", m.history[0].Index, w.next)
+			m.mu.Unlock()
+			return nil, etcdError(etcdv2.ErrorCodeEventIndexCleared, "The event in requested index is outdated and cleared", cause, int64(m.index))
+		}
+		for _, resp := range m.history {
+			if resp.Index >= w.next && w.matches(resp) {
+				w.next = resp.Index + 1
+				m.mu.Unlock()
+				return resp, nil
+			}
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
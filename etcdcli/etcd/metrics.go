@@ -0,0 +1,321 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// DefaultBuckets are the latency histogram bounds in seconds, the same as
+// the prometheus client defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics records what a Client does. Set it in Config.Metrics, share one
+// between clients if you like, and expose it with ServeHTTP or WriteTo in
+// the prometheus text format:
+//
+//	etcdcli_requests_total{op,code}            finished requests
+//	etcdcli_request_duration_seconds{op}       latency histogram
+//	etcdcli_requests_in_flight{op}             requests running now
+//	etcdcli_watches_active                     running watches
+//	etcdcli_watch_reconnects_total             watches started again after an error
+//	etcdcli_throttled_total{class,result}      requests held back by Limits
+//
+// op is get, list, set, create, update, cas, delete, cad, create_in_order or
+// watch. code is ok, the etcd error code, canceled, timeout, unavailable,
+// throttled or other. Watch requests are counted but not timed, they block
+// until the next event.
+//
+// A nil *Metrics records nothing.
+type Metrics struct {
+	mu         sync.Mutex
+	buckets    []float64
+	requests   map[[2]string]uint64
+	durations  map[string]*histogram
+	inFlight   map[string]int64
+	watches    int64
+	reconnects uint64
+	throttles  map[[2]string]uint64
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		buckets:   DefaultBuckets,
+		requests:  make(map[[2]string]uint64),
+		durations: make(map[string]*histogram),
+		inFlight:  make(map[string]int64),
+		throttles: make(map[[2]string]uint64),
+	}
+}
+
+func (m *Metrics) start(op string) time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	m.mu.Lock()
+	m.inFlight[op]++
+	m.mu.Unlock()
+	return time.Now()
+}
+
+func (m *Metrics) done(op string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	elapsed := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[op]--
+	m.requests[[2]string{op, errorLabel(err)}]++
+	if op == "watch" {
+		return
+	}
+	h := m.durations[op]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.durations[op] = h
+	}
+	h.count++
+	h.sum += elapsed
+	if i := sort.SearchFloat64s(m.buckets, elapsed); i < len(m.buckets) {
+		h.counts[i]++
+	}
+}
+
+func (m *Metrics) watchStarted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.watches++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) watchStopped() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.watches--
+	m.mu.Unlock()
+}
+
+func (m *Metrics) watchReconnected() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.reconnects++
+	m.mu.Unlock()
+}
+
+// throttled counts a request of class (read, write or watch) that waited
+// or was rejected.
+func (m *Metrics) throttled(class, result string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.throttles[[2]string{class, result}]++
+	m.mu.Unlock()
+}
+
+// errorLabel is the code label of a finished request.
+func errorLabel(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if code := ErrorCode(err); code != 0 {
+		return strconv.Itoa(code)
+	}
+	var clusterErr *etcdv2.ClusterError
+	switch {
+	case errors.As(err, &clusterErr):
+		return "unavailable"
+	case errors.Is(err, ErrThrottled):
+		return "throttled"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "other"
+}
+
+// WriteTo writes the metrics in the prometheus text format, nothing for a
+// nil *Metrics.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	fmt.Fprintln(cw, "# HELP etcdcli_requests_total Requests to etcd by operation and result.")
+	fmt.Fprintln(cw, "# TYPE etcdcli_requests_total counter")
+	for _, k := range sortedLabels(m.requests) {
+		fmt.Fprintf(cw, "etcdcli_requests_total{op=%q,code=%q} %d\n", k[0], k[1], m.requests[k])
+	}
+
+	fmt.Fprintln(cw, "# HELP etcdcli_request_duration_seconds Request latency by operation.")
+	fmt.Fprintln(cw, "# TYPE etcdcli_request_duration_seconds histogram")
+	ops := make([]string, 0, len(m.durations))
+	for op := range m.durations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		h := m.durations[op]
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(cw, "etcdcli_request_duration_seconds_bucket{op=%q,le=%q} %d\n", op, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(cw, "etcdcli_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(cw, "etcdcli_request_duration_seconds_sum{op=%q} %s\n", op, formatFloat(h.sum))
+		fmt.Fprintf(cw, "etcdcli_request_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+
+	fmt.Fprintln(cw, "# HELP etcdcli_requests_in_flight Requests to etcd running now.")
+	fmt.Fprintln(cw, "# TYPE etcdcli_requests_in_flight gauge")
+	ops = ops[:0]
+	for op := range m.inFlight {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Fprintf(cw, "etcdcli_requests_in_flight{op=%q} %d\n", op, m.inFlight[op])
+	}
+
+	fmt.Fprintln(cw, "# HELP etcdcli_watches_active Watches running now.")
+	fmt.Fprintln(cw, "# TYPE etcdcli_watches_active gauge")
+	fmt.Fprintf(cw, "etcdcli_watches_active %d\n", m.watches)
+
+	fmt.Fprintln(cw, "# HELP etcdcli_watch_reconnects_total Watches started again after an error.")
+	fmt.Fprintln(cw, "# TYPE etcdcli_watch_reconnects_total counter")
+	fmt.Fprintf(cw, "etcdcli_watch_reconnects_total %d\n", m.reconnects)
+
+	fmt.Fprintln(cw, "# HELP etcdcli_throttled_total Requests held back by the client limits.")
+	fmt.Fprintln(cw, "# TYPE etcdcli_throttled_total counter")
+	for _, k := range sortedLabels(m.throttles) {
+		fmt.Fprintf(cw, "etcdcli_throttled_total{class=%q,result=%q} %d\n", k[0], k[1], m.throttles[k])
+	}
+	return cw.n, cw.err
+}
+
+func sortedLabels(counters map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// ServeHTTP serves the metrics for a prometheus scrape, nothing for a nil
+// *Metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// instrumentedBackend records every call into metrics.
+type instrumentedBackend struct {
+	next    Backend
+	metrics *Metrics
+}
+
+func (b *instrumentedBackend) Unwrap() Backend {
+	return b.next
+}
+
+func (b *instrumentedBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	op := getOp(opts)
+	start := b.metrics.start(op)
+	resp, err := b.next.Get(ctx, key, opts)
+	b.metrics.done(op, start, err)
+	return resp, err
+}
+
+func (b *instrumentedBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	op := setOp(opts)
+	start := b.metrics.start(op)
+	resp, err := b.next.Set(ctx, key, value, opts)
+	b.metrics.done(op, start, err)
+	return resp, err
+}
+
+func (b *instrumentedBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	op := deleteOp(opts)
+	start := b.metrics.start(op)
+	resp, err := b.next.Delete(ctx, key, opts)
+	b.metrics.done(op, start, err)
+	return resp, err
+}
+
+func (b *instrumentedBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	start := b.metrics.start("create_in_order")
+	resp, err := b.next.CreateInOrder(ctx, dir, value, opts)
+	b.metrics.done("create_in_order", start, err)
+	return resp, err
+}
+
+func (b *instrumentedBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	return &instrumentedWatcher{next: b.next.Watcher(key, opts), metrics: b.metrics}
+}
+
+type instrumentedWatcher struct {
+	next    etcdv2.Watcher
+	metrics *Metrics
+}
+
+func (w *instrumentedWatcher) Next(ctx context.Context) (*etcdv2.Response, error) {
+	start := w.metrics.start("watch")
+	resp, err := w.next.Next(ctx)
+	w.metrics.done("watch", start, err)
+	return resp, err
+}
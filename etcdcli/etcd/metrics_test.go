@@ -0,0 +1,116 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	c, err := NewClientWithConfig(Config{Backend: NewMemoryBackend(), Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Set("/a", "1", 0, "", 0)
+	c.Set("/a", "2", 0, "1", 0)
+	c.Get("/a")
+	c.Get("/missing")
+	c.List("/", true)
+
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`etcdcli_requests_total{op="set",code="ok"} 1`,
+		`etcdcli_requests_total{op="cas",code="ok"} 1`,
+		`etcdcli_requests_total{op="get",code="ok"} 1`,
+		`etcdcli_requests_total{op="get",code="100"} 1`,
+		`etcdcli_requests_total{op="list",code="ok"} 1`,
+		`etcdcli_request_duration_seconds_bucket{op="get",le="+Inf"} 2`,
+		`etcdcli_request_duration_seconds_count{op="get"} 2`,
+		`etcdcli_requests_in_flight{op="get"} 0`,
+		`etcdcli_watches_active 0`,
+		`etcdcli_watch_reconnects_total 0`,
+		`# TYPE etcdcli_request_duration_seconds histogram`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != out || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("served %q, %q", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	var buf bytes.Buffer
+	if n, err := m.WriteTo(&buf); n != 0 || err != nil {
+		t.Errorf("WriteTo on nil: %d, %v", n, err)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.Len() != 0 {
+		t.Errorf("ServeHTTP on nil served %q", rec.Body.String())
+	}
+}
+
+func TestWatchReconnectsAfterIndexCleared(t *testing.T) {
+	b := NewMemoryV2Backend()
+	m := NewMetrics()
+	c, err := NewClientWithConfig(Config{Backend: b, Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Watch("/w", true, func(action, key, value string) bool {
+			if key == "/w/first" {
+				// fall behind the history the store keeps
+				for i := 0; i <= memoryV2HistorySize; i++ {
+					b.Set(ctx, "/w/filler", fmt.Sprint(i), nil)
+				}
+			}
+			return key == "/w/last"
+		})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	b.Set(ctx, "/w/first", "1", nil)
+	// written until the new watch sees it, the writes before it started
+	// are lost with the cleared index
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			m.WriteTo(&buf)
+			if !strings.Contains(buf.String(), "etcdcli_watch_reconnects_total 1\n") {
+				t.Errorf("reconnect not counted:\n%s", buf.String())
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+			b.Set(ctx, "/w/last", "1", nil)
+		case <-deadline:
+			t.Fatal("watch did not come back after the index was cleared")
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+type MigrateOptions struct {
+	// Prefix is the v2 subtree to migrate.
+	Prefix string
+	// Separator joins the path segments of a v2 key into a flat v3 key,
+	// "/" by default.
+	Separator string
+	// DestPrefix is put in front of every v3 key, joined with Separator:
+	// /app/db/host becomes DestPrefix + "/app/db/host" with the defaults, or
+	// "cfg.app.db.host" with DestPrefix "cfg" and Separator ".".
+	DestPrefix string
+	// LeaseGranularity groups keys whose expirations fall in the same window
+	// under one lease, 1s by default. Expirations are rounded up.
+	LeaseGranularity time.Duration
+}
+
+// MigrateReport describes a completed copy.
+type MigrateReport struct {
+	// Index is the v2 index of the snapshot; Follow from it to catch up.
+	Index uint64
+	Keys  int
+	// Dirs counts v2 directories; they only survive as key prefixes.
+	Dirs   int
+	Leases int
+	// Checksum is the sha256 of the migrated keys and values, equal on both
+	// sides once verified.
+	Checksum string
+}
+
+// Migration copies a v2 subtree into flat v3 keys and can keep replaying
+// v2 changes until the cutover.
+type Migration struct {
+	src  *Client
+	dst  V3Client
+	opts MigrateOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMigration(src *Client, dst V3Client, opts MigrateOptions) *Migration {
+	if opts.Separator == "" {
+		opts.Separator = "/"
+	}
+	if opts.LeaseGranularity <= 0 {
+		opts.LeaseGranularity = time.Second
+	}
+	m := &Migration{src: src, dst: dst, opts: opts}
+	m.ctx, m.cancel = context.WithCancel(src.ctx)
+	return m
+}
+
+// Key returns the v3 key a v2 key is migrated to. Run and Follow reject v2
+// keys with a segment containing Separator: /a.b/c and /a/b.c would both
+// become .a.b.c with Separator ".".
+func (m *Migration) Key(v2key string) string {
+	segments := strings.Split(strings.Trim(v2key, "/"), "/")
+	return m.opts.DestPrefix + m.opts.Separator + strings.Join(segments, m.opts.Separator)
+}
+
+// key is Key for a key to write, failing where it could collide.
+func (m *Migration) key(v2key string) (string, error) {
+	for _, segment := range etcdpath.Split(v2key) {
+		if strings.Contains(segment, m.opts.Separator) {
+			return "", fmt.Errorf("migrate: %s: segment %q contains the separator %q", v2key, segment, m.opts.Separator)
+		}
+	}
+	return m.Key(v2key), nil
+}
+
+// maxTxnOps stays well below the server's default limit of 128.
+const maxTxnOps = 64
+
+// Run copies the subtree and verifies counts and checksum: the v3 keys
+// under the destination must be exactly the migrated ones.
+func (m *Migration) Run() (*MigrateReport, error) {
+	return m.run(false)
+}
+
+// run is Run; with prune it first deletes the destination keys the v2
+// subtree no longer has, instead of failing the verification on them.
+func (m *Migration) run(prune bool) (*MigrateReport, error) {
+	d, err := m.src.snapshot(m.opts.Prefix, false)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrateReport{Index: d.ClusterIndex}
+	leases := make(map[time.Time]int64)
+	want := make(map[string]string)
+	var ops []V3Op
+	for _, node := range d.Nodes {
+		if node.Dir {
+			report.Dirs++
+			continue
+		}
+
+		key, err := m.key(node.Key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := want[key]; ok {
+			return nil, fmt.Errorf("migrate: %s and another key both become %s", node.Key, key)
+		}
+		op := V3Op{Key: key, Value: node.Value}
+		if node.Expiration != nil {
+			expiry := node.Expiration.Truncate(m.opts.LeaseGranularity)
+			if expiry.Before(*node.Expiration) {
+				expiry = expiry.Add(m.opts.LeaseGranularity)
+			}
+			lease, ok := leases[expiry]
+			if !ok {
+				ttl := int64((time.Until(expiry) + time.Second - 1) / time.Second)
+				if ttl <= 0 {
+					// expired while we were copying
+					continue
+				}
+				if lease, err = m.grant(ttl); err != nil {
+					return nil, err
+				}
+				leases[expiry] = lease
+			}
+			op.Lease = lease
+		}
+		want[op.Key] = op.Value
+		ops = append(ops, op)
+	}
+	report.Keys = len(ops)
+	report.Leases = len(leases)
+
+	if prune {
+		kvs, err := m.destKeys()
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			if _, ok := want[kv.Key]; !ok {
+				ops = append(ops, V3Op{Key: kv.Key, Delete: true})
+			}
+		}
+	}
+
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		if err := m.txn(ops[:n]); err != nil {
+			return nil, err
+		}
+		ops = ops[n:]
+	}
+
+	report.Checksum = checksum(want)
+	if err := m.verify(want, report.Checksum); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (m *Migration) grant(ttl int64) (int64, error) {
+	ctx, cancel := m.src.newContextWithTimeout()
+	defer cancel()
+	return m.dst.Grant(ctx, ttl)
+}
+
+func (m *Migration) txn(ops []V3Op) error {
+	ctx, cancel := m.src.newContextWithTimeout()
+	defer cancel()
+	_, _, err := m.dst.Txn(ctx, nil, ops)
+	return err
+}
+
+// destKeys returns the v3 keys the subtree maps to: the key of the prefix
+// and the keys below it.
+func (m *Migration) destKeys() ([]V3KeyValue, error) {
+	ctx, cancel := m.src.newContextWithTimeout()
+	defer cancel()
+	base := m.Key(m.opts.Prefix)
+	kvs, _, err := m.dst.Range(ctx, base, true)
+	if err != nil {
+		return nil, err
+	}
+	below := base
+	if !strings.HasSuffix(below, m.opts.Separator) {
+		below += m.opts.Separator
+	}
+	var keys []V3KeyValue
+	for _, kv := range kvs {
+		if kv.Key == base || strings.HasPrefix(kv.Key, below) {
+			keys = append(keys, kv)
+		}
+	}
+	return keys, nil
+}
+
+// verify reads the migrated keys back from v3.
+func (m *Migration) verify(want map[string]string, sum string) error {
+	kvs, err := m.destKeys()
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+
+	got := make(map[string]string, len(want))
+	for _, kv := range kvs {
+		if _, ok := want[kv.Key]; !ok {
+			return fmt.Errorf("verify: %s is in v3 but not in v2", kv.Key)
+		}
+		got[kv.Key] = kv.Value
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("verify: %d of %d keys found in v3", len(got), len(want))
+	}
+	if gotSum := checksum(got); gotSum != sum {
+		return fmt.Errorf("verify: checksum mismatch, v2 %s v3 %s", sum, gotSum)
+	}
+	return nil
+}
+
+func checksum(kvs map[string]string) string {
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s\x00%s\x00", k, kvs[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Follow replays v2 changes made after index until Stop is called, so the
+// v3 copy stays current until the cutover. A cleared index triggers a new
+// Run that also deletes the v3 keys of v2 keys removed meanwhile.
+func (m *Migration) Follow(index uint64) error {
+	for {
+		var applyErr error
+		err := m.src.watchFrom(m.ctx, m.opts.Prefix, true, index, func(resp *etcdv2.Response) bool {
+			if applyErr = m.apply(resp); applyErr != nil {
+				return true
+			}
+			index = resp.Node.ModifiedIndex
+			return false
+		})
+		if applyErr != nil {
+			return applyErr
+		}
+
+		switch {
+		case m.ctx.Err() != nil:
+			return nil
+		case IsEtcdWatchExpired(err):
+			report, err := m.run(true)
+			if err != nil {
+				return err
+			}
+			index = report.Index
+			m.src.metrics.watchReconnected()
+		default:
+			return err
+		}
+	}
+}
+
+// Stop makes Follow return.
+func (m *Migration) Stop() {
+	m.cancel()
+}
+
+func (m *Migration) apply(resp *etcdv2.Response) error {
+	node := resp.Node
+	key, err := m.key(node.Key)
+	if err != nil {
+		return err
+	}
+	switch resp.Action {
+	case "delete", "compareAndDelete", "expire":
+		if node.Dir {
+			return m.txn([]V3Op{{Key: key + m.opts.Separator, Delete: true, Prefix: true}})
+		}
+		return m.txn([]V3Op{{Key: key, Delete: true}})
+	}
+
+	if node.Dir {
+		return nil
+	}
+	op := V3Op{Key: key, Value: node.Value}
+	if node.TTL > 0 {
+		lease, err := m.grant(node.TTL)
+		if err != nil {
+			return err
+		}
+		op.Lease = lease
+	}
+	return m.txn([]V3Op{op})
+}
@@ -0,0 +1,160 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMigrationTest returns a v2 client with a few keys under /app and an
+// empty v3 store.
+func newMigrationTest(t *testing.T) (*Client, *MemoryV3Client) {
+	src, err := NewClientWithConfig(Config{Backend: NewMemoryV2Backend()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Close() })
+	src.Set("/app/a", "1", 0, "", 0)
+	src.Set("/app/d/b", "2", 0, "", 0)
+	src.Set("/app/t1", "x", 100, "", 0)
+	src.Set("/app/t2", "y", 100, "", 0)
+	src.MKDir("/app/e", 0)
+	src.Set("/other", "o", 0, "", 0)
+	return src, NewMemoryV3Client()
+}
+
+func v3Get(t *testing.T, kv V3Client, key string) (V3KeyValue, bool) {
+	kvs, _, err := kv.Range(context.Background(), key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) == 0 {
+		return V3KeyValue{}, false
+	}
+	return kvs[0], true
+}
+
+func TestMigration(t *testing.T) {
+	src, dst := newMigrationTest(t)
+	m := NewMigration(src, dst, MigrateOptions{Prefix: "/app", Separator: ".", DestPrefix: "cfg", LeaseGranularity: time.Hour})
+	report, err := m.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 4 || report.Dirs != 3 || report.Leases != 1 || report.Index == 0 {
+		t.Errorf("report %+v", report)
+	}
+	want := map[string]string{"cfg.app.a": "1", "cfg.app.d.b": "2", "cfg.app.t1": "x", "cfg.app.t2": "y"}
+	if report.Checksum != checksum(want) {
+		t.Errorf("checksum %s", report.Checksum)
+	}
+	for key, value := range want {
+		if kv, _ := v3Get(t, dst, key); kv.Value != value {
+			t.Errorf("%s = %q, want %q", key, kv.Value, value)
+		}
+	}
+	if _, ok := v3Get(t, dst, "cfg.other"); ok {
+		t.Error("key outside the prefix migrated")
+	}
+
+	// keys expiring in the same window share a lease that outlives them
+	t1, _ := v3Get(t, dst, "cfg.app.t1")
+	t2, _ := v3Get(t, dst, "cfg.app.t2")
+	if t1.Lease == 0 || t1.Lease != t2.Lease {
+		t.Errorf("leases %d and %d", t1.Lease, t2.Lease)
+	}
+	if ttl, _ := dst.TimeToLive(context.Background(), t1.Lease); ttl < 100 {
+		t.Errorf("lease ttl %d", ttl)
+	}
+	if m.Key("/app/d/b") != "cfg.app.d.b" || NewMigration(src, dst, MigrateOptions{}).Key("/app/d/b") != "/app/d/b" {
+		t.Error("key mapping")
+	}
+}
+
+func TestMigrationBatches(t *testing.T) {
+	src, dst := newMigrationTest(t)
+	for i := 0; i < 3*maxTxnOps; i++ {
+		src.Set(fmt.Sprintf("/app/many/%03d", i), "v", 0, "", 0)
+	}
+	report, err := NewMigration(src, dst, MigrateOptions{Prefix: "/app"}).Run()
+	if err != nil || report.Keys != 4+3*maxTxnOps {
+		t.Fatalf("report %+v: %v", report, err)
+	}
+	if kv, _ := v3Get(t, dst, "/app/many/191"); kv.Value != "v" {
+		t.Errorf("last key %+v", kv)
+	}
+}
+
+func TestMigrationVerify(t *testing.T) {
+	src, dst := newMigrationTest(t)
+	opts := MigrateOptions{Prefix: "/app", Separator: ".", DestPrefix: "cfg"}
+
+	// both become cfg.app.a.b.c
+	src.Set("/app/a.b/c", "1", 0, "", 0)
+	src.Set("/app/a/b.c", "2", 0, "", 0)
+	if _, err := NewMigration(src, dst, opts).Run(); err == nil || !strings.Contains(err.Error(), "contains the separator") {
+		t.Errorf("colliding keys: %v", err)
+	}
+	src.RM("/app/a.b", true, true, "", 0)
+	src.RM("/app/a", true, true, "", 0)
+
+	// keys the v2 subtree does not have fail the verification, keys that
+	// only share the first bytes of the prefix are not counted
+	dst.Txn(context.Background(), nil, []V3Op{{Key: "cfg.apple", Value: "x"}, {Key: "cfg.app.stale", Value: "x"}})
+	if _, err := NewMigration(src, dst, opts).Run(); err == nil || !strings.Contains(err.Error(), "cfg.app.stale") {
+		t.Errorf("extra key: %v", err)
+	}
+	dst.Txn(context.Background(), nil, []V3Op{{Key: "cfg.app.stale", Delete: true}})
+	if _, err := NewMigration(src, dst, opts).Run(); err != nil {
+		t.Errorf("run next to cfg.apple: %v", err)
+	}
+}
+
+func TestMigrationFollow(t *testing.T) {
+	src, dst := newMigrationTest(t)
+	m := NewMigration(src, dst, MigrateOptions{Prefix: "/app"})
+	report, err := m.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- m.Follow(report.Index) }()
+	src.Set("/app/a", "changed", 0, "", 0)
+	src.Set("/app/new", "n", 60, "", 0)
+	src.RM("/app/d", true, true, "", 0)
+	eventually(t, "changes replayed", func() bool {
+		a, _ := v3Get(t, dst, "/app/a")
+		n, _ := v3Get(t, dst, "/app/new")
+		_, b := v3Get(t, dst, "/app/d/b")
+		return a.Value == "changed" && n.Value == "n" && n.Lease != 0 && !b
+	})
+	m.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the history is gone: a new run brings v3 back in line, deletes
+	// included
+	src.RM("/app/t1", false, false, "", 0)
+	for i := 0; i <= memoryV2HistorySize; i++ {
+		src.Set("/noise", "n", 0, "", 0)
+	}
+	m = NewMigration(src, dst, MigrateOptions{Prefix: "/app"})
+	go func() { done <- m.Follow(report.Index) }()
+	eventually(t, "resync", func() bool {
+		_, ok := v3Get(t, dst, "/app/t1")
+		return !ok
+	})
+	src.Set("/app/after", "1", 0, "", 0)
+	eventually(t, "following after the resync", func() bool {
+		kv, _ := v3Get(t, dst, "/app/after")
+		return kv.Value == "1"
+	})
+	m.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
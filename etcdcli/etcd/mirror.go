@@ -0,0 +1,204 @@
+package etcd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// Mirror keeps a prefix of a destination cluster in sync with a prefix of a
+// source cluster: an initial recursive copy, then every set, delete and
+// expire event is replayed from the snapshot index on.
+type Mirror struct {
+	src       *Client
+	dst       *Client
+	srcPrefix string
+	dstPrefix string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// retryDelay is the wait between two failed attempts
+	retryDelay time.Duration
+
+	mu    sync.Mutex
+	stats MirrorStats
+}
+
+// MirrorStats reports how far behind the destination is.
+type MirrorStats struct {
+	// AppliedIndex is the source index of the last event written to the
+	// destination, SourceIndex the highest source index seen so far.
+	AppliedIndex uint64
+	SourceIndex  uint64
+	// LastApplied is when AppliedIndex was written.
+	LastApplied time.Time
+	Events      uint64
+	Resyncs     uint64
+	Errors      uint64
+}
+
+// IndexLag is the number of source revisions not yet applied.
+func (s MirrorStats) IndexLag() uint64 {
+	if s.SourceIndex < s.AppliedIndex {
+		return 0
+	}
+	return s.SourceIndex - s.AppliedIndex
+}
+
+// NewMirror mirrors srcPrefix on src to dstPrefix on dst. An empty dstPrefix
+// keeps the source keys.
+func NewMirror(src *Client, dst *Client, srcPrefix string, dstPrefix string) *Mirror {
+	m := &Mirror{src: src, dst: dst, srcPrefix: srcPrefix, dstPrefix: dstPrefix, retryDelay: time.Second}
+	m.ctx, m.cancel = context.WithCancel(src.ctx)
+	return m
+}
+
+// Stats returns a copy of the current counters.
+func (m *Mirror) Stats() MirrorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// Stop makes Run return.
+func (m *Mirror) Stop() {
+	m.cancel()
+}
+
+// Run copies the prefix and replays changes until Stop is called or the
+// source client is closed. Unreachable clusters are retried with backoff;
+// a cleared event index triggers a full resync.
+func (m *Mirror) Run() error {
+	index, err := m.resyncRetrying()
+	if err != nil || m.ctx.Err() != nil {
+		return err
+	}
+
+	for {
+		var applyErr error
+		err := m.src.watchFrom(m.ctx, m.srcPrefix, true, index, func(resp *etcdv2.Response) bool {
+			if applyErr = m.apply(resp); applyErr != nil {
+				return true
+			}
+			index = resp.Node.ModifiedIndex
+			return false
+		})
+		if applyErr != nil {
+			// watch again from the last applied index
+			err = applyErr
+		}
+
+		switch {
+		case m.ctx.Err() != nil:
+			return nil
+		case IsEtcdWatchExpired(err):
+			// the events since index are gone, watching from anything but a
+			// new snapshot would lose them
+			if index, err = m.resyncRetrying(); err != nil {
+				return err
+			}
+		default:
+			if err = m.backoff(err); err != nil {
+				return err
+			}
+		}
+		m.src.metrics.watchReconnected()
+	}
+}
+
+// backoff waits a little before the next attempt. It returns nil to retry or
+// the error when it is not worth retrying.
+func (m *Mirror) backoff(err error) error {
+	m.countError()
+	if m.ctx.Err() != nil {
+		return nil
+	}
+	if code := ErrorCode(err); code != 0 && code != etcdv2.ErrorCodeEventIndexCleared && code != etcdv2.ErrorCodeRaftInternal && code != etcdv2.ErrorCodeLeaderElect {
+		m.src.logger.Log(LevelError, "mirror stopped", Field{"key", m.srcPrefix}, Field{"code", code}, Field{"error", err.Error()})
+		return err
+	}
+	m.src.logger.Log(LevelWarn, "mirror failed, retrying", Field{"key", m.srcPrefix}, Field{"code", errorLabel(err)}, Field{"error", err.Error()})
+	select {
+	case <-time.After(m.retryDelay):
+	case <-m.ctx.Done():
+	}
+	return nil
+}
+
+// resyncRetrying is resync retried with backoff until it succeeds, Stop is
+// called or the error is not worth retrying.
+func (m *Mirror) resyncRetrying() (uint64, error) {
+	index, err := m.resync()
+	for err != nil {
+		if err = m.backoff(err); err != nil || m.ctx.Err() != nil {
+			return 0, err
+		}
+		index, err = m.resync()
+	}
+	return index, nil
+}
+
+// resync copies the whole prefix again, removing destination keys that are
+// gone from the source, and returns the index to watch from.
+func (m *Mirror) resync() (uint64, error) {
+	d, err := m.src.snapshot(m.srcPrefix, false)
+	if err != nil {
+		return 0, err
+	}
+	_, err = m.dst.ImportDump(d, ImportOptions{Mode: ImportMirror, Prefix: m.dstPrefix, PreserveTTL: true, Parallel: 4})
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	m.stats.Resyncs++
+	m.stats.AppliedIndex = d.ClusterIndex
+	if d.ClusterIndex > m.stats.SourceIndex {
+		m.stats.SourceIndex = d.ClusterIndex
+	}
+	m.stats.LastApplied = time.Now()
+	m.mu.Unlock()
+	return d.ClusterIndex, nil
+}
+
+func (m *Mirror) apply(resp *etcdv2.Response) error {
+	m.mu.Lock()
+	if resp.Index > m.stats.SourceIndex {
+		m.stats.SourceIndex = resp.Index
+	}
+	if resp.Node.ModifiedIndex > m.stats.SourceIndex {
+		m.stats.SourceIndex = resp.Node.ModifiedIndex
+	}
+	m.mu.Unlock()
+
+	node := resp.Node
+	key := rerootKey(node.Key, m.srcPrefix, m.dstPrefix)
+	var err error
+	switch resp.Action {
+	case "delete", "compareAndDelete", "expire":
+		err = m.dst.importDelete(DumpNode{Key: key, Dir: node.Dir})
+		if IsEtcdNotFound(err) {
+			err = nil
+		}
+	default:
+		err = m.dst.importWrite(importStep{node: DumpNode{Key: key, Dir: node.Dir, Value: node.Value, TTL: node.TTL}})
+	}
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.stats.Events++
+	m.stats.AppliedIndex = node.ModifiedIndex
+	m.stats.LastApplied = time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Mirror) countError() {
+	m.mu.Lock()
+	m.stats.Errors++
+	m.mu.Unlock()
+}
@@ -0,0 +1,172 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// eventually fails the test when cond does not hold within 5s.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: timed out", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// runMirror starts m and stops it with the test, checking Run returns nil.
+func runMirror(t *testing.T, m *Mirror) {
+	done := make(chan error, 1)
+	go func() { done <- m.Run() }()
+	t.Cleanup(func() {
+		m.Stop()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("mirror stopped with %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("mirror still running after Stop")
+		}
+	})
+}
+
+func TestMirror(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			src, err := NewClientWithConfig(Config{Backend: backend.new()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			dst := newTestClient(t)
+			src.Set("/cfg/a", "1", 0, "", 0)
+			src.Set("/cfg/d/b", "2", 0, "", 0)
+			dst.Set("/copy/stale", "s", 0, "", 0)
+
+			m := NewMirror(src, dst, "/cfg", "/copy")
+			runMirror(t, m)
+			eventually(t, "initial copy", func() bool {
+				v, _ := dst.Get("/copy/d/b")
+				return v == "2"
+			})
+			if _, err := dst.Get("/copy/stale"); !IsEtcdNotFound(err) {
+				t.Errorf("key missing from the source kept: %v", err)
+			}
+
+			src.Set("/cfg/a", "changed", 0, "", 0)
+			src.Set("/cfg/ttl", "t", 1, "", 0)
+			src.RM("/cfg/d", true, true, "", 0)
+			src.Set("/other", "o", 0, "", 0)
+			eventually(t, "events", func() bool {
+				v, _ := dst.Get("/copy/a")
+				_, err := dst.GetResonse("/copy/d", false, false)
+				return v == "changed" && IsEtcdNotFound(err)
+			})
+			if v, _ := dst.Get("/copy/ttl"); v != "t" {
+				t.Errorf("ttl key %q", v)
+			}
+			eventually(t, "expire", func() bool {
+				_, err := dst.Get("/copy/ttl")
+				return IsEtcdNotFound(err)
+			})
+			if _, err := dst.Get("/other"); !IsEtcdNotFound(err) {
+				t.Errorf("key outside the prefix mirrored: %v", err)
+			}
+
+			stats := m.Stats()
+			if stats.Resyncs != 1 || stats.Events < 4 || stats.IndexLag() != 0 || stats.LastApplied.IsZero() {
+				t.Errorf("stats %+v", stats)
+			}
+		})
+	}
+}
+
+// compactingBackend writes two source keys and compacts the source once,
+// on the first write to the destination, then fails the next fail writes.
+type compactingBackend struct {
+	Backend
+	src *Client
+	v3  *MemoryV3Client
+
+	mu      sync.Mutex
+	written bool
+	fail    int
+}
+
+func (b *compactingBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	if strings.HasPrefix(key, "/cfg/") {
+		b.mu.Lock()
+		written, fail := b.written, b.fail > 0
+		switch {
+		case !written:
+			b.written = true
+			b.src.Set("/cfg/late1", "1", 0, "", 0)
+			b.src.Set("/cfg/late2", "2", 0, "", 0)
+			resp, _ := b.src.GetResonse("/cfg/late2", false, false)
+			b.v3.Compact(int64(resp.Index))
+		case fail:
+			b.fail--
+		}
+		b.mu.Unlock()
+		if written && fail {
+			return nil, errors.New("destination unavailable")
+		}
+	}
+	return b.Backend.Set(ctx, key, value, opts)
+}
+
+func TestMirrorResync(t *testing.T) {
+	for _, fail := range []int{0, 2} {
+		v3 := NewMemoryV3Client()
+		src, err := NewClientWithConfig(Config{Backend: NewV3Backend(v3)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		b := &compactingBackend{Backend: NewMemoryBackend(), src: src, v3: v3, fail: fail}
+		dst, err := NewClientWithConfig(Config{Backend: b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+		src.Set("/cfg/a", "1", 0, "", 0)
+
+		// the writes after the snapshot are compacted before the watch
+		// starts, the resync that brings them fails fail times
+		m := NewMirror(src, dst, "/cfg", "")
+		m.retryDelay = 10 * time.Millisecond
+		runMirror(t, m)
+		eventually(t, "resync", func() bool {
+			v1, _ := dst.Get("/cfg/late1")
+			v2, _ := dst.Get("/cfg/late2")
+			return v1 == "1" && v2 == "2" && m.Stats().Resyncs == 2
+		})
+		if stats := m.Stats(); (stats.Errors == 0) != (fail == 0) || stats.IndexLag() != 0 {
+			t.Errorf("%d failures: stats %+v", fail, stats)
+		}
+	}
+}
+
+func TestMirrorStatsIndexLag(t *testing.T) {
+	for _, tt := range []struct {
+		stats MirrorStats
+		lag   uint64
+	}{
+		{MirrorStats{AppliedIndex: 5, SourceIndex: 9}, 4},
+		{MirrorStats{AppliedIndex: 9, SourceIndex: 9}, 0},
+		{MirrorStats{AppliedIndex: 9, SourceIndex: 5}, 0},
+	} {
+		if lag := tt.stats.IndexLag(); lag != tt.lag {
+			t.Errorf("%+v: lag %d, want %d", tt.stats, lag, tt.lag)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// ErrOutsideNamespace is returned for a key of a namespaced client with a
+// ".." segment, whether or not it would really leave the namespace.
+var ErrOutsideNamespace = errors.New("etcd: key must not contain \"..\" in a namespace")
+
+// WithNamespace returns a view of c that puts prefix in front of every key
+// it sends and takes it off every key it returns, in nodes, previous nodes,
+// watch events and error causes. Views nest: WithNamespace("/a") then
+// WithNamespace("/b") works under /a/b.
+//
+// The view shares the connection of c, closing it does nothing. V3 and
+// Members are not namespaced.
+func (c *Client) WithNamespace(prefix string) *Client {
+	v := c.view()
+	v.backend = &namespacedBackend{next: c.backend, prefix: etcdpath.Clean(prefix)}
+	return v
+}
+
+type namespacedBackend struct {
+	next   Backend
+	prefix string
+}
+
+func (b *namespacedBackend) Unwrap() Backend {
+	return b.next
+}
+
+// key returns the key to send for key.
+func (b *namespacedBackend) key(key string) (string, error) {
+	for _, segment := range etcdpath.Split(key) {
+		if segment == ".." {
+			return "", ErrOutsideNamespace
+		}
+	}
+	return etcdpath.Join(b.prefix, key), nil
+}
+
+func (b *namespacedBackend) strip(key string) string {
+	if b.prefix == "/" {
+		return key
+	}
+	if key == b.prefix {
+		return "/"
+	}
+	if strings.HasPrefix(key, b.prefix+"/") {
+		return key[len(b.prefix):]
+	}
+	return key
+}
+
+func (b *namespacedBackend) stripNode(node *etcdv2.Node) {
+	walkNodes(node, func(n *etcdv2.Node) {
+		n.Key = b.strip(n.Key)
+	})
+}
+
+func (b *namespacedBackend) response(resp *etcdv2.Response, err error) (*etcdv2.Response, error) {
+	if resp != nil {
+		b.stripNode(resp.Node)
+		b.stripNode(resp.PrevNode)
+	}
+	if e, ok := err.(etcdv2.Error); ok {
+		e.Cause = b.strip(e.Cause)
+		err = e
+	}
+	return resp, err
+}
+
+func (b *namespacedBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.response(b.next.Get(ctx, key, opts))
+}
+
+func (b *namespacedBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.response(b.next.Set(ctx, key, value, opts))
+}
+
+func (b *namespacedBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	key, err := b.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.response(b.next.Delete(ctx, key, opts))
+}
+
+func (b *namespacedBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	dir, err := b.key(dir)
+	if err != nil {
+		return nil, err
+	}
+	return b.response(b.next.CreateInOrder(ctx, dir, value, opts))
+}
+
+func (b *namespacedBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	key, err := b.key(key)
+	if err != nil {
+		return WatcherFunc(func(context.Context) (*etcdv2.Response, error) {
+			return nil, err
+		})
+	}
+	next := b.next.Watcher(key, opts)
+	return WatcherFunc(func(ctx context.Context) (*etcdv2.Response, error) {
+		return b.response(next.Next(ctx))
+	})
+}
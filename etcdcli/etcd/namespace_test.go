@@ -0,0 +1,101 @@
+package etcd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func TestNamespace(t *testing.T) {
+	c := newTestClient(t)
+	ns := c.WithNamespace("tenant").WithNamespace("/app/")
+
+	if err := ns.Set("/a", "1", 0, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	ns.Set("d/b", "2", 0, "", 0)
+	if v, _ := c.Get("/tenant/app/a"); v != "1" {
+		t.Errorf("stored under the namespace %q", v)
+	}
+	if v, _ := ns.Get("/a"); v != "1" {
+		t.Errorf("read back %q", v)
+	}
+	if keys, _ := ns.List("/", true); !reflect.DeepEqual(keys, []string{"/a", "/d", "/d/b"}) {
+		t.Errorf("keys %v", keys)
+	}
+
+	resp, err := ns.GetResonse("/", true, true)
+	if err != nil || resp.Node.Key != "/" {
+		t.Fatalf("root %+v: %v", resp, err)
+	}
+	if err := ns.Set("/a", "3", 0, "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.MK("/q", "x", 0, true); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := ns.List("/q", false); len(keys) != 1 || keys[0][:3] != "/q/" {
+		t.Errorf("in order keys %v", keys)
+	}
+
+	// errors name the key as the view knows it
+	_, err = ns.Get("/missing")
+	if e, ok := err.(etcdv2.Error); !ok || e.Cause != "/missing" {
+		t.Errorf("error %#v", err)
+	}
+	for _, key := range []string{"/../x", "/d/../../x", ".."} {
+		if _, err := ns.Get(key); err != ErrOutsideNamespace {
+			t.Errorf("get %s: %v", key, err)
+		}
+		if err := ns.Set(key, "x", 0, "", 0); err != ErrOutsideNamespace {
+			t.Errorf("set %s: %v", key, err)
+		}
+	}
+	if keys, _ := c.List("/", false); !reflect.DeepEqual(keys, []string{"/tenant"}) {
+		t.Errorf("keys outside the namespace %v", keys)
+	}
+}
+
+func TestNamespaceWatch(t *testing.T) {
+	c := newTestClient(t)
+	ns := c.WithNamespace("/tenant")
+
+	got := make(chan *etcdv2.Response, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- ns.WatchFrom("/d", true, 0, func(resp *etcdv2.Response) bool {
+			got <- resp
+			return true
+		})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Set("/d/x", "outside", 0, "", 0)
+	c.Set("/tenant/d/x", "1", 0, "", 0)
+	c.Set("/tenant/d/x", "2", 0, "", 0)
+
+	select {
+	case resp := <-got:
+		if resp.Node.Key != "/d/x" || resp.Node.Value != "1" {
+			t.Errorf("event %s %+v", resp.Action, resp.Node)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	// replay the second write, with its previous node
+	last, err := ns.GetResonse("/d/x", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.WatchFrom("/d/x", false, last.Node.ModifiedIndex-1, func(resp *etcdv2.Response) bool {
+		if resp.Node.Key != "/d/x" || resp.PrevNode == nil || resp.PrevNode.Key != "/d/x" || resp.PrevNode.Value != "1" {
+			t.Errorf("replayed %+v, previous %+v", resp.Node, resp.PrevNode)
+		}
+		return true
+	})
+}
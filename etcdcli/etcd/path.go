@@ -0,0 +1,67 @@
+package etcd
+
+import (
+	"context"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// pathBackend cleans every key with etcdpath.Clean and rejects the ones
+// etcdpath.Validate does not accept, before they reach the cluster.
+type pathBackend struct {
+	next Backend
+}
+
+func (b *pathBackend) Unwrap() Backend {
+	return b.next
+}
+
+func checkKey(key string) (string, error) {
+	if err := etcdpath.Validate(key); err != nil {
+		return "", err
+	}
+	return etcdpath.Clean(key), nil
+}
+
+func (b *pathBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	key, err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.next.Get(ctx, key, opts)
+}
+
+func (b *pathBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	key, err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.next.Set(ctx, key, value, opts)
+}
+
+func (b *pathBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	key, err := checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.next.Delete(ctx, key, opts)
+}
+
+func (b *pathBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	dir, err := checkKey(dir)
+	if err != nil {
+		return nil, err
+	}
+	return b.next.CreateInOrder(ctx, dir, value, opts)
+}
+
+func (b *pathBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	key, err := checkKey(key)
+	if err != nil {
+		return WatcherFunc(func(context.Context) (*etcdv2.Response, error) {
+			return nil, err
+		})
+	}
+	return b.next.Watcher(key, opts)
+}
@@ -0,0 +1,66 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"etcdcli/etcdpath"
+)
+
+func TestClientKeys(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			b := backend.new()
+			c, err := NewClientWithConfig(Config{Backend: b})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			// keys reach the backend in their canonical form
+			if err := c.Set(" /app//db/ ./host ", "h", 0, "", 0); err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := b.Get(context.Background(), "/app/db/host", nil); err != nil || resp.Node.Value != "h" {
+				t.Fatalf("canonical key: %v", err)
+			}
+			if v, err := c.Get("app/db/host/"); v != "h" || err != nil {
+				t.Errorf("relative get %q: %v", v, err)
+			}
+			if keys, err := c.List("app/", true); err != nil || strings.Join(keys, ",") != "/app/db,/app/db/host" {
+				t.Errorf("list %v: %v", keys, err)
+			}
+			if err := c.MK("q/", "v", 0, true); err != nil {
+				t.Fatal(err)
+			}
+			if keys, _ := c.List("/q", false); len(keys) != 1 || !strings.HasPrefix(keys[0], "/q/") {
+				t.Errorf("in-order keys %v", keys)
+			}
+			if err := c.RM(" app/db/host ", false, false, "h", 0); err != nil {
+				t.Errorf("rm: %v", err)
+			}
+
+			// invalid keys go no further
+			var perr *etcdpath.Error
+			for _, err := range []error{
+				c.Set("/a/../b", "v", 0, "", 0),
+				c.MKDir("/d/\x00", 0),
+				c.RM("/a/..", true, true, "", 0),
+				c.MK("/a/\xff", "v", 0, true),
+				c.Watch("/..", true, func(string, string, string) bool { return true }),
+			} {
+				if !errors.As(err, &perr) {
+					t.Errorf("invalid key: %v", err)
+				}
+			}
+			if _, err := c.Get("/" + strings.Repeat("x", etcdpath.MaxSegmentLength+1)); !errors.As(err, &perr) {
+				t.Errorf("long segment: %v", err)
+			}
+			if _, err := b.Get(context.Background(), "/b", nil); !IsEtcdNotFound(err) {
+				t.Errorf("/b written: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// ErrThrottled is returned instead of running a request when Limits.FailFast
+// is set and the request would have to wait.
+var ErrThrottled = errors.New("etcd: request throttled by client limits")
+
+// Rate is a token bucket: PerSecond requests on average, up to Burst at
+// once. The zero Rate is unlimited.
+type Rate struct {
+	PerSecond float64
+	// Burst defaults to 1.
+	Burst int
+}
+
+// Limits caps what a Client sends. Reads are Gets and Lists, writes are
+// Sets, Deletes and CreateInOrders, and watches are counted each time a
+// watch is opened, which Mirror and Migration do again after each error.
+// MaxInFlight caps reads and writes running at the same time; watches are
+// not counted, they stay open. The methods of one Client run one at a time,
+// after waiting for their rate, so MaxInFlight above 1 only matters for
+// requests made at once through several views (WithContext, WithNamespace),
+// by parallel imports and copies, Mirror and CachedClient, or on Backend
+// directly.
+//
+// A request over the limits waits for its turn, or its context, unless
+// FailFast is set, then it fails at once with ErrThrottled. Both are counted
+// in etcdcli_throttled_total{class,result} when the client has Metrics.
+type Limits struct {
+	Reads       Rate
+	Writes      Rate
+	Watches     Rate
+	MaxInFlight int
+	FailFast    bool
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(r Rate) *tokenBucket {
+	if r.PerSecond <= 0 {
+		return nil
+	}
+	burst := float64(r.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: r.PerSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before using it. With
+// failFast it takes nothing and returns false if there is no token now.
+func (b *tokenBucket) reserve(failFast bool) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if failFast {
+		return 0, false
+	}
+	b.tokens--
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), true
+}
+
+func (b *tokenBucket) refund() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// limitedBackend holds requests back according to Limits.
+type limitedBackend struct {
+	next     Backend
+	reads    *tokenBucket
+	writes   *tokenBucket
+	watches  *tokenBucket
+	inFlight chan struct{}
+	failFast bool
+	metrics  *Metrics
+}
+
+func newLimitedBackend(next Backend, limits Limits, metrics *Metrics) *limitedBackend {
+	b := &limitedBackend{
+		next:     next,
+		reads:    newTokenBucket(limits.Reads),
+		writes:   newTokenBucket(limits.Writes),
+		watches:  newTokenBucket(limits.Watches),
+		failFast: limits.FailFast,
+		metrics:  metrics,
+	}
+	if limits.MaxInFlight > 0 {
+		b.inFlight = make(chan struct{}, limits.MaxInFlight)
+	}
+	return b
+}
+
+func (b *limitedBackend) Unwrap() Backend {
+	return b.next
+}
+
+// wait takes a token of bucket, waiting if needed.
+func (b *limitedBackend) wait(ctx context.Context, class string, bucket *tokenBucket) error {
+	if bucket == nil {
+		return nil
+	}
+	delay, ok := bucket.reserve(b.failFast)
+	if !ok {
+		b.metrics.throttled(class, "rejected")
+		return ErrThrottled
+	}
+	if delay == 0 {
+		return nil
+	}
+	b.metrics.throttled(class, "waited")
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		bucket.refund()
+		return ctx.Err()
+	}
+}
+
+// bucket returns the token bucket of class.
+func (b *limitedBackend) bucket(class string) *tokenBucket {
+	switch class {
+	case "read":
+		return b.reads
+	case "write":
+		return b.writes
+	}
+	return b.watches
+}
+
+type admissionKey struct{}
+
+// admission is a token of class taken ahead of a request, or the error
+// waiting for it ended with. The first request of class made with the
+// context uses it.
+type admission struct {
+	class string
+	err   error
+	used  int32
+}
+
+// admit waits for the rate of class before the request is made, so a Client
+// can wait without holding its lock. The request made with the returned
+// context does not take another token.
+func (b *limitedBackend) admit(ctx context.Context, class string) context.Context {
+	a := &admission{class: class, err: b.wait(ctx, class, b.bucket(class))}
+	return context.WithValue(ctx, admissionKey{}, a)
+}
+
+// acquire waits for the rate of class and a free in-flight slot. The
+// returned func releases the slot. A token taken for a request that does not
+// get a slot is given back.
+func (b *limitedBackend) acquire(ctx context.Context, class string, bucket *tokenBucket) (func(), error) {
+	if a, ok := ctx.Value(admissionKey{}).(*admission); ok && a.class == class && atomic.CompareAndSwapInt32(&a.used, 0, 1) {
+		if a.err != nil {
+			return nil, a.err
+		}
+	} else if err := b.wait(ctx, class, bucket); err != nil {
+		return nil, err
+	}
+	if b.inFlight == nil {
+		return func() {}, nil
+	}
+	release := func() { <-b.inFlight }
+	select {
+	case b.inFlight <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if b.failFast {
+		bucket.refund()
+		b.metrics.throttled(class, "rejected")
+		return nil, ErrThrottled
+	}
+	b.metrics.throttled(class, "waited")
+	select {
+	case b.inFlight <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		bucket.refund()
+		return nil, ctx.Err()
+	}
+}
+
+func (b *limitedBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	release, err := b.acquire(ctx, "read", b.reads)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return b.next.Get(ctx, key, opts)
+}
+
+func (b *limitedBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	release, err := b.acquire(ctx, "write", b.writes)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return b.next.Set(ctx, key, value, opts)
+}
+
+func (b *limitedBackend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	release, err := b.acquire(ctx, "write", b.writes)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return b.next.Delete(ctx, key, opts)
+}
+
+func (b *limitedBackend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	release, err := b.acquire(ctx, "write", b.writes)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return b.next.CreateInOrder(ctx, dir, value, opts)
+}
+
+func (b *limitedBackend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	return &limitedWatcher{backend: b, next: b.next.Watcher(key, opts)}
+}
+
+// limitedWatcher takes the watch token on its first Next, the watcher is
+// created without a context to wait with.
+type limitedWatcher struct {
+	backend *limitedBackend
+	next    etcdv2.Watcher
+	started bool
+}
+
+func (w *limitedWatcher) Next(ctx context.Context) (*etcdv2.Response, error) {
+	if !w.started {
+		if err := w.backend.wait(ctx, "watch", w.backend.watches); err != nil {
+			return nil, err
+		}
+		w.started = true
+	}
+	return w.next.Next(ctx)
+}
@@ -0,0 +1,193 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// blockingBackend holds every Get until release is closed.
+type blockingBackend struct {
+	Backend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBackend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.Backend.Get(ctx, key, opts)
+}
+
+func TestLimitsFailFast(t *testing.T) {
+	m := NewMetrics()
+	c, err := NewClientWithConfig(Config{
+		Backend: NewMemoryBackend(),
+		Metrics: m,
+		Limits:  &Limits{Writes: Rate{PerSecond: 0.001}, FailFast: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Set("/a", "1", 0, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("/a", "2", 0, "", 0); err != ErrThrottled {
+		t.Fatalf("second write: %v", err)
+	}
+	// reads have their own budget
+	if _, err := c.Get("/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	for _, line := range []string{
+		`etcdcli_requests_total{op="set",code="ok"} 1`,
+		`etcdcli_requests_total{op="set",code="throttled"} 1`,
+		`etcdcli_throttled_total{class="write",result="rejected"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestLimitsWait(t *testing.T) {
+	m := NewMetrics()
+	c, err := NewClientWithConfig(Config{
+		Backend: NewMemoryBackend(),
+		Metrics: m,
+		Limits:  &Limits{Reads: Rate{PerSecond: 20}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Set("/a", "1", 0, "", 0)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 reads at 20/s took %v", elapsed)
+	}
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	if !strings.Contains(buf.String(), `etcdcli_throttled_total{class="read",result="waited"} 2`+"\n") {
+		t.Errorf("waits not counted:\n%s", buf.String())
+	}
+}
+
+func TestLimitsMaxInFlight(t *testing.T) {
+	b := &blockingBackend{Backend: NewMemoryBackend(), started: make(chan struct{}, 2), release: make(chan struct{})}
+	c, err := NewClientWithConfig(Config{Backend: b, Limits: &Limits{MaxInFlight: 1, FailFast: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// two views, so that the client lock does not serialize the calls
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.WithContext(context.Background()).Get("/a")
+		done <- err
+	}()
+	<-b.started
+	if _, err := c.WithContext(context.Background()).Get("/a"); err != ErrThrottled {
+		t.Errorf("second read in flight: %v", err)
+	}
+	close(b.release)
+	if err := <-done; !IsEtcdNotFound(err) {
+		t.Errorf("first read: %v", err)
+	}
+}
+
+func TestLimitsRefund(t *testing.T) {
+	for _, failFast := range []bool{true, false} {
+		b := &blockingBackend{Backend: NewMemoryBackend(), started: make(chan struct{}, 3), release: make(chan struct{})}
+		c, err := NewClientWithConfig(Config{
+			Backend: b,
+			Timeout: time.Second,
+			Limits:  &Limits{Reads: Rate{PerSecond: 0.001, Burst: 2}, MaxInFlight: 1, FailFast: failFast},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.WithContext(context.Background()).Get("/a")
+			done <- err
+		}()
+		<-b.started
+
+		// the second read takes the last token but no slot, and gives the
+		// token back
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		want := ErrThrottled
+		if !failFast {
+			want = context.DeadlineExceeded
+		}
+		if _, err := c.WithContext(ctx).Get("/a"); err != want {
+			t.Errorf("failFast %v: second read %v", failFast, err)
+		}
+		cancel()
+		close(b.release)
+		if err := <-done; !IsEtcdNotFound(err) {
+			t.Errorf("failFast %v: first read %v", failFast, err)
+		}
+		if _, err := c.Get("/a"); !IsEtcdNotFound(err) {
+			t.Errorf("failFast %v: token not refunded: %v", failFast, err)
+		}
+		c.Close()
+	}
+}
+
+func TestLimitsWaitUnlocked(t *testing.T) {
+	m := NewMetrics()
+	c, err := NewClientWithConfig(Config{
+		Backend: NewMemoryBackend(),
+		Metrics: m,
+		Limits:  &Limits{Writes: Rate{PerSecond: 0.001}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("/a", "1", 0, "", 0)
+
+	// the second write waits for a token without locking the client
+	done := make(chan error, 1)
+	go func() { done <- c.Set("/a", "2", 0, "", 0) }()
+	eventually(t, "the write waiting", func() bool {
+		var buf bytes.Buffer
+		m.WriteTo(&buf)
+		return strings.Contains(buf.String(), `etcdcli_throttled_total{class="write",result="waited"} 1`+"\n")
+	})
+	read := make(chan string, 1)
+	go func() {
+		v, _ := c.Get("/a")
+		read <- v
+	}()
+	select {
+	case v := <-read:
+		if v != "1" {
+			t.Errorf("read %q", v)
+		}
+	case <-time.After(time.Second):
+		t.Error("read held up by a throttled write")
+	}
+	c.Close()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("throttled write after Close: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package etcd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// SpanContext identifies a span within its trace.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+type SpanStartOptions struct {
+	Attributes []Field
+	// Links point at related spans outside the parent chain, each watch
+	// event links to its watch.
+	Links []SpanContext
+}
+
+type Span interface {
+	Context() SpanContext
+	SetAttributes(attrs ...Field)
+	AddEvent(name string, attrs ...Field)
+	// End finishes the span, err is the outcome of the operation.
+	End(err error)
+}
+
+// Tracer starts spans in the shape of OpenTelemetry, adapt it to your
+// tracing SDK and set it in Config.Tracer. Start must take the parent span
+// from ctx, see SpanFromContext, and return a ctx carrying the new span.
+//
+// The client starts a span per operation named etcd.<op> with the
+// attributes op, key, endpoint, index and code, a span etcd.watch for each
+// watch that lives as long as the watch, and a span etcd.watch.event per
+// event linked to its watch.
+type Tracer interface {
+	Start(ctx context.Context, name string, opts SpanStartOptions) (context.Context, Span)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span as the parent of the
+// spans started below it.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span in ctx or nil.
+func SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+// traceInterceptor wraps every call in a span.
+func traceInterceptor(tracer Tracer, endpoint string) Interceptor {
+	return func(ctx context.Context, call *Call, next Invoker) (*etcdv2.Response, error) {
+		op := opName(call)
+		ctx, span := tracer.Start(ctx, "etcd."+op, SpanStartOptions{Attributes: []Field{
+			{"op", op},
+			{"key", call.Key},
+			{"endpoint", endpoint},
+		}})
+		resp, err := next(ctx, call)
+		if resp != nil {
+			span.SetAttributes(Field{"index", resp.Index})
+		}
+		span.SetAttributes(Field{"code", errorLabel(err)})
+		span.End(err)
+		return resp, err
+	}
+}
+
+// startWatchSpan starts the span of a watch on c, or returns nil without a
+// tracer.
+func (c *Client) startWatchSpan(ctx context.Context, key string, recursive bool) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	return c.tracer.Start(ctx, "etcd.watch", SpanStartOptions{Attributes: []Field{
+		{"op", "watch"},
+		{"key", key},
+		{"recursive", recursive},
+		{"endpoint", c.endpoint},
+	}})
+}
+
+// traceWatchEvent records resp on the watch span and in its own linked span.
+func (c *Client) traceWatchEvent(ctx context.Context, watch Span, resp *etcdv2.Response) {
+	if watch == nil {
+		return
+	}
+	attrs := []Field{
+		{"action", resp.Action},
+		{"key", resp.Node.Key},
+		{"index", resp.Node.ModifiedIndex},
+	}
+	watch.AddEvent(resp.Action, attrs...)
+	_, span := c.tracer.Start(ctx, "etcd.watch.event", SpanStartOptions{
+		Attributes: attrs,
+		Links:      []SpanContext{watch.Context()},
+	})
+	span.End(nil)
+}
+
+func endSpan(span Span, err error) {
+	if span != nil {
+		span.End(err)
+	}
+}
+
+// MemoryTracer keeps finished spans in memory, for tests.
+type MemoryTracer struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+// RecordedSpan is a span finished on a MemoryTracer.
+type RecordedSpan struct {
+	Name string
+	SpanContext
+	ParentID   string
+	Attributes map[string]interface{}
+	Events     []SpanEvent
+	Links      []SpanContext
+	Start, End time.Time
+	Err        error
+}
+
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]interface{}
+}
+
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+func (t *MemoryTracer) Start(ctx context.Context, name string, opts SpanStartOptions) (context.Context, Span) {
+	span := &memorySpan{tracer: t, rec: RecordedSpan{
+		Name:       name,
+		Attributes: make(map[string]interface{}),
+		Links:      opts.Links,
+		Start:      time.Now(),
+	}}
+	if parent := SpanFromContext(ctx); parent != nil && parent.Context().IsValid() {
+		span.rec.TraceID = parent.Context().TraceID
+		span.rec.ParentID = parent.Context().SpanID
+	} else {
+		span.rec.TraceID = randomID(16)
+	}
+	span.rec.SpanID = randomID(8)
+	span.SetAttributes(opts.Attributes...)
+	return ContextWithSpan(ctx, span), span
+}
+
+// Spans returns the finished spans in the order they ended.
+func (t *MemoryTracer) Spans() []RecordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]RecordedSpan(nil), t.spans...)
+}
+
+func (t *MemoryTracer) Reset() {
+	t.mu.Lock()
+	t.spans = nil
+	t.mu.Unlock()
+}
+
+type memorySpan struct {
+	tracer *MemoryTracer
+	mu     sync.Mutex
+	rec    RecordedSpan
+	ended  bool
+}
+
+func (s *memorySpan) Context() SpanContext {
+	return s.rec.SpanContext
+}
+
+func (s *memorySpan) SetAttributes(attrs ...Field) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, attr := range attrs {
+		s.rec.Attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *memorySpan) AddEvent(name string, attrs ...Field) {
+	event := SpanEvent{Name: name, Time: time.Now(), Attributes: make(map[string]interface{}, len(attrs))}
+	for _, attr := range attrs {
+		event.Attributes[attr.Key] = attr.Value
+	}
+	s.mu.Lock()
+	s.rec.Events = append(s.rec.Events, event)
+	s.mu.Unlock()
+}
+
+func (s *memorySpan) End(err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.rec.End = time.Now()
+	s.rec.Err = err
+	// the span may still be written to after End, record a copy
+	rec := s.rec
+	rec.Attributes = make(map[string]interface{}, len(s.rec.Attributes))
+	for k, v := range s.rec.Attributes {
+		rec.Attributes[k] = v
+	}
+	rec.Events = append([]SpanEvent(nil), s.rec.Events...)
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, rec)
+	s.tracer.mu.Unlock()
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,156 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTracedClient(t *testing.T) (*Client, *MemoryTracer) {
+	tracer := NewMemoryTracer()
+	c, err := NewClientWithConfig(Config{Backend: NewMemoryBackend(), Tracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, tracer
+}
+
+func findSpan(spans []RecordedSpan, name string) *RecordedSpan {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestTraceOperations(t *testing.T) {
+	c, tracer := newTracedClient(t)
+	if err := c.Set("/a", "1", 0, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("/a"); err != nil {
+		t.Fatal(err)
+	}
+	c.Get("/missing")
+
+	spans := tracer.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("%d spans: %+v", len(spans), spans)
+	}
+	for i, want := range []struct {
+		name, key, code string
+		failed          bool
+	}{
+		{"etcd.set", "/a", "ok", false},
+		{"etcd.get", "/a", "ok", false},
+		{"etcd.get", "/missing", "100", true},
+	} {
+		span := spans[i]
+		if span.Name != want.name || span.Attributes["key"] != want.key || span.Attributes["code"] != want.code {
+			t.Errorf("span %d: %s %v", i, span.Name, span.Attributes)
+		}
+		if span.Attributes["op"] != want.name[len("etcd."):] {
+			t.Errorf("span %d: op %v", i, span.Attributes["op"])
+		}
+		if (span.Err != nil) != want.failed {
+			t.Errorf("span %d: error %v", i, span.Err)
+		}
+		if _, ok := span.Attributes["index"]; ok == want.failed {
+			t.Errorf("span %d: index %v", i, span.Attributes["index"])
+		}
+		if span.End.Before(span.Start) || !span.IsValid() {
+			t.Errorf("span %d: %+v", i, span)
+		}
+	}
+}
+
+func TestTraceParentFromContext(t *testing.T) {
+	c, tracer := newTracedClient(t)
+	ctx, parent := tracer.Start(context.Background(), "request", SpanStartOptions{})
+	c.WithContext(ctx).Set("/a", "1", 0, "", 0)
+	parent.End(nil)
+
+	set := findSpan(tracer.Spans(), "etcd.set")
+	if set == nil || set.ParentID != parent.Context().SpanID || set.TraceID != parent.Context().TraceID {
+		t.Errorf("set span %+v, parent %+v", set, parent.Context())
+	}
+}
+
+func TestTraceWatch(t *testing.T) {
+	c, tracer := newTracedClient(t)
+	c.Set("/w/a", "0", 0, "", 0)
+	tracer.Reset()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Watch("/w", true, func(action, key, value string) bool {
+			return true
+		})
+	}()
+	// written until the watch sees a write
+	deadline := time.After(5 * time.Second)
+	for i := 1; ; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(20 * time.Millisecond):
+			c.Set("/w/a", fmt.Sprint(i), 0, "", 0)
+			continue
+		case <-deadline:
+			t.Fatal("no watch event")
+		}
+		break
+	}
+
+	spans := tracer.Spans()
+	watch := findSpan(spans, "etcd.watch")
+	event := findSpan(spans, "etcd.watch.event")
+	if watch == nil || event == nil {
+		t.Fatalf("spans %+v", spans)
+	}
+	if watch.Err != nil || watch.Attributes["op"] != "watch" || watch.Attributes["key"] != "/w" || watch.Attributes["recursive"] != true {
+		t.Errorf("watch span %+v", watch)
+	}
+	if len(watch.Events) != 1 || watch.Events[0].Name != "set" || watch.Events[0].Attributes["key"] != "/w/a" {
+		t.Errorf("watch events %+v", watch.Events)
+	}
+	if event.Attributes["action"] != "set" || event.Attributes["key"] != "/w/a" {
+		t.Errorf("event span %+v", event)
+	}
+	if len(event.Links) != 1 || event.Links[0] != watch.SpanContext {
+		t.Errorf("event links %+v, watch %+v", event.Links, watch.SpanContext)
+	}
+}
+
+func TestMemoryTracerRecordsCopy(t *testing.T) {
+	tracer := NewMemoryTracer()
+	_, span := tracer.Start(context.Background(), "op", SpanStartOptions{Attributes: []Field{{"key", "/a"}}})
+	span.AddEvent("retry")
+	span.End(nil)
+
+	// writes after End do not reach the recorded span, and do not race
+	// with readers of it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			span.SetAttributes(Field{"late", i})
+			span.AddEvent("late")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		rec := tracer.Spans()[0]
+		_ = rec.Attributes["late"]
+	}
+	<-done
+
+	rec := tracer.Spans()[0]
+	if _, ok := rec.Attributes["late"]; ok || rec.Attributes["key"] != "/a" || len(rec.Events) != 1 {
+		t.Errorf("recorded %+v", rec)
+	}
+}
@@ -0,0 +1,139 @@
+package etcd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+type CopyOptions struct {
+	// PreserveTTL copies the remaining TTL of every key and directory.
+	PreserveTTL bool
+	// Overwrite allows writing into an existing destination, replacing the
+	// keys present in the source. Without it the copy fails when dst exists.
+	Overwrite bool
+	// Parallel is the number of concurrent value writes.
+	Parallel int
+}
+
+// CopyTree recursively copies src to dst and verifies the copy.
+func (c *Client) CopyTree(src string, dst string, opts CopyOptions) error {
+	_, err := c.copyTree(src, dst, opts)
+	return err
+}
+
+// MoveTree copies src to dst, verifies the copy and only then deletes src.
+// The v2 API has no rename, so this is how a key or directory gets a new name.
+//
+// Each copied key is deleted by the index it was copied at and directories
+// only once empty, so a key written under src during the copy is kept, not
+// lost; MoveTree then returns an error naming what was left behind.
+func (c *Client) MoveTree(src string, dst string, opts CopyOptions) error {
+	d, err := c.copyTree(src, dst, opts)
+	if err != nil {
+		return err
+	}
+
+	// children come after their parents in a dump, delete from the end
+	var kept []string
+	for i := len(d.Nodes) - 1; i >= 0; i-- {
+		node := d.Nodes[i]
+		ctx, cancel := c.newContextWithTimeout()
+		if node.Dir {
+			_, err = c.backend.Delete(ctx, node.Key, &etcdv2.DeleteOptions{Dir: true})
+		} else {
+			_, err = c.backend.Delete(ctx, node.Key, &etcdv2.DeleteOptions{PrevIndex: node.index})
+		}
+		cancel()
+		switch {
+		case err == nil, IsEtcdNotFound(err):
+		case IsEtcdTestFailed(err), IsEtcdNotDirEmpty(err):
+			kept = append(kept, node.Key)
+		default:
+			return fmt.Errorf("copied %s to %s but could not remove the source: %v", src, dst, err)
+		}
+	}
+	if len(kept) > 0 {
+		return fmt.Errorf("copied %s to %s, but kept source nodes changed during the move: %s", src, dst, strings.Join(kept, ", "))
+	}
+	return nil
+}
+
+func (c *Client) copyTree(src string, dst string, opts CopyOptions) (*Dump, error) {
+	src, dst = etcdpath.Clean(src), etcdpath.Clean(dst)
+	if src == "/" || dst == "/" {
+		return nil, fmt.Errorf("cannot copy from or to the root directory")
+	}
+	if etcdpath.HasPrefix(dst, src) || etcdpath.HasPrefix(src, dst) {
+		return nil, fmt.Errorf("%s and %s overlap", src, dst)
+	}
+
+	if !opts.Overwrite {
+		_, err := c.snapshot(dst, false)
+		if err == nil {
+			return nil, etcdv2.Error{Code: etcdv2.ErrorCodeNodeExist, Message: "Key already exists", Cause: dst}
+		}
+		if !IsEtcdNotFound(err) {
+			return nil, err
+		}
+	}
+
+	d, err := c.snapshot(src, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.Nodes) == 0 {
+		return nil, etcdv2.Error{Code: etcdv2.ErrorCodeKeyNotFound, Message: "Key not found", Cause: src}
+	}
+
+	mode := ImportSkipExisting
+	if opts.Overwrite {
+		mode = ImportOverwrite
+	}
+	_, err = c.ImportDump(d, ImportOptions{
+		Mode:        mode,
+		Prefix:      dst,
+		PreserveTTL: opts.PreserveTTL,
+		Parallel:    opts.Parallel,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.verifyCopy(d, dst); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// verifyCopy checks that every node of d exists under dst with the same
+// kind and value.
+func (c *Client) verifyCopy(d *Dump, dst string) error {
+	copied, err := c.snapshot(dst, false)
+	if err != nil {
+		return fmt.Errorf("verify %s: %v", dst, err)
+	}
+
+	have := make(map[string]DumpNode, len(copied.Nodes))
+	for _, node := range copied.Nodes {
+		have[node.Key] = node
+	}
+
+	now := time.Now()
+	for _, node := range d.Nodes {
+		key := rerootKey(node.Key, d.Prefix, dst)
+		got, ok := have[key]
+		switch {
+		case !ok && node.Expiration != nil && node.Expiration.Before(now):
+			// expired meanwhile, not copied on purpose
+		case !ok:
+			return fmt.Errorf("verify %s: %s is missing", dst, key)
+		case got.Dir != node.Dir || got.Value != node.Value:
+			return fmt.Errorf("verify %s: %s differs from %s", dst, key, node.Key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package etcd
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func TestCopyTree(t *testing.T) {
+	c := newTestClient(t)
+	c.Set("/src/x", "1", 0, "", 0)
+	c.Set("/src/d/y", "2", 60, "", 0)
+	c.MKDir("/src/e", 0)
+
+	if err := c.CopyTree("/src", "/dst", CopyOptions{PreserveTTL: true, Parallel: 2}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/dst/", "/dst/d/", "/dst/d/y", "/dst/e/", "/dst/x"}
+	if keys := dumpKeys(mustSnapshot(t, c, "/dst")); !reflect.DeepEqual(keys, want) {
+		t.Errorf("copied %v, want %v", keys, want)
+	}
+	if ttl, _, _ := c.TTL("/dst/d/y"); ttl <= 0 {
+		t.Errorf("ttl not preserved: %v", ttl)
+	}
+	if v, _ := c.Get("/src/x"); v != "1" {
+		t.Errorf("source changed: %q", v)
+	}
+
+	// dst exists
+	if err := c.CopyTree("/src", "/dst", CopyOptions{}); !IsEtcdNodeExist(err) {
+		t.Errorf("copy onto an existing tree: %v", err)
+	}
+	c.Set("/src/x", "new", 0, "", 0)
+	if err := c.CopyTree("/src", "/dst", CopyOptions{Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("/dst/x"); v != "new" {
+		t.Errorf("overwritten with %q", v)
+	}
+
+	// a single key
+	if err := c.CopyTree("/src/x", "/single", CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("/single"); v != "new" {
+		t.Errorf("single key copied as %q", v)
+	}
+
+	// keys are taken as the client cleans them
+	if err := c.CopyTree("src", "rel/", CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("/rel/d/y"); v != "2" {
+		t.Errorf("relative copy %v", dumpKeys(mustSnapshot(t, c, "/rel")))
+	}
+
+	for _, tt := range []struct{ src, dst string }{
+		{"/src", "/src/sub"},
+		{"/src", "src/sub"},
+		{"src/d/", "/src"},
+		{"/src/./d", "src//d"},
+		{"/src/d", "/src"},
+		{"/src", "/src/"},
+		{"/", "/x"},
+		{"/x", " / "},
+	} {
+		if err := c.CopyTree(tt.src, tt.dst, CopyOptions{}); err == nil {
+			t.Errorf("copy %s to %s", tt.src, tt.dst)
+		}
+	}
+	if err := c.CopyTree("/missing", "/m", CopyOptions{}); !IsEtcdNotFound(err) {
+		t.Errorf("copy of a missing key: %v", err)
+	}
+}
+
+func TestMoveTree(t *testing.T) {
+	c := newTestClient(t)
+	c.Set("/src/x", "1", 0, "", 0)
+	c.Set("/src/d/y", "2", 0, "", 0)
+
+	if err := c.MoveTree("/src", "src/sub", CopyOptions{}); err == nil {
+		t.Error("moved into its own source")
+	}
+	if keys := dumpKeys(mustSnapshot(t, c, "/src")); len(keys) != 4 {
+		t.Errorf("source after a rejected move %v", keys)
+	}
+	if err := c.MoveTree("/src", "/dst", CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetResonse("/src", false, false); !IsEtcdNotFound(err) {
+		t.Errorf("source left: %v", err)
+	}
+	if v, _ := c.Get("/dst/d/y"); v != "2" {
+		t.Errorf("moved d/y %q", v)
+	}
+}
+
+// duringCopyBackend runs during once, after the first write under dst.
+type duringCopyBackend struct {
+	Backend
+	dst    string
+	once   sync.Once
+	during func(b Backend)
+}
+
+func (b *duringCopyBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	resp, err := b.Backend.Set(ctx, key, value, opts)
+	if err == nil && strings.HasPrefix(key, b.dst+"/") {
+		b.once.Do(func() { b.during(b.Backend) })
+	}
+	return resp, err
+}
+
+func TestMoveTreeKeepsConcurrentWrites(t *testing.T) {
+	b := &duringCopyBackend{Backend: NewMemoryBackend(), dst: "/dst"}
+	c, err := NewClientWithConfig(Config{Backend: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Set("/src/x", "1", 0, "", 0)
+	c.Set("/src/d/y", "2", 0, "", 0)
+	b.during = func(b Backend) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		b.Set(ctx, "/src/x", "changed", nil)
+		b.Set(ctx, "/src/d/new", "n", nil)
+	}
+
+	err = c.MoveTree("/src", "/dst", CopyOptions{})
+	if err == nil || !strings.Contains(err.Error(), "/src/x") || !strings.Contains(err.Error(), "/src/d") {
+		t.Fatalf("move with concurrent writes: %v", err)
+	}
+	if v, _ := c.Get("/src/x"); v != "changed" {
+		t.Errorf("changed key %q", v)
+	}
+	if v, _ := c.Get("/src/d/new"); v != "n" {
+		t.Errorf("new key %q", v)
+	}
+	if _, err := c.Get("/src/d/y"); !IsEtcdNotFound(err) {
+		t.Errorf("moved key left: %v", err)
+	}
+	if v, _ := c.Get("/dst/d/y"); v != "2" {
+		t.Errorf("moved d/y %q", v)
+	}
+}
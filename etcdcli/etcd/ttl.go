@@ -0,0 +1,47 @@
+package etcd
+
+import (
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// TTL returns how long key, a key or a directory, has left before it
+// expires and when that is; 0 and the zero time for a node without TTL.
+// The server counts in whole seconds, the remaining time is as precise as
+// the expiration it reports.
+func (c *Client) TTL(key string) (time.Duration, time.Time, error) {
+	ctx, cancel := c.newContextWithTimeout()
+	resp, err := c.backend.Get(ctx, key, &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	node := resp.Node
+	if node.Expiration == nil {
+		return 0, time.Time{}, nil
+	}
+	left := time.Until(*node.Expiration)
+	if left < 0 {
+		left = 0
+	}
+	return left, *node.Expiration, nil
+}
+
+// WatchExpirations watches prefix recursively like Watch and calls onExpire
+// for the nodes that expire, and only for those: deletes and writes are
+// left out. node is the expired node as it was last, its value included,
+// taken from the previous node of the event; onExpire returns true to stop.
+func (c *Client) WatchExpirations(prefix string, onExpire func(node *etcdv2.Node) bool) error {
+	return c.watch(c.baseContext(), prefix, true, func(resp *etcdv2.Response) bool {
+		if resp.Action != "expire" {
+			return false
+		}
+		node := resp.PrevNode
+		if node == nil {
+			// no previous node, the key is all that is known
+			node = resp.Node
+		}
+		return onExpire(node)
+	})
+}
@@ -0,0 +1,93 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func TestTTL(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			c, err := NewClientWithConfig(Config{Backend: backend.new()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Set("/t/a", "va", 2, "", 0)
+			c.Set("/t/b", "vb", 0, "", 0)
+			c.MKDir("/d", 60)
+
+			left, at, err := c.TTL("/t/a")
+			if err != nil || left <= time.Second || left > 2*time.Second || at.IsZero() {
+				t.Errorf("key ttl %v at %v: %v", left, at, err)
+			}
+			if d := time.Until(at) - left; d < -100*time.Millisecond || d > 100*time.Millisecond {
+				t.Errorf("expiration %v does not match %v left", at, left)
+			}
+			if left, _, err := c.TTL("/d"); err != nil || left <= 59*time.Second || left > time.Minute {
+				t.Errorf("dir ttl %v: %v", left, err)
+			}
+			if left, at, err := c.TTL("/t/b"); left != 0 || !at.IsZero() || err != nil {
+				t.Errorf("no ttl %v at %v: %v", left, at, err)
+			}
+			if left, at, err := c.TTL("/t"); left != 0 || !at.IsZero() || err != nil {
+				t.Errorf("dir without ttl %v at %v: %v", left, at, err)
+			}
+			if _, _, err := c.TTL("/none"); !IsEtcdNotFound(err) {
+				t.Errorf("missing key: %v", err)
+			}
+		})
+	}
+}
+
+func TestWatchExpirations(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			c, err := NewClientWithConfig(Config{Backend: backend.new()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			got := make(chan *etcdv2.Node, 10)
+			done := make(chan error, 1)
+			go func() {
+				done <- c.WatchExpirations("/t", func(node *etcdv2.Node) bool {
+					got <- node
+					return node.Key == "/t/last"
+				})
+			}()
+			time.Sleep(50 * time.Millisecond)
+
+			// writes and deletes, with or without TTL, are left out
+			c.Set("/t/a", "first", 1, "", 0)
+			c.Set("/t/a", "va", 1, "", 0)
+			c.Set("/t/gone", "g", 1, "", 0)
+			c.RM("/t/gone", false, false, "", 0)
+			c.Set("/t/keep", "k", 0, "", 0)
+			c.Set("/other", "o", 1, "", 0)
+			time.Sleep(100 * time.Millisecond)
+			c.Set("/t/last", "vl", 1, "", 0)
+
+			var nodes []*etcdv2.Node
+			for len(nodes) < 2 {
+				select {
+				case node := <-got:
+					nodes = append(nodes, node)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expired %d of 2", len(nodes))
+				}
+			}
+			if nodes[0].Key != "/t/a" || nodes[0].Value != "va" || nodes[1].Key != "/t/last" || nodes[1].Value != "vl" {
+				t.Errorf("expired %+v, %+v", nodes[0], nodes[1])
+			}
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+			if _, err := c.Get("/t/keep"); err != nil {
+				t.Errorf("key without ttl: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package etcd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// TxnMode is how a Txn commits its writes. etcd v2 has no multi-key
+// transactions, both modes emulate one and give different guarantees.
+//
+// TxnGeneration keeps the keys under root as generations:
+//
+//	<root>/current                   name of the committed generation
+//	<root>/generations/<gen>/<key>   every key of one generation
+//
+// A commit writes a whole new generation, then swaps the current pointer
+// by index. Readers going through BeginTxn see one generation, all of a
+// commit or none of it, and two commits from the same snapshot do not both
+// win: the second gets ErrTxnConflict. Every commit copies all the keys, so
+// it fits small key sets such as a config struct, and plain Gets of the keys
+// do not work, there is no fixed path to read.
+//
+// TxnLock writes the keys in place, <root>/<key>, while holding the lock
+// key <root>/_lock. Commits through TxnLock are serialized, and the keys a
+// transaction read are checked by index before anything is written, so a
+// read-modify-write fails with ErrTxnConflict rather than lose an update.
+// The lock is refreshed by index before every write, so a long commit keeps
+// it, and a commit that finds it expired or taken stops there with
+// ErrTxnConflict. The key _lock under root is reserved for it. Readers are
+// not isolated: a plain Get during a commit may see some writes and not
+// others. A failed write rolls back those done before it, as far as it can;
+// a committer that dies half way leaves its writes and the lock, which
+// expires after TxnLockTTL.
+type TxnMode int
+
+const (
+	TxnGeneration TxnMode = iota
+	TxnLock
+)
+
+// TxnLockTTL is how long the lock of a TxnLock commit outlives a committer
+// that died holding it, or stalled longer than that between two writes.
+const TxnLockTTL = 30 * time.Second
+
+var (
+	// ErrTxnConflict is returned by Commit when the keys changed since the
+	// transaction read them; begin again and retry.
+	ErrTxnConflict = errors.New("etcd: transaction conflict")
+	// ErrTxnLocked is returned by a TxnLock Commit that could not get the
+	// lock within the client timeout.
+	ErrTxnLocked = errors.New("etcd: transaction lock held by another client")
+
+	errTxnDone = errors.New("etcd: transaction already committed")
+)
+
+// Txn stages writes to keys under a root, relative to it, and applies them
+// together on Commit.
+type Txn struct {
+	c    *Client
+	root string
+	mode TxnMode
+	done bool
+
+	// TxnGeneration: the generation read, the index of the pointer naming
+	// it, 0 if there was none, and its keys
+	gen      string
+	index    uint64
+	snapshot map[string]string
+
+	// TxnLock: the ModifiedIndex of every key read, 0 for a missing one
+	reads map[string]uint64
+
+	writes []txnWrite
+}
+
+type txnWrite struct {
+	key    string
+	value  string
+	delete bool
+}
+
+// BeginTxn starts a transaction on the keys under root. In TxnGeneration
+// mode it reads the committed generation, which Get and Snapshot return;
+// readers use it that way without committing.
+func (c *Client) BeginTxn(root string, mode TxnMode) (*Txn, error) {
+	t := &Txn{c: c, root: etcdpath.Clean(root), mode: mode, reads: make(map[string]uint64)}
+	if mode != TxnGeneration {
+		return t, nil
+	}
+
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = t.readGeneration(); err == nil || !IsEtcdNotFound(err) {
+			return t, err
+		}
+		// the generation was replaced and deleted while it was read
+	}
+	return nil, err
+}
+
+func (t *Txn) readGeneration() error {
+	ctx, cancel := t.c.newContextWithTimeout()
+	resp, err := t.c.backend.Get(ctx, etcdpath.Join(t.root, "current"), &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	t.gen, t.index, t.snapshot = "", 0, make(map[string]string)
+	if IsEtcdNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.gen, t.index = resp.Node.Value, resp.Node.ModifiedIndex
+
+	dir := t.generationDir(t.gen)
+	ctx, cancel = t.c.newContextWithTimeout()
+	resp, err = t.c.backend.Get(ctx, dir, &etcdv2.GetOptions{Recursive: true, Quorum: true})
+	cancel()
+	if err != nil {
+		return err
+	}
+	walkNodes(resp.Node, func(node *etcdv2.Node) {
+		if !node.Dir {
+			t.snapshot[strings.TrimPrefix(node.Key, dir)] = node.Value
+		}
+	})
+	return nil
+}
+
+func (t *Txn) generationDir(gen string) string {
+	return etcdpath.Join(t.root, "generations", gen)
+}
+
+// Get returns the value of key as the transaction sees it, its own writes
+// included, and whether it exists. In TxnLock mode the key is read from the
+// cluster and Commit checks it has not changed since.
+func (t *Txn) Get(key string) (string, bool, error) {
+	key = etcdpath.Clean(key)
+	for i := len(t.writes) - 1; i >= 0; i-- {
+		if w := t.writes[i]; w.key == key {
+			return w.value, !w.delete, nil
+		}
+	}
+	if t.mode == TxnGeneration {
+		value, ok := t.snapshot[key]
+		return value, ok, nil
+	}
+
+	ctx, cancel := t.c.newContextWithTimeout()
+	resp, err := t.c.backend.Get(ctx, etcdpath.Join(t.root, key), &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	if IsEtcdNotFound(err) {
+		t.reads[key] = 0
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	t.reads[key] = resp.Node.ModifiedIndex
+	return resp.Node.Value, true, nil
+}
+
+// Snapshot returns the keys and values of the generation read by BeginTxn,
+// without the staged writes; nil in TxnLock mode.
+func (t *Txn) Snapshot() map[string]string {
+	if t.mode != TxnGeneration {
+		return nil
+	}
+	snapshot := make(map[string]string, len(t.snapshot))
+	for key, value := range t.snapshot {
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+// Index returns the ModifiedIndex of the current pointer read by BeginTxn,
+// which changes with every commit; 0 when there was no generation yet, and
+// in TxnLock mode.
+func (t *Txn) Index() uint64 {
+	return t.index
+}
+
+// Set stages a write of value to key.
+func (t *Txn) Set(key, value string) *Txn {
+	t.writes = append(t.writes, txnWrite{key: etcdpath.Clean(key), value: value})
+	return t
+}
+
+// Delete stages the removal of key.
+func (t *Txn) Delete(key string) *Txn {
+	t.writes = append(t.writes, txnWrite{key: etcdpath.Clean(key), delete: true})
+	return t
+}
+
+// Commit applies the staged writes as the mode of the transaction says. A
+// transaction commits once, after ErrTxnConflict begin a new one.
+func (t *Txn) Commit() error {
+	if t.done {
+		return errTxnDone
+	}
+	t.done = true
+	for _, w := range t.writes {
+		if w.key == "/" {
+			return errors.New("txn: write to the root of the transaction")
+		}
+		if w.key == "/_lock" || strings.HasPrefix(w.key, "/_lock/") {
+			return errors.New("txn: _lock is reserved for the commit lock")
+		}
+	}
+	if t.mode == TxnGeneration {
+		return t.commitGeneration()
+	}
+	return t.commitLocked()
+}
+
+func (t *Txn) commitGeneration() error {
+	keys := t.Snapshot()
+	for _, w := range t.writes {
+		if w.delete {
+			delete(keys, w.key)
+		} else {
+			keys[w.key] = w.value
+		}
+	}
+
+	gen := newGeneration()
+	dir := t.generationDir(gen)
+	ctx, cancel := t.c.newContextWithTimeout()
+	_, err := t.c.backend.Set(ctx, dir, "", &etcdv2.SetOptions{Dir: true, PrevExist: etcdv2.PrevNoExist})
+	cancel()
+	if err != nil {
+		return err
+	}
+	for key, value := range keys {
+		ctx, cancel := t.c.newContextWithTimeout()
+		_, err := t.c.backend.Set(ctx, etcdpath.Join(dir, key), value, nil)
+		cancel()
+		if err != nil {
+			t.deleteGeneration(gen)
+			return err
+		}
+	}
+
+	opts := &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist}
+	if t.index != 0 {
+		opts = &etcdv2.SetOptions{PrevIndex: t.index}
+	}
+	ctx, cancel = t.c.newContextWithTimeout()
+	_, err = t.c.backend.Set(ctx, etcdpath.Join(t.root, "current"), gen, opts)
+	cancel()
+	if err != nil {
+		t.deleteGeneration(gen)
+		if IsEtcdTestFailed(err) || IsEtcdNodeExist(err) || IsEtcdNotFound(err) {
+			return ErrTxnConflict
+		}
+		return err
+	}
+
+	if t.gen != "" {
+		t.deleteGeneration(t.gen)
+	}
+	return nil
+}
+
+func (t *Txn) deleteGeneration(gen string) {
+	ctx, cancel := t.c.newContextWithTimeout()
+	defer cancel()
+	_, err := t.c.backend.Delete(ctx, t.generationDir(gen), &etcdv2.DeleteOptions{Dir: true, Recursive: true})
+	if err != nil && !IsEtcdNotFound(err) {
+		t.c.logger.Log(LevelWarn, "txn generation not deleted", Field{"key", t.generationDir(gen)}, Field{"error", err.Error()})
+	}
+}
+
+// TxnGC deletes the generations under root that are not current and older
+// than minAge, left behind by TxnGeneration committers that died or lost a
+// conflict half way. minAge must exceed the time the slowest commit takes.
+// It returns how many it deleted.
+func (c *Client) TxnGC(root string, minAge time.Duration) (int, error) {
+	t := &Txn{c: c, root: etcdpath.Clean(root)}
+	ctx, cancel := c.newContextWithTimeout()
+	current, err := c.backend.Get(ctx, etcdpath.Join(t.root, "current"), &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	if err != nil && !IsEtcdNotFound(err) {
+		return 0, err
+	}
+	ctx, cancel = c.newContextWithTimeout()
+	resp, err := c.backend.Get(ctx, etcdpath.Join(t.root, "generations"), &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	if err != nil {
+		if IsEtcdNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	deleted := 0
+	for _, node := range resp.Node.Nodes {
+		gen := etcdpath.Base(node.Key)
+		created, ok := generationTime(gen)
+		if !ok || current != nil && gen == current.Node.Value || time.Since(created) < minAge {
+			continue
+		}
+		t.deleteGeneration(gen)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// undo restores a key written by a failed TxnLock commit.
+type undo struct {
+	key     string
+	value   string
+	existed bool
+	deleted bool
+	// index is the ModifiedIndex of the write, 0 when nothing was written
+	index uint64
+}
+
+func (t *Txn) commitLocked() error {
+	l, err := t.lock()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	if err := l.hold(); err != nil {
+		return err
+	}
+	for key, index := range t.reads {
+		current, err := t.modifiedIndex(key)
+		if err != nil {
+			return err
+		}
+		if current != index {
+			return ErrTxnConflict
+		}
+	}
+
+	var undos []undo
+	for _, w := range t.writes {
+		if err := l.hold(); err != nil {
+			t.rollback(undos)
+			return err
+		}
+		u, err := t.apply(w)
+		if err != nil {
+			t.rollback(undos)
+			if IsEtcdTestFailed(err) || IsEtcdNodeExist(err) || IsEtcdNotFound(err) {
+				return ErrTxnConflict
+			}
+			return err
+		}
+		undos = append(undos, u)
+	}
+	return nil
+}
+
+// txnLock is <root>/_lock held by a TxnLock commit, as of the
+// ModifiedIndex of its last write.
+type txnLock struct {
+	t     *Txn
+	key   string
+	index uint64
+}
+
+// lock takes <root>/_lock, waiting for a holder until the client timeout.
+func (t *Txn) lock() (*txnLock, error) {
+	key := etcdpath.Join(t.root, "_lock")
+	b := make([]byte, 8)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	deadline := time.Now().Add(t.c.timeout)
+	for {
+		ctx, cancel := t.c.newContextWithTimeout()
+		resp, err := t.c.backend.Set(ctx, key, token, &etcdv2.SetOptions{TTL: TxnLockTTL, PrevExist: etcdv2.PrevNoExist})
+		cancel()
+		if err == nil {
+			return &txnLock{t: t, key: key, index: resp.Node.ModifiedIndex}, nil
+		}
+		if !IsEtcdNodeExist(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrTxnLocked
+		}
+		select {
+		case <-t.c.baseContext().Done():
+			return nil, t.c.baseContext().Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// hold refreshes the TTL of the lock by index. When the lock expired, or
+// another commit took it since, it returns ErrTxnConflict: the writes that
+// follow would no longer be serialized.
+func (l *txnLock) hold() error {
+	ctx, cancel := l.t.c.newContextWithTimeout()
+	resp, err := l.t.c.backend.Set(ctx, l.key, "", &etcdv2.SetOptions{TTL: TxnLockTTL, Refresh: true, PrevIndex: l.index})
+	cancel()
+	if IsEtcdTestFailed(err) || IsEtcdNotFound(err) {
+		l.t.c.logger.Log(LevelWarn, "txn lock lost", Field{"key", l.key}, Field{"index", l.index})
+		l.index = 0
+		return ErrTxnConflict
+	}
+	if err != nil {
+		return err
+	}
+	l.index = resp.Node.ModifiedIndex
+	return nil
+}
+
+// release deletes the lock, unless it was lost.
+func (l *txnLock) release() {
+	if l.index == 0 {
+		return
+	}
+	ctx, cancel := l.t.c.newContextWithTimeout()
+	defer cancel()
+	if _, err := l.t.c.backend.Delete(ctx, l.key, &etcdv2.DeleteOptions{PrevIndex: l.index}); err != nil {
+		l.t.c.logger.Log(LevelWarn, "txn lock not released", Field{"key", l.key}, Field{"error", err.Error()})
+	}
+}
+
+func (t *Txn) modifiedIndex(key string) (uint64, error) {
+	ctx, cancel := t.c.newContextWithTimeout()
+	resp, err := t.c.backend.Get(ctx, etcdpath.Join(t.root, key), &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	if IsEtcdNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+// apply does w, by index against the value it reads first, and returns how
+// to undo it.
+func (t *Txn) apply(w txnWrite) (undo, error) {
+	key := etcdpath.Join(t.root, w.key)
+	u := undo{key: key}
+	ctx, cancel := t.c.newContextWithTimeout()
+	resp, err := t.c.backend.Get(ctx, key, &etcdv2.GetOptions{Quorum: true})
+	cancel()
+	switch {
+	case err == nil && resp.Node.Dir:
+		return u, fmt.Errorf("txn: %s is a directory", key)
+	case err == nil:
+		u.existed, u.value = true, resp.Node.Value
+	case !IsEtcdNotFound(err):
+		return u, err
+	}
+
+	ctx, cancel = t.c.newContextWithTimeout()
+	defer cancel()
+	if w.delete {
+		if !u.existed {
+			return u, nil
+		}
+		u.deleted = true
+		resp, err = t.c.backend.Delete(ctx, key, &etcdv2.DeleteOptions{PrevIndex: resp.Node.ModifiedIndex})
+	} else if u.existed {
+		resp, err = t.c.backend.Set(ctx, key, w.value, &etcdv2.SetOptions{PrevIndex: resp.Node.ModifiedIndex})
+	} else {
+		resp, err = t.c.backend.Set(ctx, key, w.value, &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist})
+	}
+	if err != nil {
+		return u, err
+	}
+	u.index = resp.Node.ModifiedIndex
+	return u, nil
+}
+
+// rollback undoes the writes in reverse order. A key written again since
+// is left alone.
+func (t *Txn) rollback(undos []undo) {
+	for i := len(undos) - 1; i >= 0; i-- {
+		u := undos[i]
+		ctx, cancel := t.c.newContextWithTimeout()
+		var err error
+		switch {
+		case u.index == 0:
+		case u.deleted:
+			_, err = t.c.backend.Set(ctx, u.key, u.value, &etcdv2.SetOptions{PrevExist: etcdv2.PrevNoExist})
+		case u.existed:
+			_, err = t.c.backend.Set(ctx, u.key, u.value, &etcdv2.SetOptions{PrevIndex: u.index})
+		default:
+			_, err = t.c.backend.Delete(ctx, u.key, &etcdv2.DeleteOptions{PrevIndex: u.index})
+		}
+		cancel()
+		if err != nil {
+			t.c.logger.Log(LevelError, "txn rollback failed", Field{"key", u.key}, Field{"error", err.Error()})
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func TestTxnGeneration(t *testing.T) {
+	c := newTestClient(t)
+	txn, err := c.BeginTxn("/cfg", TxnGeneration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.Index() != 0 {
+		t.Errorf("index %d before the first commit", txn.Index())
+	}
+	if err := txn.Set("a", "1").Set("b/c", "2").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != errTxnDone {
+		t.Errorf("second commit: %v", err)
+	}
+
+	r, _ := c.BeginTxn("/cfg", TxnGeneration)
+	if snap := r.Snapshot(); len(snap) != 2 || snap["/a"] != "1" || snap["/b/c"] != "2" {
+		t.Fatalf("snapshot %v", snap)
+	}
+
+	// two commits from one snapshot, the second loses
+	t1, _ := c.BeginTxn("/cfg", TxnGeneration)
+	t2, _ := c.BeginTxn("/cfg", TxnGeneration)
+	if err := t1.Set("a", "x").Delete("b/c").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Set("a", "y").Commit(); err != ErrTxnConflict {
+		t.Fatalf("concurrent commit: %v", err)
+	}
+	r2, _ := c.BeginTxn("/cfg", TxnGeneration)
+	if v, ok, _ := r2.Get("a"); v != "x" || !ok || len(r2.Snapshot()) != 1 {
+		t.Errorf("after the conflict %q %v", v, r2.Snapshot())
+	}
+	if r2.Index() == r.Index() {
+		t.Errorf("index %d did not change with the commit", r2.Index())
+	}
+	if gens, _ := c.List("/cfg/generations", false); len(gens) != 1 {
+		t.Errorf("generations left %v", gens)
+	}
+
+	c.MKDir("/cfg/generations/g1-00", 0)
+	if n, err := c.TxnGC("/cfg", time.Minute); n != 1 || err != nil {
+		t.Errorf("gc deleted %d: %v", n, err)
+	}
+}
+
+// TestTxnGenerationReaders commits generations where a and b are always
+// equal while readers check they never see them differ.
+func TestTxnGenerationReaders(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			c, err := NewClientWithConfig(Config{Backend: backend.new()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			done := make(chan struct{})
+			var wg, started sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				started.Add(1)
+				go func() {
+					defer wg.Done()
+					var once sync.Once
+					start := func() { once.Do(started.Done) }
+					defer start()
+					// its own view, the client lock would serialize the
+					// reads with the commits
+					r := c.WithContext(context.Background())
+					for reads := 0; ; reads++ {
+						if reads == 1 {
+							start()
+						}
+						select {
+						case <-done:
+							return
+						default:
+						}
+						txn, err := r.BeginTxn("/gen", TxnGeneration)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if snap := txn.Snapshot(); snap["/a"] != snap["/b"] {
+							t.Errorf("mixed generations %v", snap)
+							return
+						}
+					}
+				}()
+			}
+			started.Wait()
+
+			w := c.WithContext(context.Background())
+			for i := 0; i < 100; i++ {
+				txn, err := w.BeginTxn("/gen", TxnGeneration)
+				if err != nil {
+					t.Fatal(err)
+				}
+				v := fmt.Sprint(i)
+				if err := txn.Set("a", v).Set("b", v).Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func TestTxnLock(t *testing.T) {
+	c := newTestClient(t)
+	c.Set("/lk/n", "1", 0, "", 0)
+
+	l1, _ := c.BeginTxn("/lk", TxnLock)
+	l2, _ := c.BeginTxn("/lk", TxnLock)
+	v, _, _ := l1.Get("n")
+	l2.Get("n")
+	if err := l1.Set("n", v+"1").Set("m", "new").Delete("gone").Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l2.Set("n", "lost").Commit(); err != ErrTxnConflict {
+		t.Errorf("commit of a stale read: %v", err)
+	}
+	if v, _ := c.Get("/lk/n"); v != "11" {
+		t.Errorf("n %q", v)
+	}
+	if _, err := c.Get("/lk/_lock"); !IsEtcdNotFound(err) {
+		t.Errorf("lock left: %v", err)
+	}
+
+	// the second write fails on a directory, the first is rolled back
+	c.MKDir("/lk/dir", 0)
+	l3, _ := c.BeginTxn("/lk", TxnLock)
+	if err := l3.Set("n", "rolled").Delete("m").Set("dir", "x").Commit(); err == nil {
+		t.Error("write to a directory committed")
+	}
+	if v, _ := c.Get("/lk/n"); v != "11" {
+		t.Errorf("n not rolled back: %q", v)
+	}
+	if v, _ := c.Get("/lk/m"); v != "new" {
+		t.Errorf("m not rolled back: %q", v)
+	}
+
+	for _, key := range []string{"_lock", "/_lock/x"} {
+		l, _ := c.BeginTxn("/lk", TxnLock)
+		if err := l.Set(key, "x").Commit(); err == nil {
+			t.Errorf("write to %s committed", key)
+		}
+		l, _ = c.BeginTxn("/lk", TxnLock)
+		if err := l.Delete(key).Commit(); err == nil {
+			t.Errorf("delete of %s committed", key)
+		}
+	}
+}
+
+func TestTxnLockHeld(t *testing.T) {
+	c, err := NewClientWithConfig(Config{Backend: NewMemoryBackend(), Timeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Set("/lk/_lock", "other", 0, "", 0)
+
+	l, _ := c.BeginTxn("/lk", TxnLock)
+	if err := l.Set("n", "1").Commit(); err != ErrTxnLocked {
+		t.Errorf("commit under another lock: %v", err)
+	}
+}
+
+// lockThiefBackend hands the lock of /lk over to another holder once the
+// key steal was written.
+type lockThiefBackend struct {
+	Backend
+	steal string
+}
+
+func (b *lockThiefBackend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	resp, err := b.Backend.Set(ctx, key, value, opts)
+	if err == nil && key == b.steal {
+		b.Backend.Delete(ctx, "/lk/_lock", nil)
+		b.Backend.Set(ctx, "/lk/_lock", "other", &etcdv2.SetOptions{TTL: TxnLockTTL})
+	}
+	return resp, err
+}
+
+func TestTxnLockLost(t *testing.T) {
+	for _, steal := range []string{"/lk/a", "/lk/b"} {
+		t.Run(steal, func(t *testing.T) {
+			b := &lockThiefBackend{Backend: NewMemoryBackend()}
+			c, err := NewClientWithConfig(Config{Backend: b})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Set("/lk/a", "0", 0, "", 0)
+			b.steal = steal
+
+			l, _ := c.BeginTxn("/lk", TxnLock)
+			if err := l.Set("a", "1").Set("b", "1").Set("c", "1").Commit(); err != ErrTxnConflict {
+				t.Fatalf("commit after the lock was taken: %v", err)
+			}
+			if v, _ := c.Get("/lk/a"); v != "0" {
+				t.Errorf("a not rolled back: %q", v)
+			}
+			for _, key := range []string{"/lk/b", "/lk/c"} {
+				if _, err := c.Get(key); !IsEtcdNotFound(err) {
+					t.Errorf("%s written after the lock was lost: %v", key, err)
+				}
+			}
+			if v, _ := c.Get("/lk/_lock"); v != "other" {
+				t.Errorf("lock of the other holder %q", v)
+			}
+		})
+	}
+}
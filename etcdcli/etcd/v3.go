@@ -0,0 +1,701 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"etcdcli/etcdpath"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// V3KeyValue is a key as stored in a v3 cluster.
+type V3KeyValue struct {
+	Key            string
+	Value          string
+	CreateRevision int64
+	ModRevision    int64
+	Lease          int64
+}
+
+// V3Cmp is one guard of a transaction. Target is "value", "mod" (mod
+// revision) or "create" (create revision, 0 when the key does not exist).
+// With RangeEnd set the guard must hold for every key in [Key, RangeEnd);
+// an empty range compares like a missing key.
+type V3Cmp struct {
+	Key      string
+	RangeEnd string
+	Target   string
+	Value    string
+	Revision int64
+}
+
+// V3Op is a put, with an optional lease, or a delete. Prefix deletes every
+// key starting with Key.
+type V3Op struct {
+	Key    string
+	Value  string
+	Lease  int64
+	Delete bool
+	Prefix bool
+}
+
+// V3Event is a put or delete seen by a watch. Kv of a delete only carries
+// Key and ModRevision.
+type V3Event struct {
+	Delete bool
+	Kv     V3KeyValue
+	PrevKv *V3KeyValue
+}
+
+type V3WatchResponse struct {
+	Events []V3Event
+	// Compacted is set when the requested revision is gone.
+	Compacted bool
+	Err       error
+}
+
+// V3Client is the small part of the v3 API the v3 backend needs.
+// NewV3Client adapts *clientv3.Client, NewMemoryV3Client fakes it in memory.
+type V3Client interface {
+	// Range returns the keys equal to key, or starting with key when prefix
+	// is set, sorted, along with the store revision.
+	Range(ctx context.Context, key string, prefix bool) ([]V3KeyValue, int64, error)
+	// Txn applies ops if all cmps hold and returns whether it did and the
+	// store revision afterwards.
+	Txn(ctx context.Context, cmps []V3Cmp, ops []V3Op) (bool, int64, error)
+	Grant(ctx context.Context, ttl int64) (int64, error)
+	// TimeToLive returns the seconds left on lease, -1 once it expired.
+	TimeToLive(ctx context.Context, lease int64) (int64, error)
+	// KeepAliveOnce renews lease to the TTL it was granted with and
+	// returns that TTL.
+	KeepAliveOnce(ctx context.Context, lease int64) (int64, error)
+	// Watch streams changes from revision rev on (0 for now) until ctx ends.
+	Watch(ctx context.Context, key string, prefix bool, rev int64) <-chan V3WatchResponse
+}
+
+// v3Backend lays the v2 keys model out on flat v3 keys:
+//
+//	/a/b     value key, stored as is
+//	/a/      directory marker, only needed for empty directories and TTLs
+//
+// Directories also exist implicitly as soon as a key below them does. TTLs
+// become leases; a directory TTL only expires its marker, not its children.
+// A recursive delete removes the marker along with the keys, watchers get
+// one delete of the directory for it like on v2; an implicit directory is
+// given a marker first, which they do not see.
+type v3Backend struct {
+	kv V3Client
+}
+
+// v3DeletingMarker is the value of the marker an implicit directory gets
+// right before it is deleted.
+const v3DeletingMarker = "\x00deleting"
+
+// NewV3Backend returns a Backend storing its keys in a v3 cluster.
+func NewV3Backend(kv V3Client) Backend {
+	return &v3Backend{kv: kv}
+}
+
+func (b *v3Backend) Members(ctx context.Context) ([]etcdv2.Member, error) {
+	if lister, ok := b.kv.(memberLister); ok {
+		return lister.Members(ctx)
+	}
+	return nil, fmt.Errorf("v3 client does not expose cluster members")
+}
+
+// cleanKey gives keys the v2 shape: a leading slash and no trailing one. The
+// root is the empty string.
+func cleanKey(key string) string {
+	key = strings.TrimRight(key, "/")
+	if key != "" && !strings.HasPrefix(key, "/") {
+		key = "/" + key
+	}
+	return key
+}
+
+// v3State is what the store holds at and below one key.
+type v3State struct {
+	value    *V3KeyValue  // set when key is a value
+	marker   *V3KeyValue  // set when key is a directory with a marker
+	children []V3KeyValue // everything below key, markers included
+	rev      int64
+}
+
+func (s *v3State) exists() bool {
+	return s.value != nil || s.isDir()
+}
+
+func (s *v3State) isDir() bool {
+	return s.marker != nil || len(s.children) > 0
+}
+
+func (b *v3Backend) state(ctx context.Context, key string) (*v3State, error) {
+	kvs, rev, err := b.kv.Range(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	s := &v3State{rev: rev}
+	for i := range kvs {
+		kv := kvs[i]
+		switch {
+		case kv.Key == key:
+			s.value = &kv
+		case kv.Key == key+"/":
+			s.marker = &kv
+		case strings.HasPrefix(kv.Key, key+"/"):
+			s.children = append(s.children, kv)
+		}
+	}
+	return s, nil
+}
+
+// prefixEnd is the end of the range of keys starting with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+// noChildren guards that nothing exists below the directory key, its marker
+// aside.
+func noChildren(key string) V3Cmp {
+	return V3Cmp{Key: key + "/\x00", RangeEnd: prefixEnd(key + "/"), Target: "create"}
+}
+
+// ancestors returns the value keys among the parents of key, which make
+// it unreachable like a file in the middle of a v2 path, and guards that
+// none appears meanwhile.
+func (b *v3Backend) ancestors(ctx context.Context, key string) (string, []V3Cmp, error) {
+	var cmps []V3Cmp
+	for i := strings.LastIndex(key, "/"); i > 0; i = strings.LastIndex(key[:i], "/") {
+		parent := key[:i]
+		kvs, _, err := b.kv.Range(ctx, parent, false)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(kvs) > 0 {
+			return parent, nil, nil
+		}
+		cmps = append(cmps, V3Cmp{Key: parent, Target: "create"})
+	}
+	return "", cmps, nil
+}
+
+func (b *v3Backend) node(ctx context.Context, key string, kv *V3KeyValue, dir bool) *etcdv2.Node {
+	node := &etcdv2.Node{Key: key, Dir: dir}
+	if kv == nil {
+		return node
+	}
+	node.CreatedIndex = uint64(kv.CreateRevision)
+	node.ModifiedIndex = uint64(kv.ModRevision)
+	if !dir {
+		node.Value = kv.Value
+	}
+	if kv.Lease != 0 {
+		if ttl, err := b.kv.TimeToLive(ctx, kv.Lease); err == nil && ttl >= 0 {
+			node.TTL = ttl
+			expiration := time.Now().Add(time.Duration(ttl) * time.Second)
+			node.Expiration = &expiration
+		}
+	}
+	return node
+}
+
+// dirNode builds the directory tree of s, only one level deep unless
+// recursive.
+func (b *v3Backend) dirNode(ctx context.Context, key string, s *v3State, recursive bool) *etcdv2.Node {
+	root := b.node(ctx, key, s.marker, true)
+	dirs := map[string]*etcdv2.Node{key: root}
+
+	var dirFor func(path string) *etcdv2.Node
+	dirFor = func(path string) *etcdv2.Node {
+		if dir, ok := dirs[path]; ok {
+			return dir
+		}
+		parent := dirFor(path[:strings.LastIndex(path, "/")])
+		dir := &etcdv2.Node{Key: path, Dir: true}
+		dirs[path] = dir
+		parent.Nodes = append(parent.Nodes, dir)
+		return dir
+	}
+
+	for i := range s.children {
+		kv := s.children[i]
+		if etcdpath.IsHidden(strings.TrimPrefix(strings.TrimSuffix(kv.Key, "/"), key)) {
+			// left out of listings like on v2
+			continue
+		}
+		if strings.HasSuffix(kv.Key, "/") {
+			dir := dirFor(strings.TrimSuffix(kv.Key, "/"))
+			marked := b.node(ctx, dir.Key, &kv, true)
+			dir.CreatedIndex, dir.ModifiedIndex = marked.CreatedIndex, marked.ModifiedIndex
+			dir.TTL, dir.Expiration = marked.TTL, marked.Expiration
+			continue
+		}
+		parent := dirFor(kv.Key[:strings.LastIndex(kv.Key, "/")])
+		parent.Nodes = append(parent.Nodes, b.node(ctx, kv.Key, &kv, false))
+	}
+
+	if !recursive {
+		for _, child := range root.Nodes {
+			child.Nodes = nil
+		}
+	}
+	sortNodes(root)
+	return root
+}
+
+func sortNodes(node *etcdv2.Node) {
+	sort.Sort(node.Nodes)
+	for _, child := range node.Nodes {
+		sortNodes(child)
+	}
+}
+
+func (b *v3Backend) Get(ctx context.Context, key string, opts *etcdv2.GetOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.GetOptions{}
+	}
+	key = cleanKey(key)
+	s, err := b.state(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdv2.Response{Action: "get", Index: uint64(s.rev)}
+	switch {
+	case s.value != nil:
+		resp.Node = b.node(ctx, key, s.value, false)
+	case s.isDir() || key == "":
+		resp.Node = b.dirNode(ctx, key, s, opts.Recursive)
+	default:
+		return nil, etcdError(etcdv2.ErrorCodeKeyNotFound, "Key not found", key, s.rev)
+	}
+	return resp, nil
+}
+
+func (b *v3Backend) grant(ctx context.Context, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		return 0, nil
+	}
+	return b.kv.Grant(ctx, int64((ttl+time.Second-1)/time.Second))
+}
+
+// refresh renews the lease of key for a refresh to the TTL the lease was
+// granted with, which leaves the value and its revision alone: watchers see
+// nothing, like after a refresh on v2. Keys sharing the lease, as Migration
+// gives them, are renewed along. It returns nil when the node has no lease
+// to renew, or one of another TTL, Set then writes it again.
+func (b *v3Backend) refresh(ctx context.Context, key string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	if opts.TTL <= 0 || opts.PrevValue != "" || opts.PrevIndex != 0 || opts.PrevExist == etcdv2.PrevNoExist {
+		return nil, nil
+	}
+	s, err := b.state(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	current := s.value
+	if opts.Dir {
+		current = s.marker
+	}
+	if current == nil || current.Lease == 0 || opts.Dir == (s.value != nil) {
+		return nil, nil
+	}
+	ttl := int64((opts.TTL + time.Second - 1) / time.Second)
+	if granted, err := b.kv.KeepAliveOnce(ctx, current.Lease); err != nil || granted != ttl {
+		// expired meanwhile or another TTL, left to Set
+		return nil, nil
+	}
+
+	kv := *current
+	kv.Lease = 0
+	node := b.node(ctx, key, &kv, opts.Dir)
+	node.TTL = ttl
+	expiration := time.Now().Add(time.Duration(ttl) * time.Second)
+	node.Expiration = &expiration
+	prev := *node
+	action := "set"
+	if opts.PrevExist == etcdv2.PrevExist {
+		action = "update"
+	}
+	return &etcdv2.Response{Action: action, Node: node, PrevNode: &prev, Index: uint64(s.rev)}, nil
+}
+
+func (b *v3Backend) Set(ctx context.Context, key, value string, opts *etcdv2.SetOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.SetOptions{}
+	}
+	key = cleanKey(key)
+	if key == "" {
+		return nil, etcdError(etcdv2.ErrorCodeRootROnly, "Cannot modify root directory", "/", 0)
+	}
+	if opts.Refresh && value == "" {
+		if resp, err := b.refresh(ctx, key, opts); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+
+	// the lease is granted once, by the first attempt that gets to the Txn;
+	// the retries reuse it
+	var lease int64
+	granted := false
+	for {
+		s, err := b.state(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		action := "set"
+		switch {
+		case opts.PrevValue != "" || opts.PrevIndex != 0:
+			action = "compareAndSwap"
+		case opts.PrevExist == etcdv2.PrevNoExist:
+			action = "create"
+		case opts.PrevExist == etcdv2.PrevExist:
+			action = "update"
+		}
+
+		switch {
+		case opts.Refresh && value != "":
+			return nil, etcdError(etcdv2.ErrorCodeInvalidField, "Value provided on refresh", key, s.rev)
+		case (opts.PrevExist == etcdv2.PrevExist || opts.Refresh) && !s.exists():
+			return nil, etcdError(etcdv2.ErrorCodeKeyNotFound, "Key not found", key, s.rev)
+		case opts.PrevExist == etcdv2.PrevNoExist && s.exists():
+			return nil, etcdError(etcdv2.ErrorCodeNodeExist, "Key already exists", key, s.rev)
+		case opts.Dir && s.value != nil && action != "set":
+			return nil, etcdError(etcdv2.ErrorCodeNotDir, "Not a directory", key, s.rev)
+		case s.isDir() && !(opts.Dir && action == "update"):
+			// like v2, a directory is only ever updated, never replaced
+			return nil, etcdError(etcdv2.ErrorCodeNotFile, "Not a file", key, s.rev)
+		case action == "compareAndSwap" && s.value == nil:
+			return nil, etcdError(etcdv2.ErrorCodeKeyNotFound, "Key not found", key, s.rev)
+		case opts.PrevValue != "" && s.value.Value != opts.PrevValue,
+			opts.PrevIndex != 0 && uint64(s.value.ModRevision) != opts.PrevIndex:
+			return nil, etcdError(etcdv2.ErrorCodeTestFailed, "Compare failed", key, s.rev)
+		}
+
+		file, cmps, err := b.ancestors(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if file != "" {
+			return nil, etcdError(etcdv2.ErrorCodeNotDir, "Not a directory", file, s.rev)
+		}
+
+		target, current := key, s.value
+		if opts.Dir {
+			target, current = key+"/", s.marker
+		}
+		if opts.Refresh && current != nil {
+			value = current.Value
+		}
+
+		var prev *etcdv2.Node
+		var ops []V3Op
+		cmp := V3Cmp{Key: target, Target: "create"}
+		if current != nil {
+			prev = b.node(ctx, key, current, opts.Dir)
+			cmp = V3Cmp{Key: target, Target: "mod", Revision: current.ModRevision}
+		}
+		cmps = append(cmps, cmp)
+		switch {
+		case opts.Dir && s.value != nil:
+			// a plain set replaces the value with the directory
+			prev = b.node(ctx, key, s.value, false)
+			cmps = append(cmps, V3Cmp{Key: key, Target: "mod", Revision: s.value.ModRevision})
+			ops = append(ops, V3Op{Key: key, Delete: true})
+		case opts.Dir:
+			// nor may a value appear at key meanwhile
+			cmps = append(cmps, V3Cmp{Key: key, Target: "create"})
+		default:
+			// nor a directory
+			cmps = append(cmps, noChildren(key), V3Cmp{Key: key + "/", Target: "create"})
+		}
+
+		if !granted {
+			if lease, err = b.grant(ctx, opts.TTL); err != nil {
+				return nil, err
+			}
+			granted = true
+		}
+		if opts.Dir {
+			value = ""
+		}
+		ops = append(ops, V3Op{Key: target, Value: value, Lease: lease})
+		ok, rev, err := b.kv.Txn(ctx, cmps, ops)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// somebody else wrote the key meanwhile, check the options again
+			continue
+		}
+
+		node := &etcdv2.Node{Key: key, Dir: opts.Dir, Value: value, ModifiedIndex: uint64(rev), CreatedIndex: uint64(rev)}
+		if current != nil {
+			node.CreatedIndex = uint64(current.CreateRevision)
+		}
+		if lease != 0 {
+			node.TTL = int64((opts.TTL + time.Second - 1) / time.Second)
+			expiration := time.Now().Add(time.Duration(node.TTL) * time.Second)
+			node.Expiration = &expiration
+		}
+		return &etcdv2.Response{Action: action, Node: node, PrevNode: prev, Index: uint64(rev)}, nil
+	}
+}
+
+func (b *v3Backend) Delete(ctx context.Context, key string, opts *etcdv2.DeleteOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.DeleteOptions{}
+	}
+	key = cleanKey(key)
+	if key == "" {
+		return nil, etcdError(etcdv2.ErrorCodeRootROnly, "Cannot modify root directory", "/", 0)
+	}
+
+	for {
+		s, err := b.state(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		action := "delete"
+		if opts.PrevValue != "" || opts.PrevIndex != 0 {
+			action = "compareAndDelete"
+		}
+
+		var prev *etcdv2.Node
+		var cmps []V3Cmp
+		var ops []V3Op
+		switch {
+		case s.value != nil:
+			if opts.PrevValue != "" && s.value.Value != opts.PrevValue ||
+				opts.PrevIndex != 0 && uint64(s.value.ModRevision) != opts.PrevIndex {
+				return nil, etcdError(etcdv2.ErrorCodeTestFailed, "Compare failed", key, s.rev)
+			}
+			prev = b.node(ctx, key, s.value, false)
+			cmps = []V3Cmp{{Key: key, Target: "mod", Revision: s.value.ModRevision}}
+			ops = []V3Op{{Key: key, Delete: true}}
+
+		case s.isDir():
+			if !opts.Dir && !opts.Recursive {
+				return nil, etcdError(etcdv2.ErrorCodeNotFile, "Not a file", key, s.rev)
+			}
+			if action == "compareAndDelete" {
+				return nil, etcdError(etcdv2.ErrorCodeNotFile, "Not a file", key, s.rev)
+			}
+			if !opts.Recursive && len(s.children) > 0 {
+				return nil, etcdError(etcdv2.ErrorCodeDirNotEmpty, "Directory not empty", key, s.rev)
+			}
+			if s.marker == nil {
+				// the keys below would go one by one for watchers, the
+				// marker makes it the directory
+				_, _, err := b.kv.Txn(ctx, []V3Cmp{{Key: key + "/", Target: "create"}}, []V3Op{{Key: key + "/", Value: v3DeletingMarker}})
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			prev = b.node(ctx, key, s.marker, true)
+			ops = []V3Op{{Key: key + "/", Delete: true, Prefix: true}}
+			if !opts.Recursive {
+				// the marker must be unchanged and nothing may appear below
+				// it meanwhile, or the new child would be orphaned
+				ops[0].Prefix = false
+				cmps = []V3Cmp{{Key: key + "/", Target: "mod", Revision: s.marker.ModRevision}, noChildren(key)}
+			}
+
+		default:
+			return nil, etcdError(etcdv2.ErrorCodeKeyNotFound, "Key not found", key, s.rev)
+		}
+
+		ok, rev, err := b.kv.Txn(ctx, cmps, ops)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		node := &etcdv2.Node{Key: key, Dir: prev.Dir, CreatedIndex: prev.CreatedIndex, ModifiedIndex: uint64(rev)}
+		return &etcdv2.Response{Action: action, Node: node, PrevNode: prev, Index: uint64(rev)}, nil
+	}
+}
+
+func (b *v3Backend) CreateInOrder(ctx context.Context, dir, value string, opts *etcdv2.CreateInOrderOptions) (*etcdv2.Response, error) {
+	if opts == nil {
+		opts = &etcdv2.CreateInOrderOptions{}
+	}
+	dir = cleanKey(dir)
+
+	for {
+		s, err := b.state(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		if s.value != nil {
+			return nil, etcdError(etcdv2.ErrorCodeNotDir, "Not a directory", dir, s.rev)
+		}
+
+		// Like v2, name the key after the index it is created at.
+		key := fmt.Sprintf("%s/%020d", dir, s.rev+1)
+		resp, err := b.Set(ctx, key, value, &etcdv2.SetOptions{TTL: opts.TTL, PrevExist: etcdv2.PrevNoExist})
+		if IsEtcdNodeExist(err) {
+			continue
+		}
+		return resp, err
+	}
+}
+
+func (b *v3Backend) Watcher(key string, opts *etcdv2.WatcherOptions) etcdv2.Watcher {
+	if opts == nil {
+		opts = &etcdv2.WatcherOptions{}
+	}
+	w := &v3Watcher{b: b, key: cleanKey(key), recursive: opts.Recursive}
+	if opts.AfterIndex != 0 {
+		w.next = int64(opts.AfterIndex) + 1
+	}
+	return w
+}
+
+// v3Watcher turns a v3 watch stream into v2 watch responses. The stream is
+// opened by Next and kept while Next is called with the same context.
+type v3Watcher struct {
+	b         *v3Backend
+	key       string
+	recursive bool
+
+	mu      sync.Mutex
+	next    int64
+	ctx     context.Context
+	cancel  context.CancelFunc
+	ch      <-chan V3WatchResponse
+	pending []*etcdv2.Response
+}
+
+func (w *v3Watcher) Next(ctx context.Context) (*etcdv2.Response, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.pending) == 0 {
+		if w.ch == nil || w.ctx != ctx {
+			if w.cancel != nil {
+				w.cancel()
+			}
+			var wctx context.Context
+			wctx, w.cancel = context.WithCancel(ctx)
+			w.ctx = ctx
+			w.ch = w.b.kv.Watch(wctx, w.key, true, w.next)
+		}
+
+		select {
+		case <-ctx.Done():
+			w.cancel()
+			w.ch = nil
+			return nil, ctx.Err()
+		case resp, ok := <-w.ch:
+			if !ok {
+				w.ch = nil
+				continue
+			}
+			if resp.Compacted {
+				w.cancel()
+				w.ch = nil
+				return nil, etcdError(etcdv2.ErrorCodeEventIndexCleared, "The event in requested index is outdated and cleared", w.key, w.next)
+			}
+			if resp.Err != nil {
+				w.cancel()
+				w.ch = nil
+				return nil, resp.Err
+			}
+			for i, ev := range resp.Events {
+				if r := w.response(ctx, ev); r != nil && !deletedWithDir(resp.Events, i) {
+					w.pending = append(w.pending, r)
+				}
+				w.next = ev.Kv.ModRevision + 1
+			}
+		}
+	}
+
+	resp := w.pending[0]
+	w.pending = w.pending[1:]
+	return resp, nil
+}
+
+// deletedWithDir reports whether events[i] is the delete of a key below a
+// directory whose marker was deleted in the same revision: v2 only has the
+// delete of the directory.
+func deletedWithDir(events []V3Event, i int) bool {
+	ev := events[i]
+	if !ev.Delete {
+		return false
+	}
+	for _, dir := range events {
+		if dir.Delete && dir.Kv.ModRevision == ev.Kv.ModRevision && strings.HasSuffix(dir.Kv.Key, "/") &&
+			ev.Kv.Key != dir.Kv.Key && strings.HasPrefix(ev.Kv.Key, dir.Kv.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// response converts ev, or returns nil when the v2 watch would not see it.
+func (w *v3Watcher) response(ctx context.Context, ev V3Event) *etcdv2.Response {
+	key, dir := ev.Kv.Key, false
+	if strings.HasSuffix(key, "/") {
+		key, dir = strings.TrimSuffix(key, "/"), true
+	}
+	if dir && !ev.Delete && ev.Kv.Value == v3DeletingMarker {
+		return nil
+	}
+	switch {
+	case key == w.key:
+	case w.recursive && (w.key == "" || strings.HasPrefix(key, w.key+"/")) && !etcdpath.IsHidden(strings.TrimPrefix(key, w.key)):
+	default:
+		return nil
+	}
+
+	resp := &etcdv2.Response{Index: uint64(ev.Kv.ModRevision)}
+	if ev.PrevKv != nil {
+		resp.PrevNode = w.b.node(ctx, key, ev.PrevKv, dir)
+	}
+	if ev.Delete {
+		resp.Action = "delete"
+		// v3 does not tell why a key went away; a dead lease means it expired
+		if ev.PrevKv != nil && ev.PrevKv.Lease != 0 {
+			if ttl, err := w.b.kv.TimeToLive(ctx, ev.PrevKv.Lease); err == nil && ttl < 0 {
+				resp.Action = "expire"
+			}
+		}
+		resp.Node = &etcdv2.Node{Key: key, Dir: dir, ModifiedIndex: uint64(ev.Kv.ModRevision)}
+		if resp.PrevNode != nil {
+			resp.Node.CreatedIndex = resp.PrevNode.CreatedIndex
+		}
+		return resp
+	}
+
+	resp.Action = "set"
+	if ev.Kv.CreateRevision == ev.Kv.ModRevision {
+		resp.Action = "create"
+	}
+	resp.Node = w.b.node(ctx, key, &ev.Kv, dir)
+	return resp
+}
+
+// V3 returns the v3 client behind c when it runs on the v3 backend.
+func (c *Client) V3() (V3Client, bool) {
+	isV3 := func(b Backend) bool { _, ok := b.(*v3Backend); return ok }
+	if b, ok := findBackend(c.backend, isV3).(*v3Backend); ok {
+		return b.kv, true
+	}
+	return nil, false
+}
@@ -0,0 +1,164 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+
+	etcdv2 "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+type v3Client struct {
+	c *clientv3.Client
+}
+
+// NewV3Client adapts a v3 client connection for NewV3Backend.
+func NewV3Client(c *clientv3.Client) V3Client {
+	return &v3Client{c: c}
+}
+
+func fromMVCC(kv *mvccpb.KeyValue) V3KeyValue {
+	return V3KeyValue{
+		Key:            string(kv.Key),
+		Value:          string(kv.Value),
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Lease:          kv.Lease,
+	}
+}
+
+func (v *v3Client) Range(ctx context.Context, key string, prefix bool) ([]V3KeyValue, int64, error) {
+	var opts []clientv3.OpOption
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	resp, err := v.c.Get(ctx, key, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	kvs := make([]V3KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, fromMVCC(kv))
+	}
+	return kvs, resp.Header.Revision, nil
+}
+
+func (v *v3Client) Txn(ctx context.Context, cmps []V3Cmp, ops []V3Op) (bool, int64, error) {
+	var ifs []clientv3.Cmp
+	for _, cmp := range cmps {
+		var c clientv3.Cmp
+		switch cmp.Target {
+		case "value":
+			c = clientv3.Compare(clientv3.Value(cmp.Key), "=", cmp.Value)
+		case "mod":
+			c = clientv3.Compare(clientv3.ModRevision(cmp.Key), "=", cmp.Revision)
+		case "create":
+			c = clientv3.Compare(clientv3.CreateRevision(cmp.Key), "=", cmp.Revision)
+		default:
+			return false, 0, fmt.Errorf("unknown compare target %q", cmp.Target)
+		}
+		if cmp.RangeEnd != "" {
+			c = c.WithRange(cmp.RangeEnd)
+		}
+		ifs = append(ifs, c)
+	}
+
+	var thens []clientv3.Op
+	for _, op := range ops {
+		var opts []clientv3.OpOption
+		if op.Prefix {
+			opts = append(opts, clientv3.WithPrefix())
+		}
+		if op.Delete {
+			thens = append(thens, clientv3.OpDelete(op.Key, opts...))
+			continue
+		}
+		if op.Lease != 0 {
+			opts = append(opts, clientv3.WithLease(clientv3.LeaseID(op.Lease)))
+		}
+		thens = append(thens, clientv3.OpPut(op.Key, op.Value, opts...))
+	}
+
+	resp, err := v.c.Txn(ctx).If(ifs...).Then(thens...).Commit()
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+func (v *v3Client) Grant(ctx context.Context, ttl int64) (int64, error) {
+	resp, err := v.c.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	return int64(resp.ID), nil
+}
+
+func (v *v3Client) TimeToLive(ctx context.Context, lease int64) (int64, error) {
+	resp, err := v.c.TimeToLive(ctx, clientv3.LeaseID(lease))
+	if err != nil {
+		return 0, err
+	}
+	return resp.TTL, nil
+}
+
+func (v *v3Client) KeepAliveOnce(ctx context.Context, lease int64) (int64, error) {
+	resp, err := v.c.KeepAliveOnce(ctx, clientv3.LeaseID(lease))
+	if err != nil {
+		return 0, err
+	}
+	return resp.TTL, nil
+}
+
+func (v *v3Client) Watch(ctx context.Context, key string, prefix bool, rev int64) <-chan V3WatchResponse {
+	opts := []clientv3.OpOption{clientv3.WithPrevKV()}
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+
+	out := make(chan V3WatchResponse)
+	go func() {
+		defer close(out)
+		for wresp := range v.c.Watch(ctx, key, opts...) {
+			resp := V3WatchResponse{Compacted: wresp.CompactRevision != 0}
+			if !resp.Compacted {
+				resp.Err = wresp.Err()
+			}
+			for _, ev := range wresp.Events {
+				event := V3Event{Delete: ev.Type == mvccpb.DELETE, Kv: fromMVCC(ev.Kv)}
+				if ev.PrevKv != nil {
+					prev := fromMVCC(ev.PrevKv)
+					event.PrevKv = &prev
+				}
+				resp.Events = append(resp.Events, event)
+			}
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (v *v3Client) Members(ctx context.Context) ([]etcdv2.Member, error) {
+	resp, err := v.c.MemberList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]etcdv2.Member, 0, len(resp.Members))
+	for _, m := range resp.Members {
+		members = append(members, etcdv2.Member{
+			ID:         fmt.Sprintf("%x", m.ID),
+			Name:       m.Name,
+			PeerURLs:   m.PeerURLs,
+			ClientURLs: m.ClientURLs,
+		})
+	}
+	return members, nil
+}
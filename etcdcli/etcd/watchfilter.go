@@ -0,0 +1,148 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// WatchOptions select and batch the events of WatchBatches. The filters
+// apply before batching, an event needs to pass all of those set.
+type WatchOptions struct {
+	Recursive bool
+	// Actions are the actions delivered, "set", "delete", "expire" and so
+	// on; all when empty.
+	Actions []string
+	// Glob is a path.Match pattern for the key of the event; "*" does not
+	// match a slash, "/cfg/*/port" matches /cfg/a/port but not
+	// /cfg/a/b/port.
+	Glob string
+	// Regexp matches the key of the event.
+	Regexp *regexp.Regexp
+
+	// Window coalesces events: the batch is delivered once no event has come
+	// for Window. 0 delivers every event on its own.
+	Window time.Duration
+	// MaxDelay bounds how long the first event of a batch may wait while
+	// events keep coming, 10 times Window by default.
+	MaxDelay time.Duration
+}
+
+func (o *WatchOptions) matcher() (func(resp *etcdv2.Response) bool, error) {
+	if o.Glob != "" {
+		if _, err := path.Match(o.Glob, ""); err != nil {
+			return nil, fmt.Errorf("watch glob %q: %v", o.Glob, err)
+		}
+	}
+	actions := make(map[string]bool)
+	for _, action := range o.Actions {
+		actions[action] = true
+	}
+	return func(resp *etcdv2.Response) bool {
+		if len(actions) > 0 && !actions[resp.Action] {
+			return false
+		}
+		if o.Glob != "" {
+			if ok, _ := path.Match(o.Glob, resp.Node.Key); !ok {
+				return false
+			}
+		}
+		return o.Regexp == nil || o.Regexp.MatchString(resp.Node.Key)
+	}, nil
+}
+
+// WatchBatches watches key like Watch and hands the events that pass the
+// filters of opts to onBatch, in order, coalesced in batches as opts says.
+// onBatch runs on the calling goroutine, the watch goes on meanwhile; it
+// returns true to stop. Events pending when the watch fails are delivered
+// before the error is returned.
+func (c *Client) WatchBatches(key string, opts WatchOptions, onBatch func(batch []*etcdv2.Response) bool) error {
+	match, err := opts.matcher()
+	if err != nil {
+		return err
+	}
+	maxDelay := opts.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 10 * opts.Window
+	}
+
+	ctx, cancel := context.WithCancel(c.baseContext())
+	defer cancel()
+	events := make(chan *etcdv2.Response)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.watch(ctx, key, opts.Recursive, func(resp *etcdv2.Response) bool {
+			if !match(resp) {
+				return false
+			}
+			select {
+			case events <- resp:
+				return false
+			case <-ctx.Done():
+				return true
+			}
+		})
+	}()
+
+	var batch []*etcdv2.Response
+	window := time.NewTimer(time.Hour)
+	stopTimer(window)
+	deadline := time.NewTimer(time.Hour)
+	stopTimer(deadline)
+	defer window.Stop()
+	defer deadline.Stop()
+
+	for {
+		flush := false
+		select {
+		case resp := <-events:
+			batch = append(batch, resp)
+			if opts.Window <= 0 {
+				flush = true
+				break
+			}
+			stopTimer(window)
+			window.Reset(opts.Window)
+			if len(batch) == 1 {
+				deadline.Reset(maxDelay)
+			}
+		case <-window.C:
+			flush = len(batch) > 0
+		case <-deadline.C:
+			flush = len(batch) > 0
+		case err := <-done:
+			if len(batch) > 0 {
+				onBatch(batch)
+			}
+			return err
+		}
+		if !flush {
+			continue
+		}
+
+		stopTimer(window)
+		stopTimer(deadline)
+		stop := onBatch(batch)
+		batch = nil
+		if stop {
+			cancel()
+			<-done
+			return nil
+		}
+	}
+}
+
+// stopTimer stops t and drains a tick it may have sent already, so that a
+// Reset does not see a stale one.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+// batchRecorder collects the batches of WatchBatches.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]string
+	times   []time.Time
+	stop    func(batch []*etcdv2.Response) bool
+}
+
+func (r *batchRecorder) onBatch(batch []*etcdv2.Response) bool {
+	keys := make([]string, 0, len(batch))
+	for _, resp := range batch {
+		keys = append(keys, resp.Action+" "+resp.Node.Key)
+	}
+	r.mu.Lock()
+	r.batches = append(r.batches, keys)
+	r.times = append(r.times, time.Now())
+	r.mu.Unlock()
+	return r.stop != nil && r.stop(batch)
+}
+
+func (r *batchRecorder) get() ([][]string, []time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.batches...), append([]time.Time(nil), r.times...)
+}
+
+// startBatches runs WatchBatches on c until it returns, and gives the watch
+// time to open.
+func startBatches(c *Client, key string, opts WatchOptions, r *batchRecorder) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WatchBatches(key, opts, r.onBatch)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	return done
+}
+
+func TestWatchBatchesCoalesce(t *testing.T) {
+	c := newTestClient(t)
+	r := &batchRecorder{}
+	startBatches(c, "/b", WatchOptions{Recursive: true, Window: 100 * time.Millisecond}, r)
+
+	for i := 0; i < 3; i++ {
+		c.Set(fmt.Sprintf("/b/%d", i), "v", 0, "", 0)
+	}
+	time.Sleep(300 * time.Millisecond)
+	c.Set("/b/later", "v", 0, "", 0)
+	time.Sleep(300 * time.Millisecond)
+
+	batches, _ := r.get()
+	want := [][]string{{"create /b/0", "create /b/1", "create /b/2"}, {"create /b/later"}}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("batches %q, want %q", batches, want)
+	}
+}
+
+func TestWatchBatchesMaxDelay(t *testing.T) {
+	c := newTestClient(t)
+	r := &batchRecorder{}
+	startBatches(c, "/b", WatchOptions{Recursive: true, Window: 100 * time.Millisecond, MaxDelay: 250 * time.Millisecond}, r)
+
+	// events keep coming faster than the window
+	start := time.Now()
+	for i := 0; i < 14; i++ {
+		c.Set("/b/k", fmt.Sprint(i), 0, "", 0)
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	batches, times := r.get()
+	if len(batches) < 2 {
+		t.Fatalf("batches %q", batches)
+	}
+	if first := times[0].Sub(start); first > 400*time.Millisecond {
+		t.Errorf("first batch after %v, MaxDelay 250ms", first)
+	}
+	total := 0
+	for _, batch := range batches {
+		total += len(batch)
+	}
+	if total != 14 {
+		t.Errorf("%d events in %q", total, batches)
+	}
+}
+
+func TestWatchBatchesFilters(t *testing.T) {
+	tests := []struct {
+		name string
+		opts WatchOptions
+		want [][]string
+	}{
+		{"actions", WatchOptions{Actions: []string{"delete"}}, [][]string{{"delete /f/a/port"}}},
+		{"glob", WatchOptions{Glob: "/f/*/port"}, [][]string{{"create /f/a/port"}, {"set /f/a/port"}, {"delete /f/a/port"}}},
+		{"regexp", WatchOptions{Regexp: regexp.MustCompile(`/host$`)}, [][]string{{"create /f/a/b/host"}}},
+		{"all", WatchOptions{Actions: []string{"create", "delete"}, Glob: "/f/*/*"}, [][]string{{"create /f/a/port"}, {"delete /f/a/port"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t)
+			r := &batchRecorder{}
+			tt.opts.Recursive = true
+			startBatches(c, "/f", tt.opts, r)
+
+			c.Set("/f/a/port", "1", 0, "", 0)
+			c.Set("/f/a/b/host", "h", 0, "", 0)
+			c.Set("/f/a/port", "2", 0, "", 0)
+			c.RM("/f/a/port", false, false, "", 0)
+			time.Sleep(100 * time.Millisecond)
+
+			if batches, _ := r.get(); !reflect.DeepEqual(batches, tt.want) {
+				t.Errorf("batches %q, want %q", batches, tt.want)
+			}
+		})
+	}
+
+	c := newTestClient(t)
+	if err := c.WatchBatches("/f", WatchOptions{Glob: "["}, nil); err == nil {
+		t.Error("bad glob accepted")
+	}
+}
+
+func TestWatchBatchesStop(t *testing.T) {
+	c := newTestClient(t)
+	r := &batchRecorder{stop: func(batch []*etcdv2.Response) bool { return true }}
+	done := startBatches(c, "/s", WatchOptions{Recursive: true, Window: 50 * time.Millisecond}, r)
+
+	c.Set("/s/a", "1", 0, "", 0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("stopped with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("onBatch returned true, the watch went on")
+	}
+	c.Set("/s/b", "1", 0, "", 0)
+	if batches, _ := r.get(); len(batches) != 1 {
+		t.Errorf("batches after stop %q", batches)
+	}
+}
+
+func TestWatchBatchesFlushOnError(t *testing.T) {
+	c := newTestClient(t)
+	r := &batchRecorder{}
+	done := startBatches(c, "/e", WatchOptions{Recursive: true, Window: time.Hour}, r)
+
+	c.Set("/e/a", "1", 0, "", 0)
+	c.Set("/e/b", "1", 0, "", 0)
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("watch ended with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("watch went on after close")
+	}
+	want := [][]string{{"create /e/a", "create /e/b"}}
+	if batches, _ := r.get(); !reflect.DeepEqual(batches, want) {
+		t.Errorf("batches %q, want %q", batches, want)
+	}
+}
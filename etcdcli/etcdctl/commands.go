@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"etcdcli/etcd"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+var errClusterNotHealthy = errors.New("cluster is unhealthy")
+
+// env is what every command runs against.
+type env struct {
+	client *etcd.Client
+	// config is what client was built from, for commands that need a
+	// second client
+	config etcd.Config
+	output string
+}
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	// quiet commands print their own output, the client must not echo responses
+	quiet bool
+	run   func(e *env, args []string) error
+}
+
+var commands = map[string]*command{}
+
+func register(cmd *command) {
+	commands[cmd.name] = cmd
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	register(&command{name: "get", usage: "<key>", help: "retrieve the value of a key", run: runGet})
+	register(&command{name: "set", usage: "[--ttl n] [--swap-with-value v] [--swap-with-index i] <key> <value>", help: "set the value of a key", run: runSet})
+	register(&command{name: "mk", usage: "[--ttl n] [--in-order] <key> <value>", help: "make a new key with a given value", run: runMK})
+	register(&command{name: "mkdir", usage: "[--ttl n] <key>", help: "make a new directory", run: runMKDir})
+	register(&command{name: "update", usage: "[--ttl n] <key> <value>", help: "update an existing key with a given value", run: runUpdate})
+	register(&command{name: "rm", usage: "[--dir] [--recursive] [--with-value v] [--with-index i] <key>", help: "remove a key or a directory", run: runRM})
+	register(&command{name: "rmdir", usage: "<key>", help: "remove the key if it is an empty directory", run: runRMDir})
+	register(&command{name: "ls", usage: "[--recursive] [<key>]", help: "retrieve a directory", run: runLS})
+	register(&command{name: "watch", usage: "[--recursive] [--forever] <key>", help: "watch a key for changes", quiet: true, run: runWatch})
+	register(&command{name: "exec-watch", usage: "[--recursive] <key> -- <command> [arguments...]", help: "watch a key for changes and exec an executable", quiet: true, run: runExecWatch})
+	register(&command{name: "cluster-health", usage: "", help: "check the health of the etcd cluster", quiet: true, run: runClusterHealth})
+}
+
+func parse(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		return nil, errBadArgs(err.Error())
+	}
+	if fs.NArg() != nargs {
+		return nil, errBadArgs(fmt.Sprintf("%s: expected %d argument(s), got %d", fs.Name(), nargs, fs.NArg()))
+	}
+	return fs.Args(), nil
+}
+
+// stringsFlag collects a repeatable string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func runGet(e *env, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	_, err = e.client.Get(args[0])
+	return err
+}
+
+func runSet(e *env, args []string) error {
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	ttl := fs.Int64("ttl", 0, "key time-to-live in seconds")
+	swapValue := fs.String("swap-with-value", "", "previous value")
+	swapIndex := fs.Int64("swap-with-index", 0, "previous index")
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return e.client.Set(args[0], args[1], *ttl, *swapValue, *swapIndex)
+}
+
+func runMK(e *env, args []string) error {
+	fs := flag.NewFlagSet("mk", flag.ContinueOnError)
+	ttl := fs.Int64("ttl", 0, "key time-to-live in seconds")
+	inOrder := fs.Bool("in-order", false, "create in-order key under directory <key>")
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return e.client.MK(args[0], args[1], *ttl, *inOrder)
+}
+
+func runMKDir(e *env, args []string) error {
+	fs := flag.NewFlagSet("mkdir", flag.ContinueOnError)
+	ttl := fs.Int64("ttl", 0, "key time-to-live in seconds")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	return e.client.MKDir(args[0], *ttl)
+}
+
+func runUpdate(e *env, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	ttl := fs.Int64("ttl", 0, "key time-to-live in seconds")
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return e.client.Update(args[0], args[1], *ttl)
+}
+
+func runRM(e *env, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	dir := fs.Bool("dir", false, "removes the key if it is an empty directory or a key-value pair")
+	recursive := fs.Bool("recursive", false, "removes the key and all child keys (if it is a directory)")
+	withValue := fs.String("with-value", "", "previous value")
+	withIndex := fs.Int64("with-index", 0, "previous index")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	return e.client.RM(args[0], *dir, *recursive, *withValue, *withIndex)
+}
+
+func runRMDir(e *env, args []string) error {
+	fs := flag.NewFlagSet("rmdir", flag.ContinueOnError)
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	return e.client.RMDir(args[0])
+}
+
+func runLS(e *env, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	recursive := fs.Bool("recursive", false, "returns all key names recursively for the given path")
+	key := "/"
+	if err := fs.Parse(args); err != nil {
+		return errBadArgs(err.Error())
+	}
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		key = fs.Arg(0)
+	default:
+		return errBadArgs("ls: too many arguments")
+	}
+	_, err := e.client.List(key, *recursive)
+	return err
+}
+
+func runWatch(e *env, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	recursive := fs.Bool("recursive", false, "returns all values for key and child keys")
+	forever := fs.Bool("forever", false, "forever watch a key until CTRL+C")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	err = e.client.Watch(args[0], *recursive, func(action string, path string, value string) bool {
+		printEvent(e.output, action, path, value)
+		return !*forever
+	})
+	return watchError(err)
+}
+
+func runExecWatch(e *env, args []string) error {
+	fs := flag.NewFlagSet("exec-watch", flag.ContinueOnError)
+	recursive := fs.Bool("recursive", false, "watch all values for key and child keys")
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil {
+		return errBadArgs(err.Error())
+	}
+	// flag stops at the first non-flag argument and leaves "--" in place
+	rest := fs.Args()
+	if len(rest) < 3 || rest[1] != "--" {
+		return errBadArgs("exec-watch: expected <key> -- <command>")
+	}
+	key, argv := rest[0], rest[2:]
+
+	err := e.client.Watch(key, *recursive, func(action string, path string, value string) bool {
+		cmd := exec.Command(argv[0], argv[1:]...)
+		cmd.Env = append(os.Environ(),
+			"ETCD_WATCH_ACTION="+action,
+			"ETCD_WATCH_KEY="+path,
+			"ETCD_WATCH_VALUE="+value,
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return false
+	})
+	return watchError(err)
+}
+
+// watchError hides the cancellation caused by Ctrl-C.
+func watchError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// printEvent renders a watch event through the same formatters as responses.
+func printEvent(format string, action string, path string, value string) {
+	resp := &etcdv2.Response{Action: action, Node: &etcdv2.Node{Key: path, Value: value}}
+	if action == "delete" || action == "expire" || action == "compareAndDelete" {
+		resp.PrevNode = &etcdv2.Node{Key: path, Value: value}
+	}
+	if err := etcd.PrintResponse(os.Stdout, resp, format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func runClusterHealth(e *env, args []string) error {
+	fs := flag.NewFlagSet("cluster-health", flag.ContinueOnError)
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	members, err := e.client.Members()
+	if err != nil {
+		return err
+	}
+
+	healthy := 0
+	for _, m := range members {
+		if err := e.client.MemberHealth(m); err != nil {
+			fmt.Printf("member %s is unhealthy: %v\n", m.ID, err)
+			continue
+		}
+		healthy++
+		fmt.Printf("member %s is healthy: %v\n", m.ID, m.ClientURLs)
+	}
+
+	if healthy == 0 || healthy <= len(members)/2 {
+		fmt.Printf("cluster is unhealthy (%d/%d members healthy)\n", healthy, len(members))
+		return errClusterNotHealthy
+	}
+	fmt.Println("cluster is healthy")
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"etcdcli/etcd"
+)
+
+func init() {
+	register(&command{name: "diff", usage: "[--ignore pattern]... [--format text|json] [--against endpoints | --file dump] <prefix> [<other prefix>]", help: "compare two subtrees, two clusters or a dump with live data", quiet: true, run: runDiff})
+}
+
+func runDiff(e *env, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	var ignore stringsFlag
+	fs.Var(&ignore, "ignore", "skip keys matching this pattern, relative to the prefix (repeatable)")
+	format := fs.String("format", "text", "text or json")
+	against := fs.String("against", "", "comma separated endpoints of a second cluster to compare with")
+	file := fs.String("file", "", "compare a dump written by export with live data")
+	if err := fs.Parse(args); err != nil {
+		return errBadArgs(err.Error())
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errBadArgs("diff: expected one or two prefixes")
+	}
+	if *against != "" && *file != "" {
+		return errBadArgs("diff: --against and --file are exclusive")
+	}
+	if *format != "text" && *format != "json" {
+		return errBadArgs("diff: unsupported format " + *format)
+	}
+
+	a := fs.Arg(0)
+	b := a
+	if fs.NArg() == 2 {
+		b = fs.Arg(1)
+	}
+	opts := etcd.DiffOptions{Ignore: ignore}
+
+	var changes []etcd.Change
+	var err error
+	oldLabel, newLabel := a, b
+	switch {
+	case *file != "":
+		changes, err = diffDump(e, *file, b, opts)
+		oldLabel = *file
+	case *against != "":
+		cfg := e.config
+		cfg.Endpoints = strings.Split(*against, ",")
+		cfg.Format = ""
+		var other *etcd.Client
+		if other, err = newClient(cfg); err != nil {
+			return err
+		}
+		defer other.Close()
+		changes, err = e.client.Diff(a, other, b, opts)
+		newLabel = *against + b
+	default:
+		if fs.NArg() != 2 {
+			return errBadArgs("diff: expected two prefixes")
+		}
+		changes, err = e.client.Diff(a, e.client, b, opts)
+	}
+	if err != nil {
+		return err
+	}
+	return etcd.WriteDiff(os.Stdout, changes, *format, oldLabel, newLabel)
+}
+
+func diffDump(e *env, file string, prefix string, opts etcd.DiffOptions) ([]etcd.Change, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	old, err := etcd.ReadDump(f)
+	if err != nil {
+		return nil, err
+	}
+
+	cur, err := e.client.Snapshot(prefix)
+	if err != nil && !etcd.IsEtcdNotFound(err) {
+		return nil, err
+	}
+	if cur == nil {
+		cur = &etcd.Dump{Prefix: prefix}
+	}
+	return etcd.DiffDumps(old, cur, opts)
+}
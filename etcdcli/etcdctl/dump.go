@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"etcdcli/etcd"
+)
+
+func init() {
+	register(&command{name: "export", usage: "[--format json|yaml] [--file path] <prefix>", help: "dump a subtree to a file or stdout", quiet: true, run: runExport})
+	register(&command{name: "import", usage: "[--mode skip-existing|overwrite|mirror] [--prefix p] [--no-ttl] [--parallel n] [--dry-run] [--file path]", help: "restore a dump written by export", quiet: true, run: runImport})
+}
+
+func runExport(e *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "json", "dump format, json or yaml")
+	file := fs.String("file", "", "write the dump to this file instead of stdout")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *format != "json" && *format != "yaml" {
+		return errBadArgs("export: unsupported format " + *format)
+	}
+
+	if *file == "" {
+		return e.client.ExportFormat(args[0], os.Stdout, *format)
+	}
+
+	f, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+	err = e.client.ExportFormat(args[0], f, *format)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func runImport(e *env, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	mode := fs.String("mode", "skip-existing", "what to do with existing keys: skip-existing, overwrite or mirror")
+	prefix := fs.String("prefix", "", "write the dump under this prefix instead of its original one")
+	noTTL := fs.Bool("no-ttl", false, "do not restore TTLs")
+	parallel := fs.Int("parallel", 4, "number of concurrent writes")
+	dryRun := fs.Bool("dry-run", false, "only print the planned changes")
+	file := fs.String("file", "", "read the dump from this file instead of stdin")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	m, err := etcd.ParseImportMode(*mode)
+	if err != nil {
+		return errBadArgs(err.Error())
+	}
+
+	r := os.Stdin
+	if *file != "" {
+		if r, err = os.Open(*file); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+
+	stats, err := e.client.ImportWithOptions(r, etcd.ImportOptions{
+		Mode:        m,
+		Prefix:      *prefix,
+		PreserveTTL: !*noTTL,
+		Parallel:    *parallel,
+		DryRun:      *dryRun,
+		Out:         os.Stdout,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created %d, updated %d, deleted %d, skipped %d\n", stats.Created, stats.Updated, stats.Deleted, stats.Skipped)
+	return nil
+}
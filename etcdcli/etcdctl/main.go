@@ -0,0 +1,215 @@
+// etcdctl is a small etcdctl-style command line tool built on etcd.Client.
+//
+//	etcdctl [global options] <command> [command options] [arguments...]
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"etcdcli/etcd"
+	"golang.org/x/term"
+)
+
+// Exit codes. Anything returned by the etcd server that has no dedicated code
+// maps to ExitServerError.
+const (
+	ExitSuccess = iota
+	ExitBadArgs
+	ExitBadConnection
+	ExitBadAuth
+	ExitServerError
+	ExitClusterNotHealthy
+	ExitKeyNotFound
+	ExitTestFailed
+	ExitNodeExist
+	ExitNotFileOrDir
+	ExitDirNotEmpty
+)
+
+type globalFlags struct {
+	endpoints string
+	auth      string
+	timeout   time.Duration
+	certFile  string
+	keyFile   string
+	caFile    string
+	insecure  bool
+	output    string
+	api       string
+}
+
+// newClient builds the clients of the commands, tests replace it.
+var newClient = etcd.NewClientWithConfig
+
+// errBadArgs marks usage errors so they map to ExitBadArgs.
+type errBadArgs string
+
+func (e errBadArgs) Error() string { return string(e) }
+
+func main() {
+	var g globalFlags
+	fs := newGlobalFlagSet(&g)
+	fs.Usage = func() { usage(fs) }
+
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		os.Exit(ExitBadArgs)
+	}
+	if fs.NArg() == 0 {
+		usage(fs)
+		os.Exit(ExitBadArgs)
+	}
+
+	if !validFormat(g.output) {
+		fmt.Fprintf(os.Stderr, "Error: unsupported output format %q\n", g.output)
+		os.Exit(ExitBadArgs)
+	}
+
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", name)
+		usage(fs)
+		os.Exit(ExitBadArgs)
+	}
+
+	if g.auth != "" && !strings.Contains(g.auth, ":") {
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: reading password:", err)
+			os.Exit(ExitBadAuth)
+		}
+		g.auth += ":" + password
+	}
+
+	format := g.output
+	if cmd.quiet {
+		format = ""
+	}
+	cfg := etcd.Config{
+		Endpoints:          strings.Split(g.endpoints, ","),
+		Auth:               g.auth,
+		Timeout:            g.timeout,
+		CertFile:           g.certFile,
+		KeyFile:            g.keyFile,
+		CAFile:             g.caFile,
+		InsecureSkipVerify: g.insecure,
+		API:                g.api,
+		Format:             format,
+	}
+	client, err := newClient(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(ExitBadConnection)
+	}
+
+	// Ctrl-C stops long running commands such as watch.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		client.Close()
+	}()
+
+	err = cmd.run(&env{client: client, config: cfg, output: g.output}, fs.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		if _, ok := err.(errBadArgs); ok {
+			fmt.Fprintf(os.Stderr, "Usage: etcdctl %s %s\n", cmd.name, cmd.usage)
+		}
+	}
+	client.Close()
+	os.Exit(exitCode(err))
+}
+
+func newGlobalFlagSet(g *globalFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("etcdctl", flag.ContinueOnError)
+	fs.StringVar(&g.endpoints, "endpoints", "http://127.0.0.1:2379", "comma separated list of machine addresses in the cluster")
+	fs.StringVar(&g.auth, "username", "", "provide username[:password] (prompt if password is not supplied)")
+	fs.DurationVar(&g.timeout, "timeout", 5*time.Second, "request timeout")
+	fs.StringVar(&g.certFile, "cert-file", "", "identify HTTPS client using this SSL certificate file")
+	fs.StringVar(&g.keyFile, "key-file", "", "identify HTTPS client using this SSL key file")
+	fs.StringVar(&g.caFile, "ca-file", "", "verify certificates of HTTPS-enabled servers using this CA bundle")
+	fs.BoolVar(&g.insecure, "insecure-skip-tls-verify", false, "skip server certificate verification")
+	fs.StringVar(&g.api, "api", "v2", "etcd API of the cluster, v2 or v3")
+	fs.StringVar(&g.output, "output", "simple", "output response in the given format ("+strings.Join(etcd.Formats(), ", ")+")")
+	fs.StringVar(&g.output, "o", "simple", "shorthand for --output")
+	return fs
+}
+
+func usage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "Usage: etcdctl [global options] <command> [command options] [arguments...]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range commandNames() {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", cmd.name, cmd.help)
+	}
+	fmt.Fprintln(os.Stderr, "\nGlobal options:")
+	fs.PrintDefaults()
+}
+
+// readPassword prompts for the password of --username on the terminal, or
+// reads a line from stdin when it is not one.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func validFormat(name string) bool {
+	for _, format := range etcd.Formats() {
+		if format == name {
+			return true
+		}
+	}
+	return false
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return ExitSuccess
+	}
+	if _, ok := err.(errBadArgs); ok {
+		return ExitBadArgs
+	}
+	if err == errClusterNotHealthy {
+		return ExitClusterNotHealthy
+	}
+
+	switch {
+	case etcd.IsEtcdUnreachable(err),
+		errors.Is(err, context.DeadlineExceeded):
+		return ExitBadConnection
+	case etcd.IsEtcdUnauthorized(err):
+		return ExitBadAuth
+	case etcd.IsEtcdNotFound(err):
+		return ExitKeyNotFound
+	case etcd.IsEtcdTestFailed(err):
+		return ExitTestFailed
+	case etcd.IsEtcdNodeExist(err):
+		return ExitNodeExist
+	case etcd.IsEtcdNotFile(err), etcd.IsEtcdNotDir(err):
+		return ExitNotFileOrDir
+	case etcd.IsEtcdNotDirEmpty(err):
+		return ExitDirNotEmpty
+	}
+	return ExitServerError
+}
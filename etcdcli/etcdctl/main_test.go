@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"etcdcli/etcd"
+	etcdv2 "github.com/coreos/etcd/client"
+)
+
+func TestExitCode(t *testing.T) {
+	unreachable := &etcdv2.ClusterError{Errors: []error{errors.New("dial tcp: connection refused")}}
+	for _, tt := range []struct {
+		err  error
+		code int
+	}{
+		{nil, ExitSuccess},
+		{errBadArgs("get: expected 1 argument(s), got 0"), ExitBadArgs},
+		{unreachable, ExitBadConnection},
+		{fmt.Errorf("get /k: %w", unreachable), ExitBadConnection},
+		{etcdv2.ErrClusterUnavailable, ExitBadConnection},
+		{context.DeadlineExceeded, ExitBadConnection},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeUnauthorized}, ExitBadAuth},
+		{errClusterNotHealthy, ExitClusterNotHealthy},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeKeyNotFound}, ExitKeyNotFound},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeTestFailed}, ExitTestFailed},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeNodeExist}, ExitNodeExist},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeNotFile}, ExitNotFileOrDir},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeNotDir}, ExitNotFileOrDir},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeDirNotEmpty}, ExitDirNotEmpty},
+		{etcdv2.Error{Code: etcdv2.ErrorCodeRaftInternal}, ExitServerError},
+		{errors.New("anything else"), ExitServerError},
+	} {
+		if code := exitCode(tt.err); code != tt.code {
+			t.Errorf("%v: exit code %d, want %d", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestGlobalFlags(t *testing.T) {
+	var g globalFlags
+	fs := newGlobalFlagSet(&g)
+	if err := fs.Parse([]string{"-o", "json", "--endpoints", "a:2379,b:2379", "--timeout", "2s", "get", "/k"}); err != nil {
+		t.Fatal(err)
+	}
+	if g.output != "json" || g.endpoints != "a:2379,b:2379" || g.timeout != 2*time.Second || g.api != "v2" {
+		t.Errorf("flags %+v", g)
+	}
+	if args := fs.Args(); len(args) != 2 || args[0] != "get" || args[1] != "/k" {
+		t.Errorf("args %v", args)
+	}
+	if !validFormat("json") || validFormat("xml") {
+		t.Error("format validation")
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	c, err := etcd.NewClientWithConfig(etcd.Config{Backend: etcd.NewMemoryBackend()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	e := &env{client: c}
+
+	for _, tt := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"get"}, ExitBadArgs},
+		{[]string{"set", "/k"}, ExitBadArgs},
+		{[]string{"set", "--ttl", "soon", "/k", "v"}, ExitBadArgs},
+		{[]string{"set", "--nope", "/k", "v"}, ExitBadArgs},
+		{[]string{"ls", "/a", "/b"}, ExitBadArgs},
+		{[]string{"exec-watch", "/k", "echo"}, ExitBadArgs},
+		{[]string{"cp", "/k"}, ExitBadArgs},
+		{[]string{"cluster-health", "extra"}, ExitBadArgs},
+		{[]string{"migrate", "/k"}, ExitBadArgs},
+
+		{[]string{"set", "/k", "v"}, ExitSuccess},
+		{[]string{"get", "/k"}, ExitSuccess},
+		{[]string{"mk", "/k", "v"}, ExitNodeExist},
+		{[]string{"update", "/missing", "v"}, ExitKeyNotFound},
+		{[]string{"rm", "--with-value", "other", "/k"}, ExitTestFailed},
+		{[]string{"mkdir", "/d"}, ExitSuccess},
+		{[]string{"ls", "--recursive"}, ExitSuccess},
+		{[]string{"cp", "/k", "/k2"}, ExitSuccess},
+		{[]string{"mv", "/k2", "/k3"}, ExitSuccess},
+		{[]string{"get", "/k3"}, ExitSuccess},
+		{[]string{"set", "/d/x", "v"}, ExitSuccess},
+		{[]string{"rmdir", "/d"}, ExitDirNotEmpty},
+		{[]string{"rm", "/d"}, ExitNotFileOrDir},
+	} {
+		if code := exitCode(commands[tt.args[0]].run(e, tt.args[1:])); code != tt.code {
+			t.Errorf("%v: exit code %d, want %d", tt.args, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"etcdcli/etcd"
+)
+
+func init() {
+	register(&command{name: "migrate", usage: "--to endpoints [--separator s] [--dest-prefix p] [--lease-granularity d] [--follow] <prefix>", help: "copy a v2 subtree into flat v3 keys", quiet: true, run: runMigrate})
+}
+
+func runMigrate(e *env, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	to := fs.String("to", "", "comma separated endpoints of the v3 cluster")
+	var opts etcd.MigrateOptions
+	fs.StringVar(&opts.Separator, "separator", "/", "joins v2 path segments into v3 keys")
+	fs.StringVar(&opts.DestPrefix, "dest-prefix", "", "prefix of every v3 key")
+	fs.DurationVar(&opts.LeaseGranularity, "lease-granularity", time.Second, "keys expiring within this window share a lease")
+	follow := fs.Bool("follow", false, "keep replaying v2 changes until CTRL+C")
+	args, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *to == "" {
+		return errBadArgs("migrate: --to is required")
+	}
+	opts.Prefix = args[0]
+
+	cfg := e.config
+	cfg.Endpoints = strings.Split(*to, ",")
+	cfg.API = "v3"
+	cfg.Format = ""
+	dst, err := newClient(cfg)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	v3, ok := dst.V3()
+	if !ok {
+		return fmt.Errorf("migrate: %s is not served by the v3 backend", *to)
+	}
+
+	m := etcd.NewMigration(e.client, v3, opts)
+	report, err := m.Run()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated %d keys (%d directories, %d leases) at index %d, checksum %s\n",
+		report.Keys, report.Dirs, report.Leases, report.Index, report.Checksum)
+
+	if !*follow {
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, "following changes, CTRL+C to stop")
+	return watchError(m.Follow(report.Index))
+}
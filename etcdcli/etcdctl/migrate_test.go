@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"etcdcli/etcd"
+)
+
+func TestMigrateCommand(t *testing.T) {
+	src, err := etcd.NewClientWithConfig(etcd.Config{Backend: etcd.NewMemoryV2Backend()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	src.Set("/app/db/host", "h", 0, "", 0)
+
+	v3 := etcd.NewMemoryV3Client()
+	var target etcd.Config
+	defer func(orig func(etcd.Config) (*etcd.Client, error)) { newClient = orig }(newClient)
+	newClient = func(cfg etcd.Config) (*etcd.Client, error) {
+		target = cfg
+		return etcd.NewClientWithConfig(etcd.Config{Backend: etcd.NewV3Backend(v3)})
+	}
+
+	e := &env{client: src, config: etcd.Config{Endpoints: []string{"v2:2379"}, API: "v2", Format: "json"}}
+	if err := runMigrate(e, []string{"--to", "a:2379,b:2379", "--separator", ".", "--dest-prefix", "cfg", "/app"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.Endpoints) != 2 || target.Endpoints[1] != "b:2379" || target.API != "v3" || target.Format != "" {
+		t.Errorf("target config %+v", target)
+	}
+	kvs, _, _ := v3.Range(context.Background(), "cfg.app.db.host", false)
+	if len(kvs) != 1 || kvs[0].Value != "h" {
+		t.Errorf("migrated %+v", kvs)
+	}
+
+	// the target must be served by the v3 backend
+	newClient = func(cfg etcd.Config) (*etcd.Client, error) {
+		return etcd.NewClientWithConfig(etcd.Config{Backend: etcd.NewMemoryV2Backend()})
+	}
+	if err := runMigrate(e, []string{"--to", "a:2379", "/app"}); err == nil {
+		t.Error("migrated to a v2 backend")
+	}
+}
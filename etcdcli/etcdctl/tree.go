@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+
+	"etcdcli/etcd"
+)
+
+func init() {
+	register(&command{name: "cp", usage: "[--ttl] [--overwrite] [--parallel n] <src> <dst>", help: "copy a key or directory to a new name", quiet: true, run: runCopy})
+	register(&command{name: "mv", usage: "[--ttl] [--overwrite] [--parallel n] <src> <dst>", help: "move a key or directory to a new name", quiet: true, run: runMove})
+}
+
+func copyFlags(name string) (*flag.FlagSet, *etcd.CopyOptions) {
+	opts := &etcd.CopyOptions{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.BoolVar(&opts.PreserveTTL, "ttl", false, "keep the remaining TTL of copied keys")
+	fs.BoolVar(&opts.Overwrite, "overwrite", false, "write into an existing destination")
+	fs.IntVar(&opts.Parallel, "parallel", 4, "number of concurrent writes")
+	return fs, opts
+}
+
+func runCopy(e *env, args []string) error {
+	fs, opts := copyFlags("cp")
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return e.client.CopyTree(args[0], args[1], *opts)
+}
+
+func runMove(e *env, args []string) error {
+	fs, opts := copyFlags("mv")
+	args, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	return e.client.MoveTree(args[0], args[1], *opts)
+}
@@ -0,0 +1,133 @@
+// Package etcdpath canonicalizes and validates etcd keys.
+//
+// A canonical key starts with a slash, has no empty, "." or trailing
+// segments and no whitespace around its segments: " /a//b/ ./c/ " is
+// "/a/b/c". The root is "/".
+package etcdpath
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxKeyLength is the longest key accepted, in bytes.
+	MaxKeyLength = 4096
+	// MaxSegmentLength is the longest segment accepted, in bytes.
+	MaxSegmentLength = 255
+)
+
+// Error describes why a key is not valid.
+type Error struct {
+	Key    string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("etcdpath: invalid key %q: %s", e.Key, e.Reason)
+}
+
+// Clean returns the canonical form of key. ".." segments are kept, Validate
+// rejects them.
+func Clean(key string) string {
+	segments := Split(key)
+	if len(segments) == 0 {
+		return "/"
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// Split returns the segments of the canonical form of key, none for the
+// root.
+func Split(key string) []string {
+	var segments []string
+	for _, segment := range strings.Split(key, "/") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" || segment == "." {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// Join joins the elements with slashes and cleans the result.
+func Join(elem ...string) string {
+	return Clean(strings.Join(elem, "/"))
+}
+
+// Parent returns the directory of key, the root for the root.
+func Parent(key string) string {
+	segments := Split(key)
+	if len(segments) <= 1 {
+		return "/"
+	}
+	return "/" + strings.Join(segments[:len(segments)-1], "/")
+}
+
+// Base returns the last segment of key, "" for the root.
+func Base(key string) string {
+	segments := Split(key)
+	if len(segments) == 0 {
+		return ""
+	}
+	return segments[len(segments)-1]
+}
+
+// IsHidden reports whether a segment of key starts with "_". etcd v2 leaves
+// such nodes out of directory listings, so they are easily lost.
+func IsHidden(key string) bool {
+	for _, segment := range Split(key) {
+		if strings.HasPrefix(segment, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPrefix reports whether key is prefix or below it, segment-wise: /ab is
+// not below /a.
+func HasPrefix(key, prefix string) bool {
+	key, prefix = Clean(key), Clean(prefix)
+	return prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// Validate checks the canonical form of key: valid UTF-8, no ".." segment,
+// no control characters and within MaxKeyLength and MaxSegmentLength.
+// Hidden keys are valid, see IsHidden.
+func Validate(key string) error {
+	clean := Clean(key)
+	if len(clean) > MaxKeyLength {
+		return &Error{Key: key, Reason: fmt.Sprintf("longer than %d bytes", MaxKeyLength)}
+	}
+	if !utf8.ValidString(clean) {
+		return &Error{Key: key, Reason: "not valid UTF-8"}
+	}
+	for _, segment := range Split(clean) {
+		if segment == ".." {
+			return &Error{Key: key, Reason: `".." segment`}
+		}
+		if len(segment) > MaxSegmentLength {
+			return &Error{Key: key, Reason: fmt.Sprintf("segment longer than %d bytes", MaxSegmentLength)}
+		}
+		for _, r := range segment {
+			if unicode.IsControl(r) {
+				return &Error{Key: key, Reason: fmt.Sprintf("control character %U", r)}
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateVisible is Validate that also rejects hidden keys.
+func ValidateVisible(key string) error {
+	if err := Validate(key); err != nil {
+		return err
+	}
+	if IsHidden(key) {
+		return &Error{Key: key, Reason: `hidden segment starting with "_"`}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package etcdpath
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	for _, tt := range []struct {
+		key, clean, parent, base string
+		segments                 []string
+	}{
+		{"", "/", "/", "", nil},
+		{"/", "/", "/", "", nil},
+		{" / ./ //", "/", "/", "", nil},
+		{"a", "/a", "/", "a", []string{"a"}},
+		{"/a/b", "/a/b", "/a", "b", []string{"a", "b"}},
+		{"a/b/", "/a/b", "/a", "b", []string{"a", "b"}},
+		{" /a//b/ ./c/ ", "/a/b/c", "/a/b", "c", []string{"a", "b", "c"}},
+		{"/ a b /c", "/a b/c", "/a b", "c", []string{"a b", "c"}},
+		{"/a/../b", "/a/../b", "/a/..", "b", []string{"a", "..", "b"}},
+	} {
+		if clean := Clean(tt.key); clean != tt.clean {
+			t.Errorf("Clean(%q) = %q, want %q", tt.key, clean, tt.clean)
+		}
+		if segments := Split(tt.key); !reflect.DeepEqual(segments, tt.segments) {
+			t.Errorf("Split(%q) = %q, want %q", tt.key, segments, tt.segments)
+		}
+		if parent := Parent(tt.key); parent != tt.parent {
+			t.Errorf("Parent(%q) = %q, want %q", tt.key, parent, tt.parent)
+		}
+		if base := Base(tt.key); base != tt.base {
+			t.Errorf("Base(%q) = %q, want %q", tt.key, base, tt.base)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	for _, tt := range []struct {
+		elem []string
+		want string
+	}{
+		{nil, "/"},
+		{[]string{""}, "/"},
+		{[]string{"", "x"}, "/x"},
+		{[]string{"/a", "b/", "/c"}, "/a/b/c"},
+		{[]string{"/a/", " b ", "c/d"}, "/a/b/c/d"},
+		{[]string{"/", "/"}, "/"},
+	} {
+		if got := Join(tt.elem...); got != tt.want {
+			t.Errorf("Join(%q) = %q, want %q", tt.elem, got, tt.want)
+		}
+	}
+}
+
+func TestHasPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		key, prefix string
+		want        bool
+	}{
+		{"/a/b", "/a", true},
+		{"/a", "/a", true},
+		{"/a", "/a/", true},
+		{"/a/b", " a ", true},
+		{"a//b", "/a/./", true},
+		{"/x", "/", true},
+		{"/", "", true},
+		{"/ab", "/a", false},
+		{"/a", "/a/b", false},
+		{"/", "/a", false},
+	} {
+		if got := HasPrefix(tt.key, tt.prefix); got != tt.want {
+			t.Errorf("HasPrefix(%q, %q) = %v, want %v", tt.key, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	for key, want := range map[string]bool{
+		"/_a":    true,
+		"/a/_b":  true,
+		"_a/b":   true,
+		"/a/ _b": true,
+		"/a_b":   false,
+		"/a/b_":  false,
+		"/":      false,
+	} {
+		if got := IsHidden(key); got != want {
+			t.Errorf("IsHidden(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	long := strings.Repeat("/"+strings.Repeat("x", 250), 20)
+	for _, tt := range []struct {
+		key             string
+		reason, visible string
+	}{
+		{"/a/b", "", ""},
+		{" /a//b/ ", "", ""},
+		{"/", "", ""},
+		{"/é/日本", "", ""},
+		{"/a/../b", `".." segment`, `".." segment`},
+		{"/" + strings.Repeat("x", MaxSegmentLength), "", ""},
+		{"/" + strings.Repeat("x", MaxSegmentLength+1), "segment longer than 255 bytes", "segment longer than 255 bytes"},
+		{long, "longer than 4096 bytes", "longer than 4096 bytes"},
+		{"/a/\xff", "not valid UTF-8", "not valid UTF-8"},
+		{"/a\tb", "control character U+0009", "control character U+0009"},
+		{"/a/\x00", "control character U+0000", "control character U+0000"},
+		{"/_hidden/a", "", `hidden segment starting with "_"`},
+	} {
+		if reason := errorReason(Validate(tt.key)); reason != tt.reason {
+			t.Errorf("Validate(%.20q): %q, want %q", tt.key, reason, tt.reason)
+		}
+		if reason := errorReason(ValidateVisible(tt.key)); reason != tt.visible {
+			t.Errorf("ValidateVisible(%.20q): %q, want %q", tt.key, reason, tt.visible)
+		}
+	}
+
+	err := Validate("/a/..")
+	if want := `etcdpath: invalid key "/a/..": ".." segment`; err == nil || err.Error() != want {
+		t.Errorf("error %v, want %s", err, want)
+	}
+}
+
+func errorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.(*Error).Reason
+}
@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
 	//"github.com/coreos/go-etcd/etcd"
 
 	"etcdcli/etcd"
+	"etcdcli/etcdpath"
 	etcdv2 "github.com/coreos/etcd/client"
 	//"time"
 )
@@ -78,9 +80,24 @@ func NewClient(machines []string, namespace string, config interface{}) (*Client
 	if (err != nil) {
 		return nil, errors.New("etcd.NewClient")
 	}
+	return NewClientWithEtcd(etcdClient, namespace, config)
+}
+
+// NewClientWithEtcd works like NewClient on top of an existing etcd client,
+// e.g. one built by etcd.NewClientWithConfig for another backend (v3 or in
+// memory).
+func NewClientWithEtcd(etcdClient *etcd.Client, namespace string, config interface{}) (*Client, error) {
+	configValue := reflect.ValueOf(config)
+
+	if configValue.Kind() != reflect.Ptr ||
+		configValue.Elem().Kind() != reflect.Struct {
+
+		return nil, ErrInvalidConfig
+	}
+
 	c := &Client{
 		etcdClient: etcdClient,
-		namespace:  normalizeTag(namespace),
+		namespace:  strings.TrimPrefix(etcdpath.Clean(namespace), "/"),
 		config:     configValue,
 		info:       make(map[string]info),
 	}
@@ -88,6 +105,13 @@ func NewClient(machines []string, namespace string, config interface{}) (*Client
 	namespace = c.namespace
 	if len(namespace) > 0 {
 		namespace = "/" + namespace
+		if err := etcdpath.ValidateVisible(namespace); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateTags(configValue.Elem().Type(), namespace); err != nil {
+		return nil, err
 	}
 
 	c.preload(c.config, namespace)
@@ -302,6 +326,94 @@ func (c *Client) saveField(field reflect.Value, prefix string) error {
 	return nil
 }
 
+// SaveTxn stores the structure like Save, in one etcd.TxnGeneration commit
+// under the namespace, so that LoadTxn sees all of it or none of it, never
+// a mix of two saves. The keys are kept as generations (see etcd.TxnMode):
+// Load does not see them, read them with LoadTxn. When another SaveTxn
+// committed meanwhile it returns etcd.ErrTxnConflict and saves nothing.
+func (c *Client) SaveTxn() error {
+	txn, err := c.etcdClient.BeginTxn(c.txnRoot(), etcd.TxnGeneration)
+	if err != nil {
+		return err
+	}
+
+	// the structure replaces the whole generation, removed map entries
+	// included
+	for key := range txn.Snapshot() {
+		txn.Delete(key)
+	}
+	c.stageField(txn, c.config, "")
+	return txn.Commit()
+}
+
+func (c *Client) txnRoot() string {
+	return "/" + c.namespace
+}
+
+// stageField writes field into txn with the layout of saveField, relative to
+// the namespace. A transaction has no directories nor in-order keys: empty
+// maps and slices are left out, and slice items are keyed by their index.
+func (c *Client) stageField(txn *etcd.Txn, field reflect.Value, prefix string) {
+	if field.Kind() == reflect.Ptr {
+		field = field.Elem()
+	}
+
+	switch field.Kind() {
+	case reflect.Struct:
+		for i := 0; i < field.NumField(); i++ {
+			path := normalizeTag(field.Type().Field(i).Tag.Get("etcd"))
+			if len(path) == 0 {
+				continue
+			}
+			c.stageField(txn, field.Field(i), prefix+"/"+path)
+		}
+
+	case reflect.Map:
+		for _, key := range field.MapKeys() {
+			value := field.MapIndex(key)
+			path := prefix + "/" + key.String()
+
+			switch value.Kind() {
+			case reflect.Struct:
+				c.stageField(txn, value, path)
+
+			case reflect.String:
+				txn.Set(path, value.String())
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < field.Len(); i++ {
+			item := field.Index(i)
+
+			if item.Kind() == reflect.Struct {
+				c.stageField(txn, item, fmt.Sprintf("%s/%d", prefix, i))
+			} else if value, ok := formatValue(item); ok {
+				// sorted like the keys of MK
+				txn.Set(fmt.Sprintf("%s/%020d", prefix, i), value)
+			}
+		}
+
+	default:
+		if value, ok := formatValue(field); ok {
+			txn.Set(prefix, value)
+		}
+	}
+}
+
+// formatValue returns a string, int, int64 or bool as it is stored in etcd.
+func formatValue(value reflect.Value) (string, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return value.String(), true
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10), true
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool()), true
+	}
+	return "", false
+}
+
 /*
 func alreadyExistsError(err error) bool {
 	etcderr, ok := err.(*etcd.EtcdError)
@@ -353,6 +465,82 @@ func (c *Client) load(config reflect.Value, prefix string) error {
 	return nil
 }
 
+// LoadTxn retrieves the structure stored by SaveTxn into the given
+// structure, like Load, all of it from the same save. The version of every
+// field loaded is the index of that save.
+func (c *Client) LoadTxn() error {
+	txn, err := c.etcdClient.BeginTxn(c.txnRoot(), etcd.TxnGeneration)
+	if err != nil {
+		return err
+	}
+
+	namespace := c.namespace
+	if len(namespace) > 0 {
+		namespace = "/" + namespace
+	}
+	nodes := snapshotNodes(txn.Snapshot(), namespace, txn.Index())
+
+	config := c.config.Elem()
+	for i := 0; i < config.NumField(); i++ {
+		field := config.Field(i)
+		fieldType := config.Type().Field(i)
+
+		path := normalizeTag(fieldType.Tag.Get("etcd"))
+		if len(path) == 0 {
+			continue
+		}
+		path = namespace + "/" + path
+
+		node, ok := nodes[path]
+		switch {
+		case ok:
+		case field.Kind() == reflect.Map || field.Kind() == reflect.Slice:
+			// saved empty
+			node = &etcdv2.Node{Key: path, Dir: true, ModifiedIndex: txn.Index()}
+		default:
+			return etcdv2.Error{Code: etcdv2.ErrorCodeKeyNotFound, Message: "Key not found", Cause: path, Index: txn.Index()}
+		}
+
+		if err := c.fillField(field, node, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotNodes rebuilds the nodes of a Txn snapshot under prefix, as a
+// sorted recursive Get would return them, keyed by their path.
+func snapshotNodes(snapshot map[string]string, prefix string, index uint64) map[string]*etcdv2.Node {
+	nodes := make(map[string]*etcdv2.Node)
+	for key, value := range snapshot {
+		path := prefix + key
+		nodes[path] = &etcdv2.Node{Key: path, Value: value, ModifiedIndex: index}
+
+		for dir := path; ; {
+			child := nodes[dir]
+			dir = dir[:strings.LastIndex(dir, "/")]
+			if len(dir) <= len(prefix) {
+				break
+			}
+			parent, ok := nodes[dir]
+			if !ok {
+				parent = &etcdv2.Node{Key: dir, Dir: true, ModifiedIndex: index}
+				nodes[dir] = parent
+			}
+			parent.Nodes = append(parent.Nodes, child)
+			if ok {
+				break
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		sort.Sort(node.Nodes)
+	}
+	return nodes
+}
+
 /*
 
 // Watch keeps track of a specific field in etcd using a long polling strategy.
@@ -591,17 +779,37 @@ func (c *Client) getInfo(field interface{}) (path string, info info, err error)
 	return
 }
 
-// normalizeTag removes the slash from the beggining or end of the tag name and replace the other
-// slashs with hyphens. The idea is to limit the hierarchy to the configuration structure
+// normalizeTag removes the slashes and spaces around the tag name and replace the other slashs
+// with hyphens. The idea is to limit the hierarchy to the configuration structure
 func normalizeTag(tag string) string {
-	return tag
-	for strings.HasPrefix(tag, "/") {
-		tag = strings.TrimPrefix(tag, "/")
-	}
+	return strings.Join(etcdpath.Split(tag), "-")
+}
+
+// validateTags checks that every tag of the structure type, and of the structures in its slices and
+// maps, makes a valid key that is not hidden from the directory listings Load relies on
+func validateTags(configType reflect.Type, prefix string) error {
+	switch configType.Kind() {
+	case reflect.Struct:
+		for i := 0; i < configType.NumField(); i++ {
+			field := configType.Field(i)
+
+			path := normalizeTag(field.Tag.Get("etcd"))
+			if len(path) == 0 {
+				continue
+			}
+			path = prefix + "/" + path
 
-	for strings.HasSuffix(tag, "/") {
-		tag = strings.TrimSuffix(tag, "/")
+			if err := etcdpath.ValidateVisible(path); err != nil {
+				return fmt.Errorf("etcetera: field %s: %v", field.Name, err)
+			}
+			if err := validateTags(field.Type, path); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Map:
+		return validateTags(configType.Elem(), prefix)
 	}
 
-	return strings.Replace(tag, "/", "-", -1)
+	return nil
 }
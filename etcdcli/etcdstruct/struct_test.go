@@ -0,0 +1,258 @@
+package etcdstruct
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"etcdcli/etcd"
+)
+
+type txnServer struct {
+	Host string `etcd:"host"`
+	Port int    `etcd:"port"`
+}
+
+type txnConfig struct {
+	Name    string            `etcd:"name"`
+	Count   int64             `etcd:"count"`
+	Enabled bool              `etcd:"enabled"`
+	Server  txnServer         `etcd:"server"`
+	Labels  map[string]string `etcd:"labels"`
+	Tags    []string          `etcd:"tags"`
+	Ports   []int             `etcd:"ports"`
+	Servers []txnServer       `etcd:"servers"`
+	Empty   map[string]string `etcd:"empty"`
+}
+
+func newTestEtcd(t *testing.T) *etcd.Client {
+	c, err := etcd.NewClientWithConfig(etcd.Config{Backend: etcd.NewMemoryBackend()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSaveLoadTxn(t *testing.T) {
+	etc := newTestEtcd(t)
+	saved := txnConfig{
+		Name:    "app",
+		Count:   42,
+		Enabled: true,
+		Server:  txnServer{Host: "a", Port: 1},
+		Labels:  map[string]string{"env": "prod", "zone": "b"},
+		Tags:    []string{"z", "a", "m"},
+		Ports:   []int{80, 443},
+		Servers: []txnServer{{Host: "b", Port: 2}, {Host: "c", Port: 3}},
+		Empty:   map[string]string{},
+	}
+	c, err := NewClientWithEtcd(etc, "cfg", &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SaveTxn(); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded txnConfig
+	l, _ := NewClientWithEtcd(etc, "cfg", &loaded)
+	if err := l.LoadTxn(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("loaded %+v\nsaved %+v", loaded, saved)
+	}
+	version, err := l.Version(&loaded.Name)
+	if err != nil || version == 0 {
+		t.Errorf("version %d: %v", version, err)
+	}
+
+	// a removed map entry goes with the next save
+	delete(saved.Labels, "zone")
+	if err := c.SaveTxn(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.LoadTxn(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Labels, saved.Labels) {
+		t.Errorf("labels %v", loaded.Labels)
+	}
+	if v, _ := l.Version(&loaded.Name); v == version {
+		t.Errorf("version %d did not change with the save", v)
+	}
+
+	var missing txnConfig
+	m, _ := NewClientWithEtcd(etc, "none", &missing)
+	if err := m.LoadTxn(); !etcd.IsEtcdNotFound(err) {
+		t.Errorf("load of nothing saved: %v", err)
+	}
+}
+
+type pairConfig struct {
+	A int `etcd:"a"`
+	B int `etcd:"b"`
+}
+
+func TestLoadTxnConcurrentSave(t *testing.T) {
+	etc := newTestEtcd(t)
+
+	done := make(chan struct{})
+	var wg, started sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			var once sync.Once
+			start := func() { once.Do(started.Done) }
+			defer start()
+
+			var pair pairConfig
+			// its own view, the client lock would serialize the loads with
+			// the saves
+			r, _ := NewClientWithEtcd(etc.WithContext(context.Background()), "pair", &pair)
+			for loads := 0; ; loads++ {
+				if loads == 1 {
+					start()
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := r.LoadTxn(); err != nil && !etcd.IsEtcdNotFound(err) {
+					t.Error(err)
+					return
+				}
+				if pair.A != pair.B {
+					t.Errorf("mixed saves %+v", pair)
+					return
+				}
+			}
+		}()
+	}
+	started.Wait()
+
+	var pair pairConfig
+	w, _ := NewClientWithEtcd(etc.WithContext(context.Background()), "pair", &pair)
+	for i := 1; i <= 100; i++ {
+		pair = pairConfig{A: i, B: i}
+		if err := w.SaveTxn(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestNormalizeTag(t *testing.T) {
+	for tag, want := range map[string]string{
+		"host":         "host",
+		" host ":       "host",
+		"/host/":       "host",
+		" /db//host/ ": "db-host",
+		"./db/./host":  "db-host",
+		"a b/c":        "a b-c",
+		"":             "",
+		"/":            "",
+		" / ":          "",
+	} {
+		if got := normalizeTag(tag); got != want {
+			t.Errorf("normalizeTag(%q) = %q, want %q", tag, got, want)
+		}
+	}
+}
+
+type tagServer struct {
+	Host string `etcd:"host"`
+}
+
+type tagConfig struct {
+	Name    string               `etcd:" /app/name/ "`
+	Server  tagServer            `etcd:"server"`
+	Servers []tagServer          `etcd:"servers"`
+	ByName  map[string]tagServer `etcd:"by-name"`
+	Skipped string
+}
+
+func TestValidateTags(t *testing.T) {
+	if err := validateTags(reflect.TypeOf(tagConfig{}), "/cfg"); err != nil {
+		t.Errorf("valid tags: %v", err)
+	}
+	for _, tt := range []struct {
+		config interface{}
+		field  string
+	}{
+		{struct {
+			Secret string `etcd:"_secret"`
+		}{}, "Secret"},
+		{struct {
+			Up string `etcd:".."`
+		}{}, "Up"},
+		{struct {
+			Ctl string `etcd:"a\x01b"`
+		}{}, "Ctl"},
+		{struct {
+			Servers []struct {
+				Host string `etcd:"_host"`
+			} `etcd:"servers"`
+		}{}, "Host"},
+		{struct {
+			ByName map[string]struct {
+				Host string `etcd:" .. "`
+			} `etcd:"by-name"`
+		}{}, "Host"},
+	} {
+		err := validateTags(reflect.TypeOf(tt.config), "/cfg")
+		if err == nil || !strings.Contains(err.Error(), "field "+tt.field+":") {
+			t.Errorf("%T: %v", tt.config, err)
+		}
+	}
+}
+
+func TestNamespaceAndTags(t *testing.T) {
+	etc := newTestEtcd(t)
+	saved := tagConfig{Name: "app", Server: tagServer{Host: "a"}}
+	c, err := NewClientWithEtcd(etc, " /cfg// ", &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// the tag " /app/name/ " is the single segment app-name
+	if v, err := etc.Get("/cfg/app-name"); v != "app" || err != nil {
+		t.Errorf("saved name %q: %v", v, err)
+	}
+	if v, err := etc.Get("/cfg/server/host"); v != "a" || err != nil {
+		t.Errorf("saved host %q: %v", v, err)
+	}
+
+	var loaded tagConfig
+	l, err := NewClientWithEtcd(etc, "cfg", &loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Name != "app" || loaded.Server.Host != "a" {
+		t.Errorf("loaded %+v", loaded)
+	}
+
+	for _, namespace := range []string{"_cfg", "cfg/../x", "cfg/_private"} {
+		if _, err := NewClientWithEtcd(etc, namespace, &loaded); err == nil {
+			t.Errorf("namespace %q accepted", namespace)
+		}
+	}
+	var hidden struct {
+		Secret string `etcd:"_secret"`
+	}
+	if _, err := NewClientWithEtcd(etc, "cfg", &hidden); err == nil {
+		t.Error("hidden tag accepted")
+	}
+}